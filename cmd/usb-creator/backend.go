@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Volume identifies one of the two partitions createBootableUSB lays out
+type Volume int
+
+const (
+	// VolumeESP is the 512 MB EFI system partition
+	VolumeESP Volume = iota
+	// VolumeData is the partition holding the ISO contents and autoinstall files
+	VolumeData
+)
+
+const (
+	// ESP size unless overridden with --esp-size
+	defaultESPSize = "512M"
+
+	// Largest drive erased without --force
+	defaultMaxDriveSize = "256G"
+
+	// Location of the boot menu on both volumes
+	grubConfigPath = "boot/grub/grub.cfg"
+)
+
+func (v Volume) String() string {
+	if v == VolumeESP {
+		return "ESP"
+	}
+	return "Ubuntu"
+}
+
+// DiskBackend performs the platform-specific steps of building a stick.
+// createBootableUSB drives a backend through Clean, Partition, Format and
+// CopyISO, writes the generated configuration with WriteFile, and calls
+// Finish once everything succeeded. File names are slash-separated and
+// relative to the root of the given volume.
+type DiskBackend interface {
+	// ListDrives returns the drives this backend can write to
+	ListDrives() ([]DriveInfo, error)
+	// Clean removes any existing partition table and data
+	Clean(drive *DriveInfo) error
+	// Partition creates the GPT layout: the ESP followed by the data partition
+	Partition(drive *DriveInfo) error
+	// Format creates empty filesystems on both partitions
+	Format(drive *DriveInfo) error
+	// CopyISO copies the ISO contents to the data volume and the EFI and
+	// boot folders to the ESP
+	CopyISO(drive *DriveInfo, src treeSource) error
+	// WriteFile creates or replaces a file, creating parent folders as needed
+	WriteFile(drive *DriveInfo, vol Volume, name string, data []byte) error
+	// ReadFile returns the content of a file previously copied or written
+	ReadFile(drive *DriveInfo, vol Volume, name string) ([]byte, error)
+	// Finish flushes everything written and leaves the drive ready to eject
+	Finish(drive *DriveInfo) error
+	// Close releases mounts, handles and temporary files. It is safe to call
+	// whether or not Finish was reached.
+	Close() error
+}
+
+// createBootableUSB erases drive and builds the stick from the ISO contents
+// in src, reporting each step through p. guard, nil for disk images,
+// re-checks the drive's identity right before it is cleaned.
+func createBootableUSB(backend DiskBackend, drive *DriveInfo, src treeSource, config *Config, guard *driveGuard, p progress) error {
+	defer backend.Close()
+	defer src.Close()
+
+	// Read before the drive is erased, so a missing script leaves it intact
+	scripts, err := scriptFiles(config)
+	if err != nil {
+		return err
+	}
+
+	if guard != nil {
+		if err := guard.recheck(backend, drive); err != nil {
+			return fmt.Errorf("refusing to erase the drive: %v", err)
+		}
+	}
+
+	p("Step 1/6: Cleaning disk...")
+	if err := backend.Clean(drive); err != nil {
+		return fmt.Errorf("failed to clean disk: %v", err)
+	}
+
+	p("Step 2/6: Creating partitions...")
+	if err := backend.Partition(drive); err != nil {
+		return fmt.Errorf("failed to partition disk: %v", err)
+	}
+	if err := backend.Format(drive); err != nil {
+		return fmt.Errorf("failed to format partitions: %v", err)
+	}
+
+	p("Step 3/6: Extracting ISO contents...")
+	if err := backend.CopyISO(drive, src); err != nil {
+		return fmt.Errorf("failed to copy ISO contents: %v", err)
+	}
+
+	p("Step 4/6: Creating autoinstall configuration...")
+	configFiles, err := autoinstallConfigFiles(config)
+	if err != nil {
+		return err
+	}
+	for _, file := range configFiles {
+		if err := backend.WriteFile(drive, VolumeData, file.Name, file.Data); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path.Base(file.Name), err)
+		}
+	}
+
+	p("Step 5/6: Copying installation scripts...")
+	for _, file := range scripts {
+		if err := backend.WriteFile(drive, VolumeData, file.Name, file.Data); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", path.Base(file.Name), err)
+		}
+	}
+
+	// Modify grub.cfg to enable autoinstall
+	p("Configuring boot loader...")
+	for _, vol := range []Volume{VolumeData, VolumeESP} {
+		if err := modifyGrubConfig(backend, drive, vol); err != nil {
+			return fmt.Errorf("failed to update %s grub.cfg: %v", vol, err)
+		}
+	}
+
+	if err := backend.Finish(drive); err != nil {
+		return fmt.Errorf("failed to finish drive: %v", err)
+	}
+
+	// Read everything back from the drive itself, so a stick that silently
+	// corrupts data is caught now rather than halfway through an install
+	p("Step 6/6: Verifying written files...")
+	reports, err := verifyDisk(drive.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to verify drive: %v", err)
+	}
+	if !printVerifyReport(reports, p) {
+		return fmt.Errorf("files read back from the drive do not match what was written; the drive may be faulty")
+	}
+	return nil
+}
+
+// createBootableUSBs builds every drive at once, each with its own backend,
+// from a single read of the ISO, and returns each drive's outcome in order.
+func createBootableUSBs(backends []DiskBackend, drives []*DriveInfo, isoPath string, config *Config, guard *driveGuard) []error {
+	fanout := newISOFanout(isoPath, len(drives))
+	go fanout.run()
+
+	errs := make([]error, len(drives))
+	var wg sync.WaitGroup
+	for i := range drives {
+		p := newProgress("")
+		if len(drives) > 1 {
+			p = newProgress(fmt.Sprintf("[%d] ", drives[i].Number))
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = createBootableUSB(backends[i], drives[i], fanout.view(i), config, guard, p)
+			if errs[i] != nil && len(drives) > 1 {
+				p("❌ %v", errs[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// progress prints one line of a stick's progress. When several sticks are
+// made at once, each line starts with the drive it belongs to.
+type progress func(format string, args ...any)
+
+var progressMu sync.Mutex
+
+func newProgress(prefix string) progress {
+	return func(format string, args ...any) {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		fmt.Print("   ", prefix, fmt.Sprintf(format, args...), "\n")
+	}
+}
+
+// autoinstallFile is a file added next to the ISO contents on the data
+// volume. Name is slash-separated and relative to the volume root.
+type autoinstallFile struct {
+	Name string
+	Data []byte
+}
+
+// autoinstallConfigFiles returns the cloud-init user-data and meta-data.
+func autoinstallConfigFiles(config *Config) ([]autoinstallFile, error) {
+	// loadConfig hashed the password already
+	userData := generateUserData(config, config.PasswordHash)
+	metaData := fmt.Sprintf("instance-id: ubuntu-autoinstall\nlocal-hostname: %s\n", config.Hostname)
+	return []autoinstallFile{
+		{Name: "autoinstall/user-data", Data: []byte(userData)},
+		{Name: "autoinstall/meta-data", Data: []byte(metaData)},
+	}, nil
+}
+
+// installScripts are the first-boot scripts copied to the stick, the same
+// as create-usb.bat copies.
+var installScripts = []string{
+	"install-drivers.sh",
+	"post-install.sh",
+	"mount-drives.sh",
+	"install-gui.sh",
+	"configure-drives.sh",
+	"install-optional-features.sh",
+	"early-setup.sh",
+}
+
+// findScriptsDir looks for the scripts directory next to the binary, in
+// the working directory and two levels up, as findEnvFile does for .env.
+func findScriptsDir() (string, error) {
+	for _, dir := range []string{
+		filepath.Join(filepath.Dir(os.Args[0]), "..", "..", "scripts"),
+		"scripts",
+		filepath.Join("..", "..", "scripts"),
+	} {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("scripts directory not found; run the tool from the repository")
+}
+
+// scriptFiles returns the installation scripts from the local scripts
+// directory, followed by the generated config.env they read. Line endings
+// are converted to LF, as a checkout on Windows may have CRLF, which breaks
+// the scripts' interpreter line.
+func scriptFiles(config *Config) ([]autoinstallFile, error) {
+	scriptsSrcDir, err := findScriptsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []autoinstallFile
+	for _, script := range installScripts {
+		data, err := os.ReadFile(filepath.Join(scriptsSrcDir, script))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", script, err)
+		}
+		data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+		files = append(files, autoinstallFile{Name: "scripts/" + script, Data: data})
+	}
+	return append(files, autoinstallFile{Name: "scripts/config.env", Data: []byte(generateConfigEnv(config))}), nil
+}
+
+func modifyGrubConfig(backend DiskBackend, drive *DriveInfo, vol Volume) error {
+	content, err := backend.ReadFile(drive, vol, grubConfigPath)
+	if err != nil {
+		return nil // File might not exist
+	}
+	return backend.WriteFile(drive, vol, grubConfigPath, []byte(patchGrubConfig(string(content))))
+}
+
+// patchGrubConfig adds the autoinstall kernel parameters to every linux line
+// and shortens the menu timeout so the stick boots unattended.
+func patchGrubConfig(content string) string {
+	modified := content
+
+	// Add autoinstall parameter to linux boot line
+	re := regexp.MustCompile(`(linux\s+[^\n]+)`)
+	modified = re.ReplaceAllStringFunc(modified, func(match string) string {
+		if !strings.Contains(match, "autoinstall") {
+			return match + " autoinstall ds=nocloud;s=/cdrom/autoinstall/"
+		}
+		return match
+	})
+
+	// Set timeout to 5 seconds for automatic boot
+	timeoutRe := regexp.MustCompile(`set timeout=\d+`)
+	if timeoutRe.MatchString(modified) {
+		modified = timeoutRe.ReplaceAllString(modified, "set timeout=5")
+	}
+
+	// Add timeout_style for countdown display
+	if !strings.Contains(modified, "timeout_style") {
+		modified = strings.Replace(modified, "set timeout=5", "set timeout=5\nset timeout_style=countdown", 1)
+	}
+
+	return modified
+}
+
+// runTool runs an external command and includes its output in the error.
+func runTool(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v\nOutput: %s", name, err, output)
+	}
+	return nil
+}
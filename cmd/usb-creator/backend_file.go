@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+type fileBackendState int
+
+const (
+	fileStateNew fileBackendState = iota
+	fileStateCleaned
+	fileStatePartitioned
+	fileStateFormatted
+)
+
+// fileBackend targets a plain image file instead of a physical drive. Clean
+// creates the image at its full size, so the whole pipeline can run and be
+// inspected without a stick, admin rights or platform disk tools. Like a
+// real disk, steps must run in order. Partition writes the GPT into the
+// image and Format sets up the FAT32 writer for both partitions; Finish
+// writes the filesystem metadata.
+type fileBackend struct {
+	Path  string
+	Size  uint64
+	Sizes partitionSizes
+
+	state  fileBackendState
+	layout diskLayout
+	disk   *rawDisk
+}
+
+func newFileBackend(path string, size uint64, sizes partitionSizes) *fileBackend {
+	return &fileBackend{
+		Path:  path,
+		Size:  size,
+		Sizes: sizes,
+	}
+}
+
+func (b *fileBackend) drive() DriveInfo {
+	return DriveInfo{
+		Number:      0,
+		DeviceID:    b.Path,
+		MediaType:   "File",
+		Size:        b.Size,
+		SizeDisplay: fmt.Sprintf("%.2fGB", float64(b.Size)/(1024*1024*1024)),
+		Model:       "Disk image",
+		Letters:     "(none)",
+	}
+}
+
+func (b *fileBackend) ListDrives() ([]DriveInfo, error) {
+	return []DriveInfo{b.drive()}, nil
+}
+
+func (b *fileBackend) Clean(drive *DriveInfo) error {
+	if drive.DeviceID != b.Path {
+		return fmt.Errorf("unknown drive %s", drive.DeviceID)
+	}
+	// Recreate the image so no data from a previous run survives
+	f, err := os.Create(b.Path)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(int64(b.Size)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	b.state = fileStateCleaned
+	return nil
+}
+
+func (b *fileBackend) Partition(drive *DriveInfo) error {
+	if b.state != fileStateCleaned {
+		return fmt.Errorf("partition before clean")
+	}
+	layout, err := planLayout(b.Size, b.Sizes)
+	if err != nil {
+		return err
+	}
+	if err := writePartitionTable(b.Path, layout); err != nil {
+		return err
+	}
+	b.layout = layout
+	b.state = fileStatePartitioned
+	return nil
+}
+
+func (b *fileBackend) Format(drive *DriveInfo) error {
+	if b.state != fileStatePartitioned {
+		return fmt.Errorf("format before partition")
+	}
+	disk, err := openRawDisk(b.Path, b.layout)
+	if err != nil {
+		return err
+	}
+	b.disk = disk
+	b.state = fileStateFormatted
+	return nil
+}
+
+func (b *fileBackend) CopyISO(drive *DriveInfo, src treeSource) error {
+	if b.state != fileStateFormatted {
+		return fmt.Errorf("copy before format")
+	}
+	return b.disk.copyTree(src)
+}
+
+func (b *fileBackend) WriteFile(drive *DriveInfo, vol Volume, name string, data []byte) error {
+	if b.state != fileStateFormatted {
+		return fmt.Errorf("write before format")
+	}
+	return b.disk.writeFile(vol, name, data)
+}
+
+func (b *fileBackend) ReadFile(drive *DriveInfo, vol Volume, name string) ([]byte, error) {
+	if b.state != fileStateFormatted {
+		return nil, fmt.Errorf("read before format")
+	}
+	return b.disk.readFile(vol, name)
+}
+
+func (b *fileBackend) Finish(drive *DriveInfo) error {
+	if b.state != fileStateFormatted {
+		return fmt.Errorf("finish before format")
+	}
+	return b.disk.finish()
+}
+
+func (b *fileBackend) Close() error {
+	if b.disk == nil {
+		return nil
+	}
+	err := b.disk.close()
+	b.disk = nil
+	return err
+}
+
+// imageSizeFor returns the image size requested with --image-size, or when
+// none was given, a size that fits the ESP plus the ISO contents with room
+// for filesystem overhead and the autoinstall files.
+func imageSizeFor(requested, isoPath string, sizes partitionSizes) (uint64, error) {
+	if requested != "" {
+		size, err := parseSize(requested)
+		if err != nil {
+			return 0, fmt.Errorf("invalid image size %q: %v", requested, err)
+		}
+		return size, nil
+	}
+
+	// Leave room for the GPT structures and partition alignment
+	size := sizes.ESP + sizes.Data + 3<<20
+	if sizes.Data == 0 {
+		info, err := os.Stat(isoPath)
+		if err != nil {
+			return 0, err
+		}
+		size += uint64(info.Size())*11/10 + 256<<20
+	}
+	const mib = 1 << 20
+	return (size + mib - 1) / mib * mib, nil
+}
+
+// parseSize parses a byte count with an optional binary K, M, G or T suffix.
+func parseSize(s string) (uint64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := uint64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			s = s[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+// linuxBackend writes the GPT and both FAT32 filesystems straight to the
+// block device; nothing is mounted.
+type linuxBackend struct {
+	sizes  partitionSizes
+	layout diskLayout
+	disk   *rawDisk
+}
+
+func newPlatformBackend(sizes partitionSizes) (DiskBackend, error) {
+	return &linuxBackend{sizes: sizes}, nil
+}
+
+func (b *linuxBackend) ListDrives() ([]DriveInfo, error) {
+	return listUSBDrives()
+}
+
+func (b *linuxBackend) Clean(drive *DriveInfo) error {
+	// Desktop environments auto-mount sticks; release them before wiping,
+	// including filesystems on LVM or dm-crypt devices on top, the deepest
+	// mount points first
+	disks, err := mountedDisks()
+	if err != nil {
+		return err
+	}
+	points := disks[filepath.Base(drive.DeviceID)]
+	sort.Slice(points, func(i, j int) bool { return len(points[i]) > len(points[j]) })
+	for _, point := range points {
+		if err := runTool("umount", point); err != nil {
+			return err
+		}
+	}
+	return runTool("wipefs", "--all", "--force", drive.DeviceID)
+}
+
+func (b *linuxBackend) Partition(drive *DriveInfo) error {
+	layout, err := planLayout(drive.Size, b.sizes)
+	if err != nil {
+		return err
+	}
+	if err := writePartitionTable(drive.DeviceID, layout); err != nil {
+		return err
+	}
+	b.layout = layout
+	return nil
+}
+
+func (b *linuxBackend) Format(drive *DriveInfo) error {
+	disk, err := openRawDisk(drive.DeviceID, b.layout)
+	if err != nil {
+		return err
+	}
+	b.disk = disk
+	return nil
+}
+
+func (b *linuxBackend) CopyISO(drive *DriveInfo, src treeSource) error {
+	return b.disk.copyTree(src)
+}
+
+func (b *linuxBackend) WriteFile(drive *DriveInfo, vol Volume, name string, data []byte) error {
+	return b.disk.writeFile(vol, name, data)
+}
+
+func (b *linuxBackend) ReadFile(drive *DriveInfo, vol Volume, name string) ([]byte, error) {
+	return b.disk.readFile(vol, name)
+}
+
+func (b *linuxBackend) Finish(drive *DriveInfo) error {
+	if err := b.disk.finish(); err != nil {
+		return err
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+
+	// Drop cached blocks so verification reads from the stick itself, then
+	// have the kernel pick up the new table and filesystems, and wait for
+	// the partition device nodes to appear
+	if err := runTool("blockdev", "--flushbufs", drive.DeviceID); err != nil {
+		return err
+	}
+	if err := runTool("blockdev", "--rereadpt", drive.DeviceID); err != nil {
+		return err
+	}
+	exec.Command("udevadm", "settle").Run()
+	return nil
+}
+
+func (b *linuxBackend) Close() error {
+	if b.disk == nil {
+		return nil
+	}
+	err := b.disk.close()
+	b.disk = nil
+	return err
+}
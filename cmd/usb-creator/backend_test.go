@@ -0,0 +1,236 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sliceTree is a treeSource over a fixed list of items.
+type sliceTree struct {
+	items []*treeItem
+}
+
+func (s *sliceTree) Next() (*treeItem, error) {
+	if len(s.items) == 0 {
+		return nil, io.EOF
+	}
+	item := s.items[0]
+	s.items = s.items[1:]
+	return item, nil
+}
+
+func (s *sliceTree) Close() {}
+
+// fixtureTree returns a minimal ISO tree: a grub.cfg with an installer
+// entry, an EFI loader and a kernel.
+func fixtureTree(files map[string]string) *sliceTree {
+	tree := &sliceTree{}
+	for _, dir := range []string{"EFI", "EFI/boot", "boot", "boot/grub", "casper"} {
+		tree.items = append(tree.items, &treeItem{Name: dir, IsDir: true})
+	}
+	for _, name := range []string{"EFI/boot/bootx64.efi", "boot/grub/grub.cfg", "casper/vmlinuz"} {
+		data := files[name]
+		tree.items = append(tree.items, &treeItem{Name: name, Size: int64(len(data)), Data: strings.NewReader(data)})
+	}
+	return tree
+}
+
+const fixtureGrubConfig = `set timeout=30
+
+loadfont unicode
+
+menuentry "Try or Install Ubuntu Server" {
+	set gfxpayload=keep
+	linux	/casper/vmlinuz  ---
+	initrd	/casper/initrd
+}
+`
+
+// testConfig returns the defaults of the schema with a user set.
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	envFile := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(envFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Username = "labadmin"
+	config.Hostname = "test-host"
+	config.PasswordHash = sha512Crypt([]byte("secret"), "saltsalt", sha512CryptDefaultRounds)
+	return config
+}
+
+// readBack opens the partition of partType in the image at path and reads
+// name from it.
+func readBack(t *testing.T, path string, partType guid, name string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	parts, err := readGPT(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range parts {
+		if part.Type != partType {
+			continue
+		}
+		fsys, err := openFAT32(&regionDevice{
+			dev:    f,
+			offset: int64(part.FirstLBA * sectorSize),
+			size:   int64((part.LastLBA - part.FirstLBA + 1) * sectorSize),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := fsys.ReadFile(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		return string(data)
+	}
+	t.Fatalf("no partition of type %s", partType)
+	return ""
+}
+
+func TestCreateBootableUSBFileBackend(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "stick.img")
+	backend := newFileBackend(image, 100<<20, partitionSizes{ESP: 40 << 20})
+	drive := backend.drive()
+	config := testConfig(t)
+	files := map[string]string{
+		"EFI/boot/bootx64.efi": "efi loader",
+		"boot/grub/grub.cfg":   fixtureGrubConfig,
+		"casper/vmlinuz":       strings.Repeat("kernel", 10000),
+	}
+
+	err := createBootableUSB(backend, &drive, fixtureTree(files), config, nil, func(format string, args ...any) {
+		t.Logf(format, args...)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userData := readBack(t, image, gptTypeBasicData, "autoinstall/user-data")
+	for _, want := range []string{
+		"#cloud-config\n",
+		"    hostname: test-host\n",
+		"    username: labadmin\n",
+		"    password: " + config.PasswordHash + "\n",
+		"  timezone: America/New_York\n",
+	} {
+		if !strings.Contains(userData, want) {
+			t.Errorf("user-data lacks %q", want)
+		}
+	}
+	if got := readBack(t, image, gptTypeBasicData, "autoinstall/meta-data"); got != "instance-id: ubuntu-autoinstall\nlocal-hostname: test-host\n" {
+		t.Errorf("meta-data = %q", got)
+	}
+
+	for _, script := range installScripts {
+		want, err := os.ReadFile(filepath.Join("..", "..", "scripts", script))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := readBack(t, image, gptTypeBasicData, "scripts/"+script); got != strings.ReplaceAll(string(want), "\r\n", "\n") {
+			t.Errorf("scripts/%s differs from the repository's", script)
+		}
+	}
+	if got := readBack(t, image, gptTypeBasicData, "scripts/config.env"); got != generateConfigEnv(config) {
+		t.Errorf("config.env = %q, want %q", got, generateConfigEnv(config))
+	}
+
+	want := patchGrubConfig(fixtureGrubConfig)
+	for _, partType := range []guid{gptTypeESP, gptTypeBasicData} {
+		if got := readBack(t, image, partType, grubConfigPath); got != want {
+			t.Errorf("grub.cfg on %s = %q, want %q", partType, got, want)
+		}
+	}
+	if got := readBack(t, image, gptTypeESP, "EFI/boot/bootx64.efi"); got != files["EFI/boot/bootx64.efi"] {
+		t.Errorf("ESP bootx64.efi = %q", got)
+	}
+	if got := readBack(t, image, gptTypeBasicData, "casper/vmlinuz"); got != files["casper/vmlinuz"] {
+		t.Errorf("casper/vmlinuz differs after %d bytes", len(got))
+	}
+}
+
+func TestScriptFilesMissing(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// Every script but the last, with Windows line endings
+	if err := os.Mkdir("scripts", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, script := range installScripts[:len(installScripts)-1] {
+		if err := os.WriteFile(filepath.Join("scripts", script), []byte("#!/bin/bash\r\ntrue\r\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := testConfig(t)
+	if _, err := scriptFiles(config); err == nil || !strings.Contains(err.Error(), installScripts[len(installScripts)-1]) {
+		t.Errorf("scriptFiles with a script missing: got %v, want an error naming it", err)
+	}
+
+	// A missing script stops createBootableUSB before the drive is touched
+	image := filepath.Join(t.TempDir(), "stick.img")
+	backend := newFileBackend(image, 100<<20, partitionSizes{ESP: 40 << 20})
+	drive := backend.drive()
+	if err := createBootableUSB(backend, &drive, fixtureTree(nil), config, nil, t.Logf); err == nil {
+		t.Errorf("createBootableUSB succeeded without all scripts")
+	}
+	if _, err := os.Stat(image); !os.IsNotExist(err) {
+		t.Errorf("the image was written before the scripts were checked: %v", err)
+	}
+
+	last := installScripts[len(installScripts)-1]
+	if err := os.WriteFile(filepath.Join("scripts", last), []byte("#!/bin/bash\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	files, err := scriptFiles(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(installScripts)+1 {
+		t.Fatalf("scriptFiles returned %d files, want %d", len(files), len(installScripts)+1)
+	}
+	for _, file := range files[:len(installScripts)] {
+		if strings.Contains(string(file.Data), "\r") {
+			t.Errorf("%s keeps its CRLF line endings", file.Name)
+		}
+	}
+}
+
+func TestPatchGrubConfig(t *testing.T) {
+	got := patchGrubConfig(fixtureGrubConfig)
+	for _, want := range []string{
+		"set timeout=5\nset timeout_style=countdown\n",
+		"\tlinux\t/casper/vmlinuz  --- autoinstall ds=nocloud;s=/cdrom/autoinstall/\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("patched grub.cfg lacks %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "timeout=30") {
+		t.Errorf("patched grub.cfg keeps the old timeout:\n%s", got)
+	}
+
+	// Rewriting a stick patches the grub.cfg already on it again
+	if again := patchGrubConfig(got); again != got {
+		t.Errorf("patching twice changed grub.cfg:\n%s\nthen:\n%s", got, again)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+// windowsBackend wipes the disk with Clear-Disk and writes both FAT32
+// filesystems through the raw \\.\PhysicalDriveN handle. The GPT goes on
+// last: while the disk has no partition table Windows mounts no volumes on
+// it, and so never blocks writes to their sectors.
+type windowsBackend struct {
+	sizes  partitionSizes
+	layout diskLayout
+	disk   *rawDisk
+}
+
+func newPlatformBackend(sizes partitionSizes) (DiskBackend, error) {
+	return &windowsBackend{sizes: sizes}, nil
+}
+
+func (b *windowsBackend) ListDrives() ([]DriveInfo, error) {
+	return listUSBDrives()
+}
+
+func (b *windowsBackend) Clean(drive *DriveInfo) error {
+	cleanScript := fmt.Sprintf(`
+		$disk = Get-Disk -Number %d
+		$disk | Clear-Disk -RemoveData -RemoveOEM -Confirm:$false -ErrorAction SilentlyContinue
+	`, drive.Number)
+	cmd := exec.Command("powershell", "-Command", cleanScript)
+	cmd.Run() // Ignore error as disk might already be clean
+	return nil
+}
+
+func (b *windowsBackend) Partition(drive *DriveInfo) error {
+	layout, err := planLayout(drive.Size, b.sizes)
+	if err != nil {
+		return err
+	}
+	b.layout = layout
+	return nil
+}
+
+func (b *windowsBackend) Format(drive *DriveInfo) error {
+	disk, err := openRawDisk(drive.DeviceID, b.layout)
+	if err != nil {
+		return err
+	}
+	b.disk = disk
+	return nil
+}
+
+func (b *windowsBackend) CopyISO(drive *DriveInfo, src treeSource) error {
+	return b.disk.copyTree(src)
+}
+
+func (b *windowsBackend) WriteFile(drive *DriveInfo, vol Volume, name string, data []byte) error {
+	return b.disk.writeFile(vol, name, data)
+}
+
+func (b *windowsBackend) ReadFile(drive *DriveInfo, vol Volume, name string) ([]byte, error) {
+	return b.disk.readFile(vol, name)
+}
+
+func (b *windowsBackend) Finish(drive *DriveInfo) error {
+	if err := b.disk.finish(); err != nil {
+		return err
+	}
+	if err := b.Close(); err != nil {
+		return err
+	}
+	if err := writePartitionTable(drive.DeviceID, b.layout); err != nil {
+		return err
+	}
+
+	// Make Windows re-read the new table and mount the volumes
+	return runDiskpart("rescan\nexit\n")
+}
+
+func (b *windowsBackend) Close() error {
+	if b.disk == nil {
+		return nil
+	}
+	err := b.disk.close()
+	b.disk = nil
+	return err
+}
+
+// diskpartMu keeps diskpart runs from overlapping when several sticks
+// finish at once.
+var diskpartMu sync.Mutex
+
+// runDiskpart writes script to a temporary file and runs it with diskpart /s.
+func runDiskpart(script string) error {
+	diskpartMu.Lock()
+	defer diskpartMu.Unlock()
+
+	tmpFile, err := os.CreateTemp("", "diskpart*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.WriteString(script); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	tmpFile.Close()
+
+	cmd := exec.Command("diskpart", "/s", tmpFile.Name())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("diskpart failed: %v\nOutput: %s", err, output)
+	}
+	return nil
+}
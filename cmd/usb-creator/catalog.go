@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Lists every LTS release with its codename and support status
+	metaReleaseLTSURL = "https://changelogs.ubuntu.com/meta-release-lts"
+
+	// Current point release ISOs of each series: amd64 on releases, the
+	// other architectures on cdimage
+	releasesURL        = "https://releases.ubuntu.com/"
+	cdimageReleasesURL = "https://cdimage.ubuntu.com/releases/"
+
+	// Cached catalog in DefaultDownloadDir, and how long it is used
+	// before the index is read again
+	catalogCacheName = "releases.json"
+	catalogMaxAge    = 24 * time.Hour
+
+	// The first LTS with autoinstall support
+	oldestAutoinstallSeries = "20.04"
+
+	defaultArch   = "amd64"
+	defaultFlavor = "live-server"
+)
+
+// Architectures and flavors looked up for every LTS release
+var (
+	catalogArchs   = []string{"amd64", "arm64"}
+	catalogFlavors = []string{"live-server", "desktop"}
+)
+
+// fallbackReleases is used when neither the release index nor a cached
+// catalog can be read. These point releases may have been removed from
+// releases.ubuntu.com since, but an ISO cached in downloads/ still works.
+var fallbackReleases = []ubuntuRelease{
+	{Series: "24.04", Codename: "noble", Name: "Noble Numbat", Version: "24.04.1", Arch: "amd64", Flavor: "live-server",
+		URL: "https://releases.ubuntu.com/24.04/ubuntu-24.04.1-live-server-amd64.iso"},
+	{Series: "22.04", Codename: "jammy", Name: "Jammy Jellyfish", Version: "22.04.5", Arch: "amd64", Flavor: "live-server",
+		URL: "https://releases.ubuntu.com/22.04/ubuntu-22.04.5-live-server-amd64.iso"},
+}
+
+// isoNamePattern matches the ISO names listed in SHA256SUMS, such as
+// ubuntu-24.04.3-live-server-amd64.iso.
+var isoNamePattern = regexp.MustCompile(`^ubuntu-(\d+\.\d+(?:\.\d+)?)-([a-z-]+)-([a-z0-9]+)\.iso$`)
+
+// ubuntuRelease is the newest point release ISO of one LTS series for one
+// architecture and flavor.
+type ubuntuRelease struct {
+	Series   string `json:"series"`   // 24.04
+	Codename string `json:"codename"` // noble
+	Name     string `json:"name"`     // Noble Numbat
+	Version  string `json:"version"`  // 24.04.3
+	Arch     string `json:"arch"`     // amd64
+	Flavor   string `json:"flavor"`   // live-server
+	URL      string `json:"url"`
+}
+
+// FileName is the name of the ISO, which is also its name in downloads/.
+func (r ubuntuRelease) FileName() string {
+	return path.Base(r.URL)
+}
+
+func (r ubuntuRelease) String() string {
+	if r.Name == "" {
+		return fmt.Sprintf("Ubuntu %s LTS", r.Version)
+	}
+	return fmt.Sprintf("Ubuntu %s LTS (%s)", r.Version, r.Name)
+}
+
+// releaseCatalog is the set of releases the tool offers. A local catalog
+// file given with --catalog uses the same JSON format as the cache.
+type releaseCatalog struct {
+	Updated  time.Time       `json:"updated"`
+	Releases []ubuntuRelease `json:"releases"`
+}
+
+// find returns the releases for arch and flavor, newest series first.
+func (c *releaseCatalog) find(arch, flavor string) []ubuntuRelease {
+	var found []ubuntuRelease
+	for _, r := range c.Releases {
+		if r.Arch == arch && r.Flavor == flavor {
+			found = append(found, r)
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return compareVersions(found[i].Version, found[j].Version) > 0
+	})
+	return found
+}
+
+// loadCatalog returns the release catalog: the local file if one is given,
+// else the cached catalog while it is fresh, else the release index read
+// anew. When the index cannot be read, a stale cache or fallbackReleases
+// are used instead.
+func loadCatalog(localPath string) (*releaseCatalog, error) {
+	if localPath != "" {
+		return readCatalog(localPath)
+	}
+
+	cachePath := filepath.Join(DefaultDownloadDir, catalogCacheName)
+	cached, cacheErr := readCatalog(cachePath)
+	if cacheErr == nil && time.Since(cached.Updated) < catalogMaxAge {
+		return cached, nil
+	}
+
+	catalog, err := fetchCatalog()
+	if err == nil {
+		if err := writeCatalog(cachePath, catalog); err != nil {
+			fmt.Printf("⚠️  Could not cache the release catalog: %v\n", err)
+		}
+		return catalog, nil
+	}
+	if cacheErr == nil {
+		fmt.Printf("⚠️  Could not update the release catalog (%v); using the one from %s\n",
+			err, cached.Updated.Format("2006-01-02"))
+		return cached, nil
+	}
+	fmt.Printf("⚠️  Could not read the release catalog (%v); offering built-in releases\n", err)
+	return &releaseCatalog{Releases: fallbackReleases}, nil
+}
+
+func readCatalog(filePath string) (*releaseCatalog, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var catalog releaseCatalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	for i, r := range catalog.Releases {
+		if r.Version == "" || r.URL == "" {
+			return nil, fmt.Errorf("%s: release %d needs a version and a url", filePath, i+1)
+		}
+		if r.Series == "" {
+			catalog.Releases[i].Series = seriesOf(r.Version)
+		}
+	}
+	return &catalog, nil
+}
+
+func writeCatalog(filePath string, catalog *releaseCatalog) error {
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, append(data, '\n'), 0644)
+}
+
+// fetchCatalog reads the supported LTS releases from the meta-release index
+// and finds the newest point release ISO of each in the SHA256SUMS of its
+// release folders.
+func fetchCatalog() (*releaseCatalog, error) {
+	index, err := httpGetBytes(metaReleaseLTSURL)
+	if err != nil {
+		return nil, err
+	}
+	catalog := &releaseCatalog{Updated: time.Now().UTC()}
+	for _, lts := range parseMetaRelease(index) {
+		for _, arch := range catalogArchs {
+			dir := releaseDirURL(lts.Series, arch)
+			sums, err := httpGetBytes(dir + "SHA256SUMS")
+			if err != nil {
+				// Not every series has ISOs for every architecture
+				continue
+			}
+			for _, flavor := range catalogFlavors {
+				if version, name, ok := newestISO(sums, arch, flavor); ok {
+					release := lts
+					release.Version, release.Arch, release.Flavor, release.URL = version, arch, flavor, dir+name
+					catalog.Releases = append(catalog.Releases, release)
+				}
+			}
+		}
+	}
+	if len(catalog.Releases) == 0 {
+		return nil, fmt.Errorf("no LTS release ISOs found")
+	}
+	return catalog, nil
+}
+
+// releaseDirURL is the folder holding the ISOs of a series for arch.
+func releaseDirURL(series, arch string) string {
+	if arch == "amd64" {
+		return releasesURL + series + "/"
+	}
+	return cdimageReleasesURL + series + "/release/"
+}
+
+// parseMetaRelease returns the supported LTS series with autoinstall from
+// the meta-release-lts index, a list of "Key: value" stanzas separated by
+// blank lines.
+func parseMetaRelease(data []byte) []ubuntuRelease {
+	var releases []ubuntuRelease
+	stanza := make(map[string]string)
+	flush := func() {
+		series := seriesOf(stanza["Version"])
+		if stanza["Supported"] == "1" && series != "" && compareVersions(series, oldestAutoinstallSeries) >= 0 {
+			releases = append(releases, ubuntuRelease{Series: series, Codename: stanza["Dist"], Name: stanza["Name"]})
+		}
+		clear(stanza)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			flush()
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ":"); ok {
+			stanza[key] = strings.TrimSpace(value)
+		}
+	}
+	flush()
+	return releases
+}
+
+// seriesOf returns the series of a version such as "24.04.3 LTS", or "" if
+// it does not start with one.
+func seriesOf(version string) string {
+	fields := strings.Fields(version)
+	if len(fields) == 0 {
+		return ""
+	}
+	parts := strings.Split(fields[0], ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	for _, p := range parts[:2] {
+		if _, err := strconv.Atoi(p); err != nil {
+			return ""
+		}
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// newestISO finds the ISO with the highest point release for arch and
+// flavor in a SHA256SUMS file.
+func newestISO(sums []byte, arch, flavor string) (version, name string, ok bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		_, file, found := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !found || len(file) < 2 {
+			continue
+		}
+		file = file[1:] // '*' or ' ' for the mode
+		m := isoNamePattern.FindStringSubmatch(file)
+		if m == nil || m[2] != flavor || m[3] != arch {
+			continue
+		}
+		if !ok || compareVersions(m[1], version) > 0 {
+			version, name, ok = m[1], file, true
+		}
+	}
+	return version, name, ok
+}
+
+// compareVersions compares dotted version numbers such as 24.04 and
+// 24.04.3 and returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
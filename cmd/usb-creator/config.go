@@ -0,0 +1,342 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the installation configuration. It is the schema of .env:
+// every field names its key and default, which applies when the key is
+// missing or empty. Keys marked configenv are written to config.env on the
+// stick for the first-boot scripts; the rest only concern this tool.
+type Config struct {
+	// User
+	Username string `env:"INSTALL_USERNAME,configenv"`
+	Password string `env:"INSTALL_PASSWORD"`
+	// Other sources of the password, see resolvePassword, and how to hash it
+	PasswordHash      string `env:"INSTALL_PASSWORD_HASH"`
+	PasswordFile      string `env:"INSTALL_PASSWORD_FILE"`
+	PasswordCommand   string `env:"INSTALL_PASSWORD_COMMAND"`
+	PasswordAlgorithm string `env:"PASSWORD_HASH_ALGORITHM" default:"sha512"`
+	PasswordRounds    int    `env:"PASSWORD_HASH_ROUNDS" default:"5000"`
+	Hostname          string `env:"INSTALL_HOSTNAME,configenv" default:"random"`
+
+	// SSH
+	SSHAuthorizedKey string `env:"SSH_AUTHORIZED_KEYS,configenv"`
+
+	// Network
+	StaticIP   bool   `env:"STATIC_IP,configenv" default:"false"`
+	IPAddress  string `env:"IP_ADDRESS,configenv" default:"192.168.1.100"`
+	CIDRPrefix string `env:"CIDR_PREFIX"`       // 24, or a netmask; see prefixLength
+	Netmask    string `env:"NETMASK,configenv"` // the same; config.env has the prefix length
+	Gateway    string `env:"GATEWAY,configenv" default:"192.168.1.1"`
+	DNSServers string `env:"DNS_SERVERS,configenv" default:"8.8.8.8,8.8.4.4"`
+
+	// Basic installation options
+	InstallGUI     bool   `env:"INSTALL_GUI,configenv" default:"false"`
+	Timezone       string `env:"TIMEZONE,configenv" default:"America/New_York"`
+	Locale         string `env:"LOCALE,configenv" default:"en_US.UTF-8"`
+	KeyboardLayout string `env:"KEYBOARD_LAYOUT,configenv" default:"us"`
+	ExtraPackages  string `env:"EXTRA_PACKAGES,configenv" default:"htop,vim,curl,wget,git"`
+
+	// Drives
+	InteractiveDriveConfig bool `env:"INTERACTIVE_DRIVE_CONFIG,configenv" default:"false"`
+	AutoMountDrives        bool `env:"AUTO_MOUNT_DRIVES,configenv" default:"true"`
+
+	// Automation mode
+	Unattended       bool `env:"UNATTENDED,configenv" default:"true"`
+	ShowOptionalMenu bool `env:"SHOW_OPTIONAL_MENU,configenv" default:"false"`
+
+	// ISO sources
+	ISOMirrors    []string `env:"ISO_MIRRORS"`
+	ISOSearchDirs []string `env:"ISO_SEARCH_DIRS"`
+
+	// Downloads; see httpSettings
+	ProxyURL           string        `env:"PROXY_URL"`
+	ProxyUsername      string        `env:"PROXY_USERNAME"`
+	ProxyPassword      string        `env:"PROXY_PASSWORD"`
+	NoProxy            string        `env:"NO_PROXY"`
+	CABundle           string        `env:"CA_BUNDLE"`
+	HTTPConnectTimeout time.Duration `env:"HTTP_CONNECT_TIMEOUT" default:"30s"`
+	HTTPReadTimeout    time.Duration `env:"HTTP_READ_TIMEOUT" default:"60s"`
+
+	// Notifications
+	WebhookURL string `env:"WEBHOOK_URL,configenv"`
+
+	// Optional features: containers
+	InstallDocker    bool `env:"INSTALL_DOCKER,configenv" default:"true"`
+	InstallPortainer bool `env:"INSTALL_PORTAINER,configenv" default:"false"`
+
+	// Optional features: web management
+	InstallCockpit bool `env:"INSTALL_COCKPIT,configenv" default:"false"`
+	InstallWebmin  bool `env:"INSTALL_WEBMIN,configenv" default:"false"`
+
+	// Optional features: VPN and remote access
+	InstallTailscale bool   `env:"INSTALL_TAILSCALE,configenv" default:"false"`
+	InstallZeroTier  bool   `env:"INSTALL_ZEROTIER,configenv" default:"false"`
+	EnableWakeOnLAN  bool   `env:"ENABLE_WAKE_ON_LAN,configenv" default:"false"`
+	RTCWakeTime      string `env:"RTC_WAKE_TIME,configenv"`
+	LANCIDR          string `env:"LAN_CIDR,configenv"`
+
+	// Optional features: security
+	InstallFail2ban   bool `env:"INSTALL_FAIL2BAN,configenv" default:"true"`
+	ConfigureUFW      bool `env:"CONFIGURE_UFW,configenv" default:"true"`
+	HardenSSH         bool `env:"HARDEN_SSH,configenv" default:"true"`
+	EnableAutoUpdates bool `env:"ENABLE_AUTO_UPDATES,configenv" default:"true"`
+
+	// Optional features: file sharing
+	InstallSamba      bool   `env:"INSTALL_SAMBA,configenv" default:"false"`
+	SambaSharePath    string `env:"SAMBA_SHARE_PATH,configenv" default:"/srv/samba/share"`
+	InstallNFS        bool   `env:"INSTALL_NFS,configenv" default:"false"`
+	NFSExportPath     string `env:"NFS_EXPORT_PATH,configenv" default:"/srv/nfs/share"`
+	NFSAllowedNetwork string `env:"NFS_ALLOWED_NETWORK,configenv" default:"192.168.1.0/24"`
+
+	// Optional features: monitoring
+	InstallPrometheus   bool `env:"INSTALL_PROMETHEUS,configenv" default:"false"`
+	InstallNodeExporter bool `env:"INSTALL_NODE_EXPORTER,configenv" default:"false"`
+	InstallGrafana      bool `env:"INSTALL_GRAFANA,configenv" default:"false"`
+
+	// Optional features: observability
+	InstallSigNoz        bool   `env:"INSTALL_SIGNOZ,configenv" default:"false"`
+	InstallOtelCollector bool   `env:"INSTALL_OTEL_COLLECTOR,configenv" default:"false"`
+	OtelEndpoint         string `env:"OTEL_ENDPOINT,configenv" default:"signoz-internal.jeremy.ninja:4317"`
+
+	// Optional features: system
+	InstallAnsible     bool   `env:"INSTALL_ANSIBLE,configenv" default:"false"`
+	EnableTmpfsTmp     bool   `env:"ENABLE_TMPFS_TMP,configenv" default:"true"`
+	TmpfsTmpSize       string `env:"TMPFS_TMP_SIZE,configenv" default:"50%"`
+	ConfigureSwap      bool   `env:"CONFIGURE_SWAP,configenv" default:"true"`
+	SwapSizeGB         int    `env:"SWAP_SIZE_GB,configenv" default:"4"`
+	ConfigureZram      bool   `env:"CONFIGURE_ZRAM,configenv" default:"false"`
+	ZramSizeGB         string `env:"ZRAM_SIZE_GB,configenv" default:"auto"`
+	ConfigureNTP       bool   `env:"CONFIGURE_NTP,configenv" default:"true"`
+	InstallCommonTools bool   `env:"INSTALL_COMMON_TOOLS,configenv" default:"true"`
+
+	// Optional features: development tools
+	InstallDevTools bool   `env:"INSTALL_DEV_TOOLS,configenv" default:"true"`
+	GoVersion       string `env:"GO_VERSION,configenv" default:"1.22.0"`
+
+	// Line of .env each key is set on, for problem reports
+	lines map[string]int
+
+	// Where the password came from
+	passwordSource string
+}
+
+// configField is one field of Config with its schema tags.
+type configField struct {
+	Key       string
+	Default   string
+	ConfigEnv bool
+	Value     reflect.Value
+}
+
+// fields lists the settings of config in schema order.
+func (config *Config) fields() []configField {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		key, options, _ := strings.Cut(t.Field(i).Tag.Get("env"), ",")
+		if key == "" {
+			continue
+		}
+		fields = append(fields, configField{
+			Key:       key,
+			Default:   t.Field(i).Tag.Get("default"),
+			ConfigEnv: options == "configenv",
+			Value:     v.Field(i),
+		})
+	}
+	return fields
+}
+
+// set parses value into the field according to its type.
+func (f configField) set(value string) error {
+	switch f.Value.Interface().(type) {
+	case string:
+		f.Value.SetString(value)
+	case bool:
+		switch value {
+		case "true":
+			f.Value.SetBool(true)
+		case "false":
+			f.Value.SetBool(false)
+		default:
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("expected a whole number, got %q", value)
+		}
+		f.Value.SetInt(int64(n))
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("expected a duration such as 30s, got %q", value)
+		}
+		f.Value.SetInt(int64(d))
+	case []string:
+		f.Value.Set(reflect.ValueOf(splitList(value)))
+	default:
+		return fmt.Errorf("unsupported setting type %s", f.Value.Type())
+	}
+	return nil
+}
+
+// String formats the field as it is written to config.env.
+func (f configField) String() string {
+	switch v := f.Value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case time.Duration:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// findEnvFile returns the path of the .env file, looked for in the current
+// directory and two levels up, where it is when run from cmd/usb-creator.
+func findEnvFile() (string, error) {
+	envFile := ".env"
+	if _, err := os.Stat(envFile); os.IsNotExist(err) {
+		// Try parent directory
+		envFile = filepath.Join("..", "..", ".env")
+		if _, err := os.Stat(envFile); os.IsNotExist(err) {
+			return "", fmt.Errorf(".env file not found. Please copy .env.sample to .env and configure it")
+		}
+	}
+	return envFile, nil
+}
+
+// configProblem is a setting that cannot be used, at its line of .env (0
+// when the key is not set there).
+type configProblem struct {
+	Line    int
+	Key     string
+	Message string
+}
+
+// configError reports every problem found in a .env file, in file order.
+type configError struct {
+	Path     string
+	Problems []configProblem
+}
+
+// newConfigError returns problems as a configError, or nil if there are
+// none.
+func newConfigError(path string, problems []configProblem) error {
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return &configError{Path: path, Problems: problems}
+}
+
+func (e *configError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d problem(s) in %s:", len(e.Problems), e.Path)
+	for _, p := range e.Problems {
+		if p.Line > 0 {
+			fmt.Fprintf(&b, "\n  line %d: %s: %s", p.Line, p.Key, p.Message)
+		} else {
+			fmt.Fprintf(&b, "\n  %s: %s", p.Key, p.Message)
+		}
+	}
+	return b.String()
+}
+
+// readConfig reads every setting of the schema from the .env file at path,
+// without requiring any. All values that do not fit their type are
+// reported together.
+func readConfig(path string) (*Config, error) {
+	return readConfigKeys(path, nil)
+}
+
+// readConfigKeys is readConfig for only the settings in keys, or for all of
+// them when keys is nil. The others keep their zero values, and errors in
+// them are not reported.
+func readConfigKeys(path string, keys []string) (*Config, error) {
+	env, err := readEnvFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{lines: env.Lines}
+	var problems []configProblem
+	for _, f := range config.fields() {
+		if keys != nil && !slices.Contains(keys, f.Key) {
+			continue
+		}
+		value := env.Values[f.Key]
+		if value == "" {
+			value = f.Default
+		}
+		if err := f.set(value); err != nil {
+			problems = append(problems, configProblem{env.Lines[f.Key], f.Key, err.Error()})
+		}
+	}
+	if err := newConfigError(path, problems); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func loadConfig() (*Config, error) {
+	// Try to load .env file
+	envFile, err := findEnvFile()
+	if err != nil {
+		return nil, err
+	}
+	config, err := readConfig(envFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := newConfigError(envFile, config.validate()); err != nil {
+		return nil, err
+	}
+
+	if err := config.resolvePassword(); err != nil {
+		return nil, err
+	}
+
+	// Generate random hostname if set to "random" or empty
+	if config.Hostname == "random" {
+		config.Hostname = generateRandomHostname()
+	}
+	// The first-boot scripts read NETMASK as a prefix length
+	if prefix, err := config.prefixLength(); err == nil {
+		config.CIDRPrefix = strconv.Itoa(prefix)
+		config.Netmask = config.CIDRPrefix
+	}
+	return config, nil
+}
+
+// generateConfigEnv writes every setting the first-boot scripts read. They
+// take every line literally, so values that span lines, such as a list of
+// SSH keys, are written with \n between their lines.
+func generateConfigEnv(config *Config) string {
+	var b strings.Builder
+	b.WriteString("# Auto-generated configuration\n")
+	for _, f := range config.fields() {
+		if f.ConfigEnv {
+			fmt.Fprintf(&b, "%s=%s\n", f.Key, configEnvValue(f.String()))
+		}
+	}
+	return b.String()
+}
+
+// configEnvValue keeps a value on one line of config.env.
+func configEnvValue(value string) string {
+	value = strings.ReplaceAll(value, "\r", "")
+	return strings.ReplaceAll(strings.TrimRight(value, "\n"), "\n", `\n`)
+}
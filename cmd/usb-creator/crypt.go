@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// SHA-512 crypt rounds when none are given, and the range allowed
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMinRounds     = 1000
+	sha512CryptMaxRounds     = 999999999
+)
+
+// cryptAlphabet is the base-64 alphabet of crypt(3) hashes.
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptHashPattern matches the SHA-512 ($6$) and yescrypt ($y$) hashes
+// accepted as INSTALL_PASSWORD_HASH, as mkpasswd and /etc/shadow have them.
+var cryptHashPattern = regexp.MustCompile(`^(\$6\$(rounds=[0-9]+\$)?[./0-9A-Za-z]{1,16}\$[./0-9A-Za-z]{86}|\$y\$[./0-9A-Za-z]+\$[./0-9A-Za-z]+\$[./0-9A-Za-z]{43})$`)
+
+// hashPassword hashes password with a random salt in a crypt(3) format the
+// installer and /etc/shadow understand: "sha512" ($6$), with rounds, or
+// "yescrypt" ($y$) at the cost Ubuntu uses.
+func hashPassword(password []byte, algorithm string, rounds int) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	switch algorithm {
+	case "sha512":
+		for i := range salt {
+			salt[i] = cryptAlphabet[salt[i]&0x3f]
+		}
+		return sha512Crypt(password, string(salt), rounds), nil
+	case "yescrypt":
+		return yescryptCrypt(password, salt, yescryptDefaultNLog2, yescryptDefaultR), nil
+	}
+	return "", fmt.Errorf("unknown password hash algorithm %q", algorithm)
+}
+
+// sha512Crypt implements the SHA-512 crypt of glibc, as specified at
+// https://www.akkadia.org/drepper/SHA-crypt.txt. The salt is cut to 16
+// characters and rounds, clamped to the allowed range, is only written to
+// the hash when it is not the default.
+func sha512Crypt(password []byte, salt string, rounds int) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	rounds = min(max(rounds, sha512CryptMinRounds), sha512CryptMaxRounds)
+
+	b := sha512.New()
+	b.Write(password)
+	b.Write([]byte(salt))
+	b.Write(password)
+	digestB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write([]byte(salt))
+	n := len(password)
+	for ; n > 64; n -= 64 {
+		a.Write(digestB)
+	}
+	a.Write(digestB[:n])
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(password)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	// The byte sequences P and S, from the password and the salt repeated
+	dp := sha512.New()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeatDigest(dp.Sum(nil), len(password))
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write([]byte(salt))
+	}
+	s := repeatDigest(ds.Sum(nil), len(salt))
+
+	c := digestA
+	for i := 0; i < rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+	clear(p)
+
+	var out strings.Builder
+	out.WriteString("$6$")
+	if rounds != sha512CryptDefaultRounds {
+		out.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(salt + "$")
+	for i := 0; i < 21; i++ {
+		// The byte order of the specification: 0, 21, 42, then 22, 43, 1...
+		j := i * 22 % 63
+		encodeCrypt24(&out, c[j], c[(j+21)%63], c[(j+42)%63], 4)
+	}
+	encodeCrypt24(&out, 0, 0, c[63], 2)
+	return out.String()
+}
+
+// repeatDigest repeats digest up to n bytes.
+func repeatDigest(digest []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, digest[:min(len(digest), n-len(out))]...)
+	}
+	return out
+}
+
+// encodeCrypt24 writes n characters of the 24 bits b2:b1:b0, lowest first.
+func encodeCrypt24(out *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint32(b2)<<16 | uint32(b1)<<8 | uint32(b0)
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// The test vectors of https://www.akkadia.org/drepper/SHA-crypt.txt. The
+// one with rounds=5000 is written without it here, as sha512Crypt omits the
+// default; glibc keeps it only when the salt string names it.
+var sha512CryptVectors = []struct {
+	password, salt string
+	rounds         int
+	want           string
+}{
+	{"Hello world!", "saltstring", 5000,
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+	{"Hello world!", "saltstringsaltstring", 10000,
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+	{"This is just a test", "toolongsaltstring", 5000,
+		"$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	{"a very much longer text to encrypt.  This one even stretches over morethan one line.", "anotherlongsaltstring", 1400,
+		"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+	{"we have a short salt string but not a short password", "short", 77777,
+		"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+	{"a short string", "asaltof16chars..", 123456,
+		"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+	// Too few rounds are raised to the minimum
+	{"the minimum number is still observed", "roundstoolow", 10,
+		"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+}
+
+func TestSHA512Crypt(t *testing.T) {
+	for _, v := range sha512CryptVectors {
+		if got := sha512Crypt([]byte(v.password), v.salt, v.rounds); got != v.want {
+			t.Errorf("sha512Crypt(%q, %q, %d) =\n%s\nwant\n%s", v.password, v.salt, v.rounds, got, v.want)
+		}
+	}
+}
+
+// Hashes of libxcrypt's crypt(3) for settings with the salt encoded from
+// these bytes, at the cost Ubuntu uses.
+var yescryptVectors = []struct {
+	password, salt, want string
+}{
+	{"secret", "abcdefghijklmnop",
+		"$y$j9T$V7qMYJaNbVKOeh4PhtqPk/$hJwCJdTkn9AseI9yQVrRlHPr.MsAEPsSuYrOpEFYJR4"},
+	{"", "abcdefghijklmnop",
+		"$y$j9T$V7qMYJaNbVKOeh4PhtqPk/$f3QS7iqRou4HLvixNmDcRQau6RUhLaWKt.mzv32hmm8"},
+	{"Hello world!", "0123456789abcdef",
+		"$y$j9T$k2XAnEHBqQ1Ct2aMXFKNa/$39o5wp7xduX2w8qG2IzHqokdj9pOGk73sLyLgG3S/nA"},
+	{"ünïcödé password", strings.Repeat("\x00\xff", 8),
+		"$y$j9T$.wD.z1kz.wD.z1kz.wD.z1$TTrQOMRyuZQpWYM2k7FOg9f.o.dzR4Ibb0OjdWoav1D"},
+}
+
+func TestYescryptCrypt(t *testing.T) {
+	for _, v := range yescryptVectors {
+		got := yescryptCrypt([]byte(v.password), []byte(v.salt), yescryptDefaultNLog2, yescryptDefaultR)
+		if got != v.want {
+			t.Errorf("yescryptCrypt(%q, %q) =\n%s\nwant\n%s", v.password, v.salt, got, v.want)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	for _, tc := range []struct {
+		algorithm, prefix string
+	}{
+		{"sha512", "$6$rounds=10000$"},
+		{"yescrypt", "$y$j9T$"},
+	} {
+		hash, err := hashPassword([]byte("secret"), tc.algorithm, 10000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(hash, tc.prefix) || !cryptHashPattern.MatchString(hash) {
+			t.Errorf("%s hash %q is not a %s... crypt hash", tc.algorithm, hash, tc.prefix)
+		}
+	}
+	if _, err := hashPassword([]byte("secret"), "md5", 5000); err == nil {
+		t.Errorf("hashPassword accepted an unknown algorithm")
+	}
+}
+
+func TestCryptHashPattern(t *testing.T) {
+	var valid []string
+	for _, v := range sha512CryptVectors {
+		valid = append(valid, v.want)
+	}
+	for _, v := range yescryptVectors {
+		valid = append(valid, v.want)
+	}
+	for _, hash := range valid {
+		if !cryptHashPattern.MatchString(hash) {
+			t.Errorf("cryptHashPattern rejects %s", hash)
+		}
+	}
+
+	sha := sha512CryptVectors[0].want
+	yes := yescryptVectors[0].want
+	for _, hash := range []string{
+		"",
+		"secret",
+		"$1$saltsalt$qjXMvbEw8oaL.CzflDugX/", // MD5
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZF2T9", // SHA-256
+		strings.Replace(sha, "$6$", "$7$", 1),
+		sha[:len(sha)-1],                          // hash too short
+		sha + ".",                                 // hash too long
+		strings.Replace(sha, "saltstring", "", 1), // no salt
+		strings.Replace(sha, "saltstring", "salt*string", 1),
+		"$6$rounds=$saltstring$" + sha[len(sha)-86:], // rounds without a number
+		"$6$salt1234567890123$" + sha[len(sha)-86:],  // salt longer than 16
+		" " + sha,
+		sha + "\n",
+		yes[:len(yes)-1],
+		strings.Replace(yes, "$j9T$", "$$", 1), // no parameters
+		strings.Replace(yes, "V7qMYJaNbVKOeh4PhtqPk/", "", 1), // no salt
+		"*", "!", "!" + sha, // locked accounts
+	} {
+		if cryptHashPattern.MatchString(hash) {
+			t.Errorf("cryptHashPattern accepts %q", hash)
+		}
+	}
+}
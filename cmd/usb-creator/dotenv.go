@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// envKeyPattern matches the variable names a shell accepts.
+var envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envFile is a parsed .env file.
+type envFile struct {
+	Path   string
+	Values map[string]string
+	Lines  map[string]int // line each key was last set on
+}
+
+// readEnvFile parses a .env file with the dotenv rules:
+//
+//   - Blank lines and lines starting with # are skipped, and KEY=value may
+//     be preceded by "export ".
+//   - An unquoted value runs to the end of the line, or to a # after
+//     whitespace, and is trimmed. Backslashes in it are kept, so a plain
+//     KEY=value line means what it means to create-usb.bat and to the
+//     scripts reading config.env.
+//   - A 'single-quoted' value is taken literally.
+//   - A "double-quoted" value understands \n, \t, \r, \", \\ and \$.
+//   - Quoted values may span lines, e.g. for a list of SSH keys.
+//   - ${VAR} and ${VAR:-default}, in unquoted and double-quoted values, are
+//     replaced by an earlier key of the file or else an environment
+//     variable. A $ without braces is kept as it is.
+//
+// Errors name the file and line.
+func readEnvFile(filename string) (*envFile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+
+	p := &envParser{
+		env:  &envFile{Path: filename, Values: make(map[string]string), Lines: make(map[string]int)},
+		text: text,
+		line: 1,
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.env, nil
+}
+
+type envParser struct {
+	env  *envFile
+	text string
+	pos  int
+	line int
+}
+
+func (p *envParser) errorf(line int, format string, args ...any) error {
+	return fmt.Errorf("%s:%d: %s", p.env.Path, line, fmt.Sprintf(format, args...))
+}
+
+func (p *envParser) parse() error {
+	for p.pos < len(p.text) {
+		p.skipBlanks()
+		if p.pos >= len(p.text) {
+			break
+		}
+		switch p.text[p.pos] {
+		case '\n':
+			p.pos++
+			p.line++
+			continue
+		case '#':
+			p.restOfLine()
+			continue
+		}
+
+		line := p.line
+		eq := strings.IndexAny(p.text[p.pos:], "=\n")
+		if eq < 0 || p.text[p.pos+eq] == '\n' {
+			return p.errorf(line, "expected KEY=value, got %q", strings.TrimSpace(p.restOfLine()))
+		}
+		name := strings.TrimSpace(p.text[p.pos : p.pos+eq])
+		p.pos += eq + 1
+		if after, found := strings.CutPrefix(name, "export"); found && after != strings.TrimLeft(after, " \t") {
+			name = strings.TrimSpace(after)
+		}
+		if !envKeyPattern.MatchString(name) {
+			return p.errorf(line, "invalid key %q", name)
+		}
+
+		value, err := p.value(line)
+		if err != nil {
+			return err
+		}
+		p.env.Values[name] = value
+		p.env.Lines[name] = line
+	}
+	return nil
+}
+
+// skipBlanks skips spaces and tabs.
+func (p *envParser) skipBlanks() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// restOfLine returns the text up to the end of the line and moves past it.
+func (p *envParser) restOfLine() string {
+	end := strings.IndexByte(p.text[p.pos:], '\n')
+	if end < 0 {
+		end = len(p.text) - p.pos
+	}
+	s := p.text[p.pos : p.pos+end]
+	p.pos += end
+	if p.pos < len(p.text) {
+		p.pos++
+		p.line++
+	}
+	return s
+}
+
+// value parses the value starting at the current position, on line.
+func (p *envParser) value(line int) (string, error) {
+	p.skipBlanks()
+	if p.pos >= len(p.text) {
+		return "", nil
+	}
+
+	var value string
+	switch p.text[p.pos] {
+	case '\'':
+		end := strings.IndexByte(p.text[p.pos+1:], '\'')
+		if end < 0 {
+			return "", p.errorf(line, "unterminated single-quoted value")
+		}
+		value = p.text[p.pos+1 : p.pos+1+end]
+		p.line += strings.Count(value, "\n")
+		p.pos += end + 2
+	case '"':
+		var err error
+		if value, err = p.doubleQuoted(line); err != nil {
+			return "", err
+		}
+	default:
+		raw := p.restOfLine()
+		for i := 1; i < len(raw); i++ {
+			if raw[i] == '#' && (raw[i-1] == ' ' || raw[i-1] == '\t') {
+				raw = raw[:i]
+				break
+			}
+		}
+		return p.interpolate(strings.TrimSpace(raw), line)
+	}
+
+	// Only a comment may follow the closing quote
+	valueEnd := p.line
+	if rest := strings.TrimSpace(p.restOfLine()); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", p.errorf(valueEnd, "unexpected %q after the closing quote", rest)
+	}
+	return value, nil
+}
+
+// doubleQuoted parses a double-quoted value, handling escapes and ${VAR}.
+func (p *envParser) doubleQuoted(line int) (string, error) {
+	var b strings.Builder
+	for i := p.pos + 1; i < len(p.text); i++ {
+		c := p.text[i]
+		switch {
+		case c == '"':
+			p.pos = i + 1
+			return b.String(), nil
+		case c == '\\' && i+1 < len(p.text):
+			i++
+			switch e := p.text[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\', '$':
+				b.WriteByte(e)
+			case '\n':
+				// A line continuation, as in the shell
+				p.line++
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+		case c == '$' && strings.HasPrefix(p.text[i:], "${"):
+			end := strings.IndexByte(p.text[i:], '}')
+			if end < 0 || strings.Contains(p.text[i:i+end], "\n") {
+				return "", p.errorf(p.line, "unterminated ${ in value")
+			}
+			expanded, err := p.expand(p.text[i+2:i+end], p.line)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(expanded)
+			i += end
+		default:
+			if c == '\n' {
+				p.line++
+			}
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf(line, "unterminated double-quoted value")
+}
+
+// interpolate replaces the ${VAR} references in an unquoted value.
+func (p *envParser) interpolate(value string, line int) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			return "", p.errorf(line, "unterminated ${ in value")
+		}
+		expanded, err := p.expand(value[start+2:start+end], line)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value[:start])
+		b.WriteString(expanded)
+		value = value[start+end+1:]
+	}
+}
+
+// expand returns the value of a reference such as VAR or VAR:-default.
+func (p *envParser) expand(ref string, line int) (string, error) {
+	name, fallback, hasDefault := strings.Cut(ref, ":-")
+	if !envKeyPattern.MatchString(name) {
+		return "", p.errorf(line, "invalid variable reference ${%s}", ref)
+	}
+	value, ok := p.env.Values[name]
+	if !ok {
+		value, ok = os.LookupEnv(name)
+	}
+	if (!ok || value == "") && hasDefault {
+		return fallback, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeEnv writes content to a .env file in a temporary folder.
+func writeEnv(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadEnvFile(t *testing.T) {
+	t.Setenv("DOTENV_TEST_HOME", "/home/test")
+	t.Setenv("DOTENV_TEST_EMPTY", "")
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    map[string]string
+	}{
+		{"plain", "A=1\nB = two words \n", map[string]string{"A": "1", "B": "two words"}},
+		{"empty value", "A=\nB=  \n", map[string]string{"A": "", "B": ""}},
+		{"export", "export A=1\nexport\tB=2\nexported=3\n", map[string]string{"A": "1", "B": "2", "exported": "3"}},
+		{"comments and blank lines", "# comment\n\n   # indented\nA=1\n", map[string]string{"A": "1"}},
+		{"inline comment", "A=value # comment\nB=value\t# comment\n", map[string]string{"A": "value", "B": "value"}},
+		{"# without whitespace", "A=pass#word\nB=#start\n", map[string]string{"A": "pass#word", "B": "#start"}},
+		{"quoted # is kept", "A='a # b'\nB=\"c # d\" # comment\n", map[string]string{"A": "a # b", "B": "c # d"}},
+		{"backslashes unquoted", `A=C:\Users\test` + "\n", map[string]string{"A": `C:\Users\test`}},
+		{"single quotes are literal", `A='say "hi" \n ${DOTENV_TEST_HOME}'` + "\n", map[string]string{"A": `say "hi" \n ${DOTENV_TEST_HOME}`}},
+		{"embedded quotes", `A="say \"hi\" it's me"` + "\nB='it\"s'\n", map[string]string{"A": `say "hi" it's me`, "B": `it"s`}},
+		{"escapes", `A="tab\there\nnew\rret \\ \$HOME \q"` + "\n", map[string]string{"A": "tab\there\nnew\rret \\ $HOME \\q"}},
+		{"line continuation", "A=\"one \\\ntwo\"\nB=3\n", map[string]string{"A": "one two", "B": "3"}},
+		{"multi-line SSH keys",
+			"SSH_AUTHORIZED_KEYS=\"ssh-ed25519 AAAA one@host\nssh-rsa BBBB two@host\"\nNEXT=1\n",
+			map[string]string{"SSH_AUTHORIZED_KEYS": "ssh-ed25519 AAAA one@host\nssh-rsa BBBB two@host", "NEXT": "1"}},
+		{"multi-line single-quoted", "A='one\ntwo'\n", map[string]string{"A": "one\ntwo"}},
+		{"${VAR} from the file", "BASE=/srv\nA=${BASE}/data\nB=\"${BASE}/nfs\"\n", map[string]string{"BASE": "/srv", "A": "/srv/data", "B": "/srv/nfs"}},
+		{"${VAR} from the environment", "A=${DOTENV_TEST_HOME}/iso\n", map[string]string{"A": "/home/test/iso"}},
+		{"file before environment", "DOTENV_TEST_HOME=/root\nA=${DOTENV_TEST_HOME}\n", map[string]string{"DOTENV_TEST_HOME": "/root", "A": "/root"}},
+		{"${VAR:-default}", "A=${DOTENV_TEST_UNSET:-fallback}\nB=\"${DOTENV_TEST_EMPTY:-empty}\"\nC=${DOTENV_TEST_HOME:-unused}\n",
+			map[string]string{"A": "fallback", "B": "empty", "C": "/home/test"}},
+		{"unset without default", "A=x${DOTENV_TEST_UNSET}y\n", map[string]string{"A": "xy"}},
+		{"$ without braces", "A=$HOME\nB=\"cost $5\"\n", map[string]string{"A": "$HOME", "B": "cost $5"}},
+		{"later line wins", "A=1\nA=2\n", map[string]string{"A": "2"}},
+		{"CRLF and BOM", "\ufeffA=1\r\nB=\"2\"\r\n", map[string]string{"A": "1", "B": "2"}},
+		{"no final newline", "A=1", map[string]string{"A": "1"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env, err := readEnvFile(writeEnv(t, tc.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(env.Values, tc.want) {
+				t.Errorf("values = %q, want %q", env.Values, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadEnvFileLines(t *testing.T) {
+	env, err := readEnvFile(writeEnv(t, "# comment\nA=1\nB=\"multi\nline\"\n\nC='x\ny'\nD=4\nA=5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"A": 9, "B": 3, "C": 6, "D": 8}
+	if !reflect.DeepEqual(env.Lines, want) {
+		t.Errorf("lines = %v, want %v", env.Lines, want)
+	}
+}
+
+func TestReadEnvFileErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    string // the error after the file name
+	}{
+		{"unterminated double quote", "A=1\nB=\"open\nC=3\n", `:2: unterminated double-quoted value`},
+		{"unterminated single quote", "A=1\n\nB='open\n", `:3: unterminated single-quoted value`},
+		{"text after the quote", "A=\"x\"\nB=\"multi\nline\" extra\n", `:3: unexpected "extra" after the closing quote`},
+		{"no =", "A=1\nJUST_A_WORD\n", `:2: expected KEY=value, got "JUST_A_WORD"`},
+		{"invalid key", "A=1\n\n1BAD=x\n", `:3: invalid key "1BAD"`},
+		{"key with a space", "MY KEY=x\n", `:1: invalid key "MY KEY"`},
+		{"unterminated ${", "A=${HOME\n", `:1: unterminated ${ in value`},
+		{"unterminated ${ quoted", "A=1\nB=\"${HOME\"\n", `:2: unterminated ${ in value`},
+		{"invalid reference", "A=${1X}\n", `:1: invalid variable reference ${1X}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeEnv(t, tc.content)
+			_, err := readEnvFile(path)
+			if err == nil {
+				t.Fatalf("readEnvFile accepted %q", tc.content)
+			}
+			if want := path + tc.want; err.Error() != want {
+				t.Errorf("error = %q, want %q", err, want)
+			}
+		})
+	}
+}
+
+func TestReadConfigKeys(t *testing.T) {
+	// A mistake in another setting does not stop the network settings
+	path := writeEnv(t, "PASSWORD_HASH_ROUNDS=many\nHTTP_READ_TIMEOUT=90s\n")
+	config, err := readConfigKeys(path, httpKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.HTTPReadTimeout.Seconds() != 90 || config.HTTPConnectTimeout.Seconds() != 30 {
+		t.Errorf("timeouts %v and %v, want 90s and the default 30s", config.HTTPReadTimeout, config.HTTPConnectTimeout)
+	}
+	if _, err := readConfig(path); err == nil || !strings.Contains(err.Error(), "PASSWORD_HASH_ROUNDS") {
+		t.Errorf("readConfig: got %v, want an error for PASSWORD_HASH_ROUNDS", err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Failed attempts in a row, without any data received, before a
+	// download is abandoned
+	downloadAttempts = 5
+
+	// Wait before the first retry, doubled after every further failure
+	downloadRetryDelay    = 2 * time.Second
+	downloadRetryMaxDelay = time.Minute
+)
+
+// permanentError marks a download failure that retrying cannot fix, such as
+// a 404 or an HTML page instead of the ISO.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// downloadISO downloads the ISO to destPath from the first of urls, copies
+// of the same ISO, that works, moving on to the next when one keeps failing.
+// Data goes to destPath.tmp first, which is resumed with a Range request
+// when a previous run was interrupted, and only gets its final name once it
+// matches the signed Ubuntu checksum. With more than one connection, sources
+// that support it are downloaded in segments at once.
+func downloadISO(urls []string, destPath string, connections int) error {
+	// Create downloads directory
+	dir := filepath.Dir(destPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	fmt.Printf("Saving to: %s\n", destPath)
+
+	tmpPath := destPath + ".tmp"
+	var err error
+	for i, url := range urls {
+		if i > 0 {
+			fmt.Printf("\n⚠️  %v\n   Trying the next source...\n", err)
+		}
+		fmt.Printf("Downloading from: %s\n", url)
+		if err = downloadFrom(url, tmpPath, connections); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		// Leave nothing that looks like a download to resume
+		if info, statErr := os.Stat(tmpPath); statErr == nil && info.Size() == 0 {
+			os.Remove(tmpPath)
+			os.Remove(segmentStatePath(tmpPath))
+		}
+		return err
+	}
+	fmt.Println("\n✓ Download complete")
+	os.Remove(validatorPath(tmpPath))
+	os.Remove(segmentStatePath(tmpPath))
+
+	// Only a verified ISO gets its final name
+	fmt.Println("🔐 Verifying ISO checksum...")
+	if err := verifyISO(tmpPath, urls...); err != nil {
+		// Only a mismatch condemns the download. After any other failure,
+		// such as fetching SHA256SUMS, the next run verifies the complete
+		// .tmp again instead of downloading it anew.
+		if err == errChecksumMismatch {
+			os.Remove(tmpPath)
+		} else {
+			fmt.Printf("   Keeping %s to verify on the next run\n", tmpPath)
+		}
+		return err
+	}
+	fmt.Println("✓ ISO matches the signed Ubuntu checksum")
+
+	// Rename temp file
+	return os.Rename(tmpPath, destPath)
+}
+
+// downloadFrom downloads url into tmpPath over one connection, or in
+// segments over several. An interrupted segmented download is resumed in
+// segments whatever connections is, as its .tmp is not filled in order.
+func downloadFrom(url, tmpPath string, connections int) error {
+	if _, err := os.Stat(segmentStatePath(tmpPath)); err != nil && connections <= 1 {
+		return downloadWithRetries(url, func() (int64, error) {
+			return downloadAttempt(url, tmpPath)
+		})
+	}
+	err := downloadWithRetries(url, func() (int64, error) {
+		return downloadSegmented(url, tmpPath, max(connections, 1))
+	})
+	if errors.Is(err, errRangesUnsupported) {
+		fmt.Println("   The server does not support segmented downloads; using one connection")
+		abandonSegments(tmpPath)
+		err = downloadWithRetries(url, func() (int64, error) {
+			return downloadAttempt(url, tmpPath)
+		})
+	}
+	return err
+}
+
+// downloadWithRetries runs download attempts for url, retrying with growing
+// delays while the failures look temporary.
+func downloadWithRetries(url string, attempt func() (int64, error)) error {
+	delay := downloadRetryDelay
+	for failures := 0; ; {
+		received, err := attempt()
+		if err == nil {
+			return nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return err
+		}
+		// A connection that delivered data before it dropped is worth
+		// retrying again and again
+		if received > 0 {
+			failures, delay = 0, downloadRetryDelay
+		}
+		if failures++; failures >= downloadAttempts {
+			return fmt.Errorf("giving up on %s after %d attempts: %v", url, failures, err)
+		}
+		fmt.Printf("\n⚠️  Download interrupted: %v\n", err)
+		fmt.Printf("   Retrying in %s (attempt %d of %d)...\n", delay, failures+1, downloadAttempts)
+		time.Sleep(delay)
+		delay = min(delay*2, downloadRetryMaxDelay)
+	}
+}
+
+// downloadAttempt downloads url into tmpPath, continuing after the data
+// already there, and reports how many bytes it received.
+func downloadAttempt(url, tmpPath string) (int64, error) {
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	defer out.Close()
+	info, err := out.Stat()
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	offset := info.Size()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		// Without a validator, or when resuming from another mirror, the
+		// checksum still catches a file that changed in between
+		if data, err := os.ReadFile(validatorPath(tmpPath)); err == nil {
+			if from, validator, ok := strings.Cut(string(data), "\n"); ok && from == url {
+				req.Header.Set("If-Range", validator)
+			}
+		}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		if err := checkISOContentType(resp.Header.Get("Content-Type")); err != nil {
+			return 0, &permanentError{err}
+		}
+	}
+
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// A fresh download, or the file changed since the partial one
+		if offset > 0 {
+			fmt.Println("   The file on the server changed; starting over")
+		}
+		offset = 0
+		if err := out.Truncate(0); err != nil {
+			return 0, &permanentError{err}
+		}
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+		saveValidator(tmpPath, url, resp.Header)
+	case http.StatusPartialContent:
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			return 0, fmt.Errorf("server sent an unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		total = size
+		fmt.Printf("   Resuming at %.2f GB\n", float64(offset)/(1024*1024*1024))
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is complete already, or longer than the file
+		// on the server now is
+		if _, size, err := parseContentRange(resp.Header.Get("Content-Range")); err == nil && size == offset {
+			return 0, nil
+		}
+		out.Truncate(0)
+		os.Remove(validatorPath(tmpPath))
+		return 0, fmt.Errorf("partial download does not fit the file on the server; starting over")
+	default:
+		return 0, statusError(resp)
+	}
+
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return 0, &permanentError{err}
+	}
+	if total >= 0 {
+		fmt.Printf("File size: %.2f GB\n", float64(total)/(1024*1024*1024))
+	} else {
+		fmt.Println("File size: unknown")
+	}
+
+	// Create progress wrapper
+	counter := &writeCounter{Total: total, Downloaded: offset}
+	received, err := io.Copy(out, io.TeeReader(resp.Body, counter))
+	if err != nil {
+		return received, err
+	}
+	if total >= 0 && offset+received != total {
+		return received, io.ErrUnexpectedEOF
+	}
+	return received, out.Close()
+}
+
+// statusError describes a response the download cannot use. Server errors,
+// timeouts and rate limiting may pass; anything else is permanent.
+func statusError(resp *http.Response) error {
+	err := fmt.Errorf("server returned %s", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return &permanentError{err}
+}
+
+// checkISOContentType rejects responses that are clearly not an ISO, such as
+// the HTML error page of a proxy or a mirror.
+func checkISOContentType(contentType string) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("server sent an invalid Content-Type %q", contentType)
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml") {
+		return fmt.Errorf("server sent %s instead of an ISO image", mediaType)
+	}
+	return nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes first-last/size" or "bytes */size". The size is -1 when the server
+// sent "*".
+func parseContentRange(header string) (start, size int64, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	byteRange, sizeText, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	size = -1
+	if sizeText != "*" {
+		if size, err = strconv.ParseInt(sizeText, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+		}
+	}
+	if byteRange == "*" {
+		return 0, size, nil
+	}
+	first, _, ok := strings.Cut(byteRange, "-")
+	if start, err = strconv.ParseInt(first, 10, 64); !ok || err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %q", header)
+	}
+	return start, size, nil
+}
+
+// validatorPath holds the URL a partial download came from and the ETag or
+// Last-Modified date of the file there, which is sent as If-Range when
+// resuming from the same URL.
+func validatorPath(tmpPath string) string {
+	return tmpPath + ".validator"
+}
+
+// saveValidator remembers the validator of a download that is starting.
+func saveValidator(tmpPath, url string, header http.Header) {
+	validator := responseValidator(header)
+	if validator == "" {
+		os.Remove(validatorPath(tmpPath))
+		return
+	}
+	os.WriteFile(validatorPath(tmpPath), []byte(url+"\n"+validator), 0644)
+}
+
+// responseValidator returns the strong ETag, or else the Last-Modified date,
+// of a response, for use in If-Range. Weak ETags are not allowed there.
+func responseValidator(header http.Header) string {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	return validator
+}
+
+// writeCounter prints download progress. Total is -1 when the server did not
+// send the size.
+type writeCounter struct {
+	Total      int64
+	Downloaded int64
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	wc.Downloaded += int64(n)
+	printProgress(wc.Downloaded, wc.Total)
+	return n, nil
+}
+
+// printProgress overwrites the progress line; total is -1 when unknown.
+func printProgress(downloaded, total int64) {
+	if total <= 0 {
+		fmt.Printf("\r   Progress: %.2f GB", float64(downloaded)/(1024*1024*1024))
+		return
+	}
+	percentage := float64(downloaded) / float64(total) * 100
+	fmt.Printf("\r   Progress: %.1f%% (%.2f GB / %.2f GB)",
+		percentage,
+		float64(downloaded)/(1024*1024*1024),
+		float64(total)/(1024*1024*1024))
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+const testISOName = "ubuntu-24.04.1-live-server-amd64.iso"
+
+// isoServer serves an ISO, with Range requests, and the SHA256SUMS of its
+// release folder.
+type isoServer struct {
+	*httptest.Server
+	url  string
+	data []byte
+
+	sums, sig []byte // SHA256SUMS and its signature; 404 while nil
+	noRanges  bool   // answer every request with the whole file
+	cutAfter  int64  // when set, drop each response after this many bytes
+	served    atomic.Int64
+
+	mu       sync.Mutex
+	requests []http.Header // of the ISO, as received
+	active   sync.WaitGroup
+}
+
+func newISOServer(t *testing.T, data []byte) *isoServer {
+	t.Helper()
+	s := &isoServer{data: data}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/releases/24.04.1/"+testISOName, func(w http.ResponseWriter, r *http.Request) {
+		s.active.Add(1)
+		defer s.active.Done()
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Header.Clone())
+		s.mu.Unlock()
+		if s.noRanges {
+			r.Header.Del("Range")
+		}
+		w.Header().Set("ETag", s.etag())
+		http.ServeContent(&countingWriter{ResponseWriter: w, s: s, left: s.cutAfter}, r, testISOName, time.Time{}, bytes.NewReader(s.data))
+	})
+	mux.HandleFunc("/releases/24.04.1/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		if s.sums == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(s.sums)
+	})
+	mux.HandleFunc("/releases/24.04.1/SHA256SUMS.gpg", func(w http.ResponseWriter, r *http.Request) {
+		if s.sig == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(s.sig)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	s.url = s.URL + "/releases/24.04.1/" + testISOName
+	return s
+}
+
+// sign publishes a SHA256SUMS listing the ISO with hash, signed by key.
+func (s *isoServer) sign(t *testing.T, key *openpgp.Entity, hash string) {
+	t.Helper()
+	s.sums = []byte(hash + " *" + testISOName + "\n")
+	var sig bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&sig, key, bytes.NewReader(s.sums), nil); err != nil {
+		t.Fatal(err)
+	}
+	s.sig = sig.Bytes()
+}
+
+// lastRequest returns the headers of the latest request for the ISO.
+func (s *isoServer) lastRequest() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+// idle waits for the responses of aborted requests to finish, so that
+// served counts no more of them.
+func (s *isoServer) idle() {
+	s.active.Wait()
+}
+
+// etag returns the ETag the ISO is served with.
+func (s *isoServer) etag() string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(s.data))
+}
+
+// countingWriter counts the ISO bytes sent, not those of error pages, and
+// drops the connection after left of them, unless left is 0.
+type countingWriter struct {
+	http.ResponseWriter
+	s      *isoServer
+	left   int64
+	failed bool
+}
+
+func (w *countingWriter) WriteHeader(status int) {
+	w.failed = status >= 300
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return w.ResponseWriter.Write(p)
+	}
+	cut := w.left > 0 && int64(len(p)) >= w.left
+	if cut {
+		p = p[:w.left]
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.s.served.Add(int64(n))
+	w.left -= int64(n)
+	if cut {
+		w.ResponseWriter.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}
+	return n, err
+}
+
+// isoTestData returns size bytes that differ at every offset, so a resume
+// at the wrong place shows.
+func isoTestData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// inTempDir runs the rest of the test in a new empty working directory,
+// where DefaultDownloadDir is created.
+func inTempDir(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestDownloadISOKeepsUnverified(t *testing.T) {
+	inTempDir(t)
+	key := withSigningKey(t, true)
+	data := isoTestData(300 << 10)
+	server := newISOServer(t, data)
+	destPath := filepath.Join(DefaultDownloadDir, testISOName)
+
+	// SHA256SUMS cannot be fetched: the download is kept for the next run
+	if err := downloadISO([]string{server.url}, destPath, 1); err == nil || err == errChecksumMismatch {
+		t.Fatalf("downloadISO without SHA256SUMS: got %v, want a fetch error", err)
+	}
+	if info, err := os.Stat(destPath + ".tmp"); err != nil || info.Size() != int64(len(data)) {
+		t.Fatalf("the complete download was not kept: %v", err)
+	}
+
+	// which verifies it without downloading it again
+	server.sign(t, key, sha256Hex(data))
+	before := server.served.Load()
+	if err := downloadISO([]string{server.url}, destPath, 1); err != nil {
+		t.Fatal(err)
+	}
+	if sent := server.served.Load() - before; sent != 0 {
+		t.Errorf("the kept download was fetched again (%d bytes)", sent)
+	}
+	if got, err := os.ReadFile(destPath); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s differs from the served ISO: %v", destPath, err)
+	}
+}
+
+func TestDownloadISOMismatch(t *testing.T) {
+	inTempDir(t)
+	key := withSigningKey(t, true)
+	server := newISOServer(t, isoTestData(100<<10))
+	server.sign(t, key, strings.Repeat("0", 64))
+	destPath := filepath.Join(DefaultDownloadDir, testISOName)
+
+	if err := downloadISO([]string{server.url}, destPath, 1); err != errChecksumMismatch {
+		t.Fatalf("downloadISO = %v, want %v", err, errChecksumMismatch)
+	}
+	for _, name := range []string{destPath, destPath + ".tmp"} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s is left after a checksum mismatch", name)
+		}
+	}
+}
+
+func TestDownloadAttemptResume(t *testing.T) {
+	data := isoTestData(300 << 10)
+	server := newISOServer(t, data)
+	server.cutAfter = 100 << 10
+	tmpPath := filepath.Join(t.TempDir(), testISOName+".tmp")
+
+	// Each attempt is cut off and the next continues where it stopped,
+	// asking for the rest only while the file is unchanged
+	for want := int64(100 << 10); want < int64(len(data)); want += 100 << 10 {
+		if _, err := downloadAttempt(server.url, tmpPath); err == nil {
+			t.Fatal("the interrupted attempt succeeded")
+		}
+		if info, err := os.Stat(tmpPath); err != nil || info.Size() != want {
+			t.Fatalf("after an interruption the .tmp has %v bytes, want %d", info.Size(), want)
+		}
+		if validator, err := os.ReadFile(validatorPath(tmpPath)); err != nil || string(validator) != server.url+"\n"+server.etag() {
+			t.Fatalf("validator file = %q, %v", validator, err)
+		}
+	}
+	server.cutAfter = 0
+	before := server.served.Load()
+	if _, err := downloadAttempt(server.url, tmpPath); err != nil {
+		t.Fatal(err)
+	}
+	header := server.lastRequest()
+	if header.Get("Range") != "bytes=204800-" || header.Get("If-Range") != server.etag() {
+		t.Errorf("resumed with Range %q and If-Range %q", header.Get("Range"), header.Get("If-Range"))
+	}
+	if sent := server.served.Load() - before; sent != 100<<10 {
+		t.Errorf("the resumed attempt fetched %d bytes, want the missing %d", sent, 100<<10)
+	}
+	if got, err := os.ReadFile(tmpPath); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the resumed download differs from the served ISO: %v", err)
+	}
+}
+
+func TestDownloadAttemptRestarts(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		change func(s *isoServer) []byte // returns the ISO now served
+	}{
+		{"file changed", func(s *isoServer) []byte {
+			s.data = bytes.Repeat([]byte{0xa5}, len(s.data))
+			return s.data
+		}},
+		{"ranges ignored", func(s *isoServer) []byte {
+			s.noRanges = true
+			return s.data
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newISOServer(t, isoTestData(200<<10))
+			server.cutAfter = 50 << 10
+			tmpPath := filepath.Join(t.TempDir(), testISOName+".tmp")
+			if _, err := downloadAttempt(server.url, tmpPath); err == nil {
+				t.Fatal("the interrupted attempt succeeded")
+			}
+
+			want := tc.change(server)
+			server.cutAfter = 0
+			before := server.served.Load()
+			if _, err := downloadAttempt(server.url, tmpPath); err != nil {
+				t.Fatal(err)
+			}
+			if header := server.lastRequest(); header.Get("Range") != "bytes=51200-" {
+				t.Errorf("did not ask to resume: Range %q", header.Get("Range"))
+			}
+			// The whole file came again and replaced the partial one
+			if sent := server.served.Load() - before; sent != int64(len(want)) {
+				t.Errorf("fetched %d bytes, want the whole %d", sent, len(want))
+			}
+			if got, err := os.ReadFile(tmpPath); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("the download differs from the served ISO: %v", err)
+			}
+		})
+	}
+}
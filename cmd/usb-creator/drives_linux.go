@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// adminHint tells the user how to get raw disk access on this platform.
+const adminHint = "Please run with sudo."
+
+const (
+	sysBlockDir = "/sys/block"
+	udevDataDir = "/run/udev/data"
+
+	// Same ceiling the Windows Get-Disk filter uses for non-USB disks
+	maxCandidateSize = 256 << 30
+)
+
+func isAdmin() bool {
+	return os.Geteuid() == 0
+}
+
+// listUSBDrives enumerates whole disks from /sys/block and returns the ones
+// that look like removable media, using the same rules as the Windows
+// Get-Disk filter: anything on the USB bus, plus non-NVMe disks under 256 GB.
+func listUSBDrives() ([]DriveInfo, error) {
+	entries, err := os.ReadDir(sysBlockDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list drives: %v", err)
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mounts: %v", err)
+	}
+	system, err := systemDisks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the system disks: %v", err)
+	}
+	inUse, err := mountedDisks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the mounted disks: %v", err)
+	}
+
+	var drives []DriveInfo
+	number := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if isVirtualBlockDevice(name) {
+			continue
+		}
+		num := number
+		number++
+
+		dir := filepath.Join(sysBlockDir, name)
+		sectors, _ := strconv.ParseUint(readSysFile(dir, "size"), 10, 64)
+		size := sectors * 512
+		if size == 0 {
+			// Card reader slot with no card inserted
+			continue
+		}
+
+		udev := readUdevProperties(dir)
+		transport := blockTransport(dir, udev)
+		removable := readSysFile(dir, "removable") == "1"
+
+		if transport != "USB" && !removable && (size >= maxCandidateSize || transport == "NVMe") {
+			continue
+		}
+
+		letters := strings.Join(mountedPartitions(dir, name, mounts), ",")
+		if letters == "" {
+			letters = "(none)"
+		}
+
+		drives = append(drives, DriveInfo{
+			Number:      num,
+			DeviceID:    "/dev/" + name,
+			MediaType:   transport,
+			Size:        size,
+			SizeDisplay: fmt.Sprintf("%.2fGB", float64(size)/(1024*1024*1024)),
+			Model:       blockModel(dir, udev),
+			Serial:      blockSerial(dir, udev),
+			Letters:     letters,
+			IsRemovable: removable || transport == "USB",
+			System:      system[name],
+			Mounted:     strings.Join(inUse[name], ", "),
+		})
+	}
+
+	return drives, nil
+}
+
+// isVirtualBlockDevice reports whether a /sys/block entry is a kernel virtual
+// device (loop, ramdisk, device-mapper, optical, ...) rather than a disk.
+func isVirtualBlockDevice(name string) bool {
+	for _, prefix := range []string{"loop", "ram", "zram", "dm-", "md", "sr", "fd", "nbd"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func readSysFile(dir, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// readUdevProperties loads the E: properties udev recorded for a block
+// device. The database is optional; an empty map is returned without udev.
+func readUdevProperties(dir string) map[string]string {
+	props := make(map[string]string)
+	dev := readSysFile(dir, "dev")
+	if dev == "" {
+		return props
+	}
+
+	file, err := os.Open(filepath.Join(udevDataDir, "b"+dev))
+	if err != nil {
+		return props
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "E:") {
+			continue
+		}
+		parts := strings.SplitN(line[2:], "=", 2)
+		if len(parts) == 2 {
+			props[parts[0]] = parts[1]
+		}
+	}
+	return props
+}
+
+// blockTransport names the bus a disk hangs off, using udev's ID_BUS when
+// available and falling back to the shape of the sysfs device path.
+func blockTransport(dir string, udev map[string]string) string {
+	switch strings.ToLower(udev["ID_BUS"]) {
+	case "usb":
+		return "USB"
+	case "ata":
+		return "SATA"
+	case "nvme":
+		return "NVMe"
+	case "scsi":
+		return "SCSI"
+	}
+
+	path, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "Unknown"
+	}
+	switch {
+	case strings.Contains(path, "/usb"):
+		return "USB"
+	case strings.Contains(path, "/nvme"):
+		return "NVMe"
+	case strings.Contains(path, "/mmc"):
+		return "SD"
+	case strings.Contains(path, "/ata"):
+		return "SATA"
+	case strings.Contains(path, "/virtio"):
+		return "Virtio"
+	case strings.Contains(path, "/host"):
+		return "SCSI"
+	}
+	return "Unknown"
+}
+
+func blockModel(dir string, udev map[string]string) string {
+	vendor := readSysFile(dir, "device/vendor")
+	model := readSysFile(dir, "device/model")
+	if model == "" {
+		model = readSysFile(dir, "device/name") // MMC/SD cards
+	}
+	if model == "" {
+		model = strings.ReplaceAll(udev["ID_MODEL"], "_", " ")
+	}
+	// Virtio and PCI devices expose a hex vendor ID rather than a name
+	if strings.HasPrefix(vendor, "0x") {
+		vendor = ""
+	}
+	name := strings.TrimSpace(vendor + " " + model)
+	if name == "" {
+		return "Unknown"
+	}
+	return name
+}
+
+func blockSerial(dir string, udev map[string]string) string {
+	if serial := udev["ID_SERIAL_SHORT"]; serial != "" {
+		return serial
+	}
+	if serial := readSysFile(dir, "device/serial"); serial != "" {
+		return serial
+	}
+	return readSysFile(dir, "serial")
+}
+
+// mountedPartitions returns the mount points of the disk and any of its
+// partitions, in the order the partitions appear in sysfs.
+func mountedPartitions(dir, name string, mounts map[string][]string) []string {
+	points := append([]string(nil), mounts["/dev/"+name]...)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return points
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), "partition")); err != nil {
+			continue
+		}
+		points = append(points, mounts["/dev/"+entry.Name()]...)
+	}
+	return points
+}
+
+// systemMountPoints are the filesystems the running system cannot lose.
+var systemMountPoints = []string{"/", "/boot", "/boot/efi", "/efi", "/usr", "/var", "/home"}
+
+// mountInfo is one line of /proc/self/mountinfo.
+type mountInfo struct {
+	Point  string
+	Dev    string // major:minor
+	Source string
+}
+
+// systemDisks maps each whole disk holding a system filesystem or active
+// swap to a description of what it holds. Partitions and stacked devices
+// (LVM, dm-crypt, md RAID) are followed down to the disks beneath them.
+func systemDisks() (map[string]string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	disks := make(map[string]string)
+	mark := func(names []string, what string) {
+		for _, name := range names {
+			if _, ok := disks[name]; !ok {
+				disks[name] = what
+			}
+		}
+	}
+	for _, m := range mounts {
+		for _, point := range systemMountPoints {
+			if m.Point == point {
+				mark(mountDisks(m), "the "+point+" filesystem")
+			}
+		}
+	}
+
+	swaps, err := os.ReadFile("/proc/swaps")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(swaps), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name := unescapeMountPath(fields[0])
+		if fields[1] == "partition" {
+			mark(deviceDisks(name), "active swap")
+			continue
+		}
+		// A swap file lives on whichever mount contains it
+		var best *mountInfo
+		for i, m := range mounts {
+			prefix := strings.TrimSuffix(m.Point, "/") + "/"
+			if strings.HasPrefix(name, prefix) && (best == nil || len(m.Point) > len(best.Point)) {
+				best = &mounts[i]
+			}
+		}
+		if best != nil {
+			mark(mountDisks(*best), "a swap file")
+		}
+	}
+	return disks, nil
+}
+
+// mountedDisks maps each whole disk to the mount points of every filesystem
+// on it, whether on a partition or on a device stacked on top of it. Any
+// mount, not only the system ones, means the disk is in use.
+func mountedDisks() (map[string][]string, error) {
+	mounts, err := readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+	disks := make(map[string][]string)
+	for _, m := range mounts {
+		for _, name := range mountDisks(m) {
+			if !slices.Contains(disks[name], m.Point) {
+				disks[name] = append(disks[name], m.Point)
+			}
+		}
+	}
+	return disks, nil
+}
+
+// readMountInfo parses /proc/self/mountinfo, which unlike /proc/self/mounts
+// gives the device number even when the source is shown as /dev/root.
+func readMountInfo() ([]mountInfo, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mountInfo
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		m := mountInfo{Point: unescapeMountPath(fields[4]), Dev: fields[2]}
+		// Optional fields end at "-", followed by the type and source
+		for i := 5; i+2 < len(fields); i++ {
+			if fields[i] == "-" {
+				m.Source = unescapeMountPath(fields[i+2])
+				break
+			}
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// mountDisks returns the whole disks behind a mount, by device number or,
+// for filesystems such as btrfs that report an anonymous one, by source.
+func mountDisks(m mountInfo) []string {
+	if disks := blockDisks(filepath.Join("/sys/dev/block", m.Dev)); len(disks) > 0 {
+		return disks
+	}
+	return deviceDisks(m.Source)
+}
+
+// deviceDisks returns the whole disks behind a device node such as
+// /dev/sda2 or /dev/mapper/vg-root.
+func deviceDisks(path string) []string {
+	if !strings.HasPrefix(path, "/dev/") {
+		return nil
+	}
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+	return blockDisks(filepath.Join("/sys/class/block", filepath.Base(path)))
+}
+
+// blockDisks follows a block device's sysfs entry through its slaves and
+// from partitions to their parent, ending at whole disks.
+func blockDisks(sysPath string) []string {
+	dir, err := filepath.EvalSymlinks(sysPath)
+	if err != nil {
+		return nil
+	}
+	slaves, _ := os.ReadDir(filepath.Join(dir, "slaves"))
+	if len(slaves) > 0 {
+		var disks []string
+		for _, slave := range slaves {
+			disks = append(disks, blockDisks(filepath.Join("/sys/class/block", slave.Name()))...)
+		}
+		return disks
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partition")); err == nil {
+		dir = filepath.Dir(dir)
+	}
+	return []string{filepath.Base(dir)}
+}
+
+// readMounts maps each mounted device node to its mount points.
+func readMounts() (map[string][]string, error) {
+	file, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mounts := make(map[string][]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		mounts[fields[0]] = append(mounts[fields[0]], unescapeMountPath(fields[1]))
+	}
+	return mounts, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (\040 for space etc.) that the
+// kernel uses for whitespace in /proc/self/mounts.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if v, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,23 @@
+//go:build !windows && !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// adminHint tells the user how to get raw disk access on this platform.
+const adminHint = "Please run as root."
+
+func isAdmin() bool {
+	return false
+}
+
+func listUSBDrives() ([]DriveInfo, error) {
+	return nil, fmt.Errorf("drive discovery is not supported on %s", runtime.GOOS)
+}
+
+func newPlatformBackend(sizes partitionSizes) (DiskBackend, error) {
+	return nil, fmt.Errorf("writing to drives is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// adminHint tells the user how to get raw disk access on this platform.
+const adminHint = "Please run as Administrator."
+
+func isAdmin() bool {
+	_, err := os.Open("\\\\.\\PHYSICALDRIVE0")
+	return err == nil
+}
+
+func listUSBDrives() ([]DriveInfo, error) {
+	// Use PowerShell to get disk information with drive letters
+	// Disks holding Windows, the EFI/system partition or a page file are
+	// flagged so they can never be erased
+	cmd := exec.Command("powershell", "-Command", `
+		$pageDisks = @(Get-CimInstance Win32_PageFileUsage -ErrorAction SilentlyContinue | ForEach-Object { (Get-Partition -DriveLetter $_.Name[0] -ErrorAction SilentlyContinue).DiskNumber })
+		Get-Disk | Where-Object { $_.BusType -eq 'USB' -or ($_.Size -lt 256GB -and $_.BusType -ne 'NVMe' -and $_.OperationalStatus -eq 'Online') } |
+		ForEach-Object {
+			$disk = $_
+			$letters = (Get-Partition -DiskNumber $disk.Number -ErrorAction SilentlyContinue | Get-Volume -ErrorAction SilentlyContinue | Where-Object DriveLetter | ForEach-Object { $_.DriveLetter + ':' }) -join ','
+			if (-not $letters) { $letters = '(none)' }
+			$size = [math]::Round($disk.Size / 1GB, 2)
+			$system = @()
+			if ($disk.IsBoot) { $system += 'the running Windows installation' }
+			if ($disk.IsSystem) { $system += 'the system partition' }
+			if ($pageDisks -contains $disk.Number) { $system += 'a page file' }
+			"$($disk.Number)|$($letters)|$($disk.FriendlyName)|$($size)GB|$($disk.BusType)|$($disk.SerialNumber)|$($disk.Size)|$($system -join ', ')"
+		}
+	`)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list drives: %v", err)
+	}
+
+	var drives []DriveInfo
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "|")
+		if len(parts) >= 5 {
+			num, _ := strconv.Atoi(parts[0])
+			drive := DriveInfo{
+				Number:      num,
+				Letters:     parts[1],
+				Model:       parts[2],
+				SizeDisplay: parts[3],
+				MediaType:   parts[4],
+				DeviceID:    fmt.Sprintf("\\\\.\\PhysicalDrive%d", num),
+				IsRemovable: parts[4] == "USB",
+			}
+			if len(parts) >= 7 {
+				drive.Serial = strings.TrimSpace(parts[5])
+				drive.Size, _ = strconv.ParseUint(strings.TrimSpace(parts[6]), 10, 64)
+			}
+			if len(parts) >= 8 {
+				drive.System = strings.TrimSpace(parts[7])
+			}
+			drives = append(drives, drive)
+		}
+	}
+
+	return drives, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// Chunks each stick may fall behind the fastest one before reading the ISO
+// pauses for it
+const fanoutBuffer = 32
+
+// treeSource yields the directories and regular files of the ISO contents,
+// parents before their children. A file's Data must be read, or abandoned,
+// before the next call to Next.
+type treeSource interface {
+	// Next returns the next item, or io.EOF after the last one
+	Next() (*treeItem, error)
+	// Close tells the source the stick needs nothing more, whether or not
+	// it read everything
+	Close()
+}
+
+// treeItem is one directory or file of a treeSource. Name is slash-separated
+// and relative to the root of the ISO.
+type treeItem struct {
+	Name  string
+	IsDir bool
+	Size  int64
+	Data  io.Reader // nil for directories
+}
+
+// isoFanout reads the ISO contents once and hands the same stream of
+// directories and file data to every stick being created from it. Reading
+// runs at the pace of the slowest stick, which may lag the fastest by
+// fanoutBuffer chunks.
+type isoFanout struct {
+	isoPath string
+	views   []*isoView
+}
+
+// fanoutMsg carries an item header, a chunk of the current file's data or
+// the error that stopped reading.
+type fanoutMsg struct {
+	item  *treeItem
+	chunk []byte
+	err   error
+}
+
+func newISOFanout(isoPath string, sticks int) *isoFanout {
+	f := &isoFanout{isoPath: isoPath}
+	for i := 0; i < sticks; i++ {
+		f.views = append(f.views, &isoView{
+			msgs: make(chan fanoutMsg, fanoutBuffer),
+			done: make(chan struct{}),
+		})
+	}
+	return f
+}
+
+// view returns the source for the i-th stick.
+func (f *isoFanout) view(i int) treeSource {
+	return f.views[i]
+}
+
+// run reads the ISO, or a directory holding extracted ISO contents, and
+// feeds every view until the end or until no stick is listening any more.
+func (f *isoFanout) run() {
+	defer func() {
+		for _, v := range f.views {
+			close(v.msgs)
+		}
+	}()
+
+	if err := f.walk(); err != nil {
+		f.send(fanoutMsg{err: err})
+	}
+}
+
+func (f *isoFanout) walk() error {
+	var src fs.FS
+	if info, err := os.Stat(f.isoPath); err != nil {
+		return err
+	} else if info.IsDir() {
+		src = os.DirFS(f.isoPath)
+	} else {
+		iso, err := openISO(f.isoPath)
+		if err != nil {
+			return err
+		}
+		defer iso.Close()
+		src = iso
+	}
+
+	return fs.WalkDir(src, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name != "." && !f.send(fanoutMsg{item: &treeItem{Name: name, IsDir: true}}) {
+				return fs.SkipAll
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil // Symlinks have no FAT equivalent
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !f.send(fanoutMsg{item: &treeItem{Name: name, Size: info.Size()}}) {
+			return fs.SkipAll
+		}
+
+		file, err := src.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		for remaining := info.Size(); remaining > 0; {
+			// Every stick keeps a reference, so each chunk is a new buffer
+			chunk := make([]byte, min(remaining, fatWriteChunk))
+			if _, err := io.ReadFull(file, chunk); err != nil {
+				return err
+			}
+			if !f.send(fanoutMsg{chunk: chunk}) {
+				return fs.SkipAll
+			}
+			remaining -= int64(len(chunk))
+		}
+		return nil
+	})
+}
+
+// send delivers msg to every view still listening and reports whether there
+// was any.
+func (f *isoFanout) send(msg fanoutMsg) bool {
+	listening := false
+	for _, v := range f.views {
+		select {
+		case v.msgs <- msg:
+			listening = true
+		case <-v.done:
+		}
+	}
+	return listening
+}
+
+// isoView is one stick's treeSource on an isoFanout.
+type isoView struct {
+	msgs      chan fanoutMsg
+	done      chan struct{}
+	closeOnce sync.Once
+
+	pending   []byte
+	remaining int64
+	err       error
+}
+
+func (v *isoView) Next() (*treeItem, error) {
+	// Skip whatever the caller left unread of the previous file
+	if _, err := io.Copy(io.Discard, v); err != nil {
+		return nil, err
+	}
+	if v.err != nil {
+		return nil, v.err
+	}
+	msg, ok := <-v.msgs
+	switch {
+	case !ok:
+		return nil, io.EOF
+	case msg.err != nil:
+		v.err = msg.err
+		return nil, v.err
+	}
+
+	// The header is shared by all views; give the caller its own copy
+	item := *msg.item
+	if !item.IsDir {
+		v.remaining = item.Size
+		item.Data = v
+	}
+	return &item, nil
+}
+
+// Read returns the data of the current file.
+func (v *isoView) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	if v.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(v.pending) == 0 {
+		msg, ok := <-v.msgs
+		switch {
+		case !ok:
+			v.err = io.ErrUnexpectedEOF
+			return 0, v.err
+		case msg.err != nil:
+			v.err = msg.err
+			return 0, v.err
+		}
+		v.pending = msg.chunk
+	}
+	n := copy(p, v.pending)
+	v.pending = v.pending[n:]
+	v.remaining -= int64(n)
+	return n, nil
+}
+
+func (v *isoView) Close() {
+	v.closeOnce.Do(func() { close(v.done) })
+}
@@ -0,0 +1,975 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	fatReservedSectors = 32
+	fatCopies          = 2
+	fatMinClusters     = 65525
+	fatMaxClusters     = 0x0FFFFFF5
+	fatMaxFileSize     = 1<<32 - 1
+	fatMaxNameLength   = 255
+
+	fatFree  = 0x00000000
+	fatEOC   = 0x0FFFFFFF
+	fatMedia = 0x0FFFFFF8
+
+	dirEntrySize = 32
+
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = 0x0F
+
+	// Files are streamed to the device in chunks of this size, a multiple
+	// of every cluster size
+	fatWriteChunk = 1 << 20
+)
+
+// blockDevice is a disk, partition or image that can be read and written at
+// arbitrary offsets. The FAT32 writer only issues sector-aligned requests,
+// as raw Windows device handles require.
+type blockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// regionDevice exposes part of a blockDevice, such as one partition, as a
+// device starting at offset zero.
+type regionDevice struct {
+	dev    blockDevice
+	offset int64
+	size   int64
+}
+
+func (r *regionDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > r.size {
+		return 0, fmt.Errorf("read of %d bytes at %d is outside the %d byte region", len(p), off, r.size)
+	}
+	return r.dev.ReadAt(p, r.offset+off)
+}
+
+func (r *regionDevice) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > r.size {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the %d byte region", len(p), off, r.size)
+	}
+	return r.dev.WriteAt(p, r.offset+off)
+}
+
+// fatEntry is a file or directory in the tree the writer builds in memory.
+type fatEntry struct {
+	name    string
+	short   [11]byte
+	isDir   bool
+	cluster uint32
+	size    uint32
+
+	children []*fatEntry
+	index    map[string]*fatEntry // keyed by upper-case name; FAT is case-insensitive
+	shorts   map[[11]byte]bool
+}
+
+func newFATDir(name string) *fatEntry {
+	return &fatEntry{
+		name:   name,
+		isDir:  true,
+		index:  make(map[string]*fatEntry),
+		shorts: make(map[[11]byte]bool),
+	}
+}
+
+// fatFS formats a device as FAT32 and lays down directories and files with
+// long file names. File data is written as soon as a file is added; the
+// directories, both FATs and the boot sectors are written by Close, so an
+// interrupted run never leaves a filesystem that looks valid.
+type fatFS struct {
+	dev           blockDevice
+	label         string
+	sectors       uint32
+	hiddenSectors uint32
+	volumeID      uint32
+	modTime       time.Time
+
+	sectorsPerCluster uint32
+	reservedSectors   uint32
+	fatSectors        uint32
+	clusterSize       int64
+
+	fat      []uint32
+	nextFree uint32
+	root     *fatEntry
+}
+
+// formatFAT32 creates an empty FAT32 filesystem spanning sectors 512-byte
+// sectors of dev. hiddenSectors is the partition's starting LBA, recorded in
+// the boot sector as Windows expects.
+func formatFAT32(dev blockDevice, sectors, hiddenSectors uint64, label string) (*fatFS, error) {
+	if sectors > 0xFFFFFFFF {
+		return nil, fmt.Errorf("partition of %d sectors is too large for FAT32", sectors)
+	}
+
+	f := &fatFS{
+		dev:           dev,
+		label:         fatLabel(label),
+		sectors:       uint32(sectors),
+		hiddenSectors: uint32(hiddenSectors),
+		modTime:       time.Now(),
+	}
+	var id [4]byte
+	rand.Read(id[:])
+	f.volumeID = binary.LittleEndian.Uint32(id[:])
+
+	// Start from the cluster size Windows picks for the volume size and
+	// adjust until the cluster count is inside the FAT32 range
+	spc := defaultSectorsPerCluster(sectors)
+	for {
+		reserved, fatSectors, clusters := fatGeometry(f.sectors, spc)
+		switch {
+		case clusters < fatMinClusters && spc > 1:
+			spc /= 2
+			continue
+		case clusters < fatMinClusters:
+			return nil, fmt.Errorf("partition of %d MB is too small for FAT32", sectors*sectorSize>>20)
+		case clusters > fatMaxClusters && spc < 128:
+			spc *= 2
+			continue
+		case clusters > fatMaxClusters:
+			return nil, fmt.Errorf("partition of %d sectors has too many clusters for FAT32", sectors)
+		}
+		f.sectorsPerCluster = spc
+		f.reservedSectors = reserved
+		f.fatSectors = fatSectors
+		f.fat = make([]uint32, clusters+2)
+		break
+	}
+	f.clusterSize = int64(f.sectorsPerCluster) * sectorSize
+
+	f.fat[0] = fatMedia
+	f.fat[1] = fatEOC
+	f.fat[2] = fatEOC // root directory
+	f.nextFree = 3
+	f.root = newFATDir("")
+	f.root.cluster = 2
+	return f, nil
+}
+
+// defaultSectorsPerCluster follows the cluster sizes Windows uses for FAT32.
+func defaultSectorsPerCluster(sectors uint64) uint32 {
+	switch size := sectors * sectorSize; {
+	case size <= 260<<20:
+		return 1
+	case size <= 8<<30:
+		return 8
+	case size <= 16<<30:
+		return 16
+	case size <= 32<<30:
+		return 32
+	default:
+		return 64
+	}
+}
+
+// fatGeometry sizes the FATs with the formula from Microsoft's FAT
+// specification and pads the reserved area so the data region starts on a
+// cluster boundary.
+func fatGeometry(sectors, spc uint32) (reserved, fatSectors, clusters uint32) {
+	tmp1 := uint64(sectors) - fatReservedSectors
+	tmp2 := (256*uint64(spc) + fatCopies) / 2
+	fatSectors = uint32((tmp1 + tmp2 - 1) / tmp2)
+
+	reserved = fatReservedSectors
+	if pad := (reserved + fatCopies*fatSectors) % spc; pad != 0 {
+		reserved += spc - pad
+	}
+	used := reserved + fatCopies*fatSectors
+	if used >= sectors {
+		return reserved, fatSectors, 0
+	}
+	return reserved, fatSectors, (sectors - used) / spc
+}
+
+func (f *fatFS) clusterOffset(cluster uint32) int64 {
+	dataStart := int64(f.reservedSectors+fatCopies*f.fatSectors) * sectorSize
+	return dataStart + int64(cluster-2)*f.clusterSize
+}
+
+func (f *fatFS) clustersFor(size int64) uint32 {
+	return uint32((size + f.clusterSize - 1) / f.clusterSize)
+}
+
+// allocate chains n free clusters together, preferring the run that follows
+// the previous allocation so files end up contiguous.
+func (f *fatFS) allocate(n uint32) ([]uint32, error) {
+	if n == 0 {
+		return nil, nil
+	}
+	clusters := make([]uint32, 0, n)
+	total := uint32(len(f.fat))
+	for i := uint32(0); i < total-2 && uint32(len(clusters)) < n; i++ {
+		c := 2 + (f.nextFree-2+i)%(total-2)
+		if f.fat[c] == fatFree {
+			clusters = append(clusters, c)
+		}
+	}
+	if uint32(len(clusters)) < n {
+		return nil, fmt.Errorf("volume %s is full", f.label)
+	}
+	for i, c := range clusters {
+		if i+1 < len(clusters) {
+			f.fat[c] = clusters[i+1]
+		} else {
+			f.fat[c] = fatEOC
+		}
+	}
+	f.nextFree = clusters[len(clusters)-1] + 1
+	if f.nextFree >= total {
+		f.nextFree = 2
+	}
+	return clusters, nil
+}
+
+func (f *fatFS) chain(first uint32) ([]uint32, error) {
+	var clusters []uint32
+	for c := first; c >= 2 && c < fatEOC&0x0FFFFFF8; c = f.fat[c] {
+		if c >= uint32(len(f.fat)) || len(clusters) > len(f.fat) {
+			return nil, fmt.Errorf("corrupt cluster chain at %d", c)
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+func (f *fatFS) free(first uint32) {
+	clusters, _ := f.chain(first)
+	for _, c := range clusters {
+		f.fat[c] = fatFree
+	}
+}
+
+// lookup walks a slash-separated path from the root.
+func (f *fatFS) lookup(name string) (*fatEntry, error) {
+	entry := f.root
+	for _, part := range splitFATPath(name) {
+		if !entry.isDir {
+			return nil, fmt.Errorf("%s: not a directory", entry.name)
+		}
+		child, ok := entry.index[strings.ToUpper(part)]
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+		}
+		entry = child
+	}
+	return entry, nil
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (f *fatFS) MkdirAll(name string) (*fatEntry, error) {
+	dir := f.root
+	for _, part := range splitFATPath(name) {
+		child, ok := dir.index[strings.ToUpper(part)]
+		if !ok {
+			var err error
+			if child, err = dir.add(part, true); err != nil {
+				return nil, err
+			}
+		}
+		if !child.isDir {
+			return nil, fmt.Errorf("%s: not a directory", part)
+		}
+		dir = child
+	}
+	return dir, nil
+}
+
+// WriteFile creates or replaces a file with size bytes read from r,
+// creating parent directories as needed.
+func (f *fatFS) WriteFile(name string, r io.Reader, size int64) error {
+	if size < 0 || size > fatMaxFileSize {
+		return fmt.Errorf("%s: %d bytes is too large for FAT32", name, size)
+	}
+	dir, err := f.MkdirAll(path.Dir(path.Clean("/" + name)))
+	if err != nil {
+		return err
+	}
+	base := path.Base(name)
+	entry, ok := dir.index[strings.ToUpper(base)]
+	if ok {
+		if entry.isDir {
+			return fmt.Errorf("%s: is a directory", name)
+		}
+		f.free(entry.cluster)
+		entry.cluster, entry.size = 0, 0
+	} else if entry, err = dir.add(base, false); err != nil {
+		return err
+	}
+
+	clusters, err := f.allocate(f.clustersFor(size))
+	if err != nil {
+		return err
+	}
+	if err := f.writeClusters(clusters, r, size); err != nil {
+		f.free(firstCluster(clusters))
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	entry.cluster = firstCluster(clusters)
+	entry.size = uint32(size)
+	return nil
+}
+
+// writeClusters streams size bytes into the clusters, merging runs of
+// consecutive clusters into large writes and zero-padding the last cluster.
+func (f *fatFS) writeClusters(clusters []uint32, r io.Reader, size int64) error {
+	buf := make([]byte, fatWriteChunk)
+	perChunk := int(fatWriteChunk / f.clusterSize)
+	remaining := size
+	for i := 0; i < len(clusters); {
+		j := i + 1
+		for j < len(clusters) && j-i < perChunk && clusters[j] == clusters[j-1]+1 {
+			j++
+		}
+		chunk := buf[:int64(j-i)*f.clusterSize]
+		n := int64(len(chunk))
+		if remaining < n {
+			n = remaining
+		}
+		if _, err := io.ReadFull(r, chunk[:n]); err != nil {
+			return err
+		}
+		clear(chunk[n:])
+		if _, err := f.dev.WriteAt(chunk, f.clusterOffset(clusters[i])); err != nil {
+			return err
+		}
+		remaining -= n
+		i = j
+	}
+	return nil
+}
+
+// ReadFile returns the content of a file written earlier or, on a volume
+// opened with openFAT32, found on disk.
+func (f *fatFS) ReadFile(name string) ([]byte, error) {
+	r, size, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return data, nil
+}
+
+// Open returns a reader for a file's content and its size. Runs of
+// consecutive clusters are read in large requests, so whole ISO images can
+// be streamed back from a stick.
+func (f *fatFS) Open(name string) (io.Reader, int64, error) {
+	entry, err := f.lookup(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if entry.isDir {
+		return nil, 0, fmt.Errorf("%s: is a directory", name)
+	}
+	clusters, err := f.chain(entry.cluster)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", name, err)
+	}
+	if uint32(len(clusters)) < f.clustersFor(int64(entry.size)) {
+		return nil, 0, fmt.Errorf("%s: cluster chain is shorter than the file", name)
+	}
+	r := &fatFileReader{f: f, clusters: clusters, remaining: int64(entry.size)}
+	return r, int64(entry.size), nil
+}
+
+// fatFileReader streams a file's clusters in reads of up to fatWriteChunk
+// bytes.
+type fatFileReader struct {
+	f         *fatFS
+	clusters  []uint32
+	remaining int64
+	buf       []byte
+	pending   []byte
+}
+
+func (r *fatFileReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		if r.remaining == 0 {
+			return 0, io.EOF
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, fatWriteChunk)
+		}
+		perChunk := int(fatWriteChunk / r.f.clusterSize)
+		n := 1
+		for n < len(r.clusters) && n < perChunk && r.clusters[n] == r.clusters[n-1]+1 {
+			n++
+		}
+		chunk := r.buf[:int64(n)*r.f.clusterSize]
+		if _, err := r.f.dev.ReadAt(chunk, r.f.clusterOffset(r.clusters[0])); err != nil {
+			return 0, err
+		}
+		if int64(len(chunk)) > r.remaining {
+			chunk = chunk[:r.remaining]
+		}
+		r.pending = chunk
+		r.remaining -= int64(len(chunk))
+		r.clusters = r.clusters[n:]
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// openFAT32 reads the boot sector, FAT and directory tree of an existing
+// FAT32 volume so its files can be read back. The result is read-only:
+// calling WriteFile or Close on it is not supported.
+func openFAT32(dev blockDevice) (*fatFS, error) {
+	boot := make([]byte, sectorSize)
+	if _, err := dev.ReadAt(boot, 0); err != nil {
+		return nil, err
+	}
+	if boot[510] != 0x55 || boot[511] != 0xAA || string(boot[82:90]) != "FAT32   " {
+		return nil, fmt.Errorf("not a FAT32 volume")
+	}
+	if n := binary.LittleEndian.Uint16(boot[11:13]); n != sectorSize {
+		return nil, fmt.Errorf("unsupported sector size %d", n)
+	}
+
+	f := &fatFS{
+		dev:               dev,
+		label:             strings.TrimRight(string(boot[71:82]), " "),
+		sectors:           binary.LittleEndian.Uint32(boot[32:36]),
+		hiddenSectors:     binary.LittleEndian.Uint32(boot[28:32]),
+		volumeID:          binary.LittleEndian.Uint32(boot[67:71]),
+		sectorsPerCluster: uint32(boot[13]),
+		reservedSectors:   uint32(binary.LittleEndian.Uint16(boot[14:16])),
+		fatSectors:        binary.LittleEndian.Uint32(boot[36:40]),
+	}
+	if f.sectorsPerCluster == 0 || f.sectorsPerCluster&(f.sectorsPerCluster-1) != 0 {
+		return nil, fmt.Errorf("corrupt FAT32 boot sector")
+	}
+	if boot[16] != fatCopies {
+		return nil, fmt.Errorf("unsupported FAT count %d", boot[16])
+	}
+	f.clusterSize = int64(f.sectorsPerCluster) * sectorSize
+	used := f.reservedSectors + fatCopies*f.fatSectors
+	if used >= f.sectors {
+		return nil, fmt.Errorf("corrupt FAT32 boot sector")
+	}
+	clusters := (f.sectors - used) / f.sectorsPerCluster
+	if uint64(clusters+2)*4 > uint64(f.fatSectors)*sectorSize {
+		return nil, fmt.Errorf("corrupt FAT32 boot sector")
+	}
+
+	fatBytes := make([]byte, int64(f.fatSectors)*sectorSize)
+	if _, err := dev.ReadAt(fatBytes, int64(f.reservedSectors)*sectorSize); err != nil {
+		return nil, err
+	}
+	f.fat = make([]uint32, clusters+2)
+	for i := range f.fat {
+		f.fat[i] = binary.LittleEndian.Uint32(fatBytes[i*4:]) & 0x0FFFFFFF
+	}
+
+	f.root = newFATDir("")
+	f.root.cluster = binary.LittleEndian.Uint32(boot[44:48])
+	if err := f.readDir(f.root, make(map[uint32]bool)); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readDir loads the entries of dir and, recursively, its subdirectories,
+// joining long file names to their short entries.
+func (f *fatFS) readDir(dir *fatEntry, seen map[uint32]bool) error {
+	if seen[dir.cluster] {
+		return fmt.Errorf("directory loop at cluster %d", dir.cluster)
+	}
+	seen[dir.cluster] = true
+
+	clusters, err := f.chain(dir.cluster)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, int64(len(clusters))*f.clusterSize)
+	for i, c := range clusters {
+		chunk := data[int64(i)*f.clusterSize : int64(i+1)*f.clusterSize]
+		if _, err := f.dev.ReadAt(chunk, f.clusterOffset(c)); err != nil {
+			return err
+		}
+	}
+
+	var long []uint16
+	var longSum byte
+	var longNext int
+	for off := 0; off+dirEntrySize <= len(data); off += dirEntrySize {
+		e := data[off : off+dirEntrySize]
+		if e[0] == 0x00 {
+			break // end of directory
+		}
+		if e[0] == 0xE5 {
+			long = nil
+			continue // deleted
+		}
+		if e[11]&0x3F == attrLongName {
+			seq := int(e[0] & 0x1F)
+			if e[0]&0x40 != 0 {
+				long = make([]uint16, seq*13)
+				longSum = e[13]
+			} else if long == nil || seq != longNext || e[13] != longSum {
+				long = nil
+				continue
+			}
+			if seq == 0 || seq*13 > len(long) {
+				long = nil
+				continue
+			}
+			part := long[(seq-1)*13 : seq*13]
+			for i := range part {
+				switch {
+				case i < 5:
+					part[i] = binary.LittleEndian.Uint16(e[1+i*2:])
+				case i < 11:
+					part[i] = binary.LittleEndian.Uint16(e[14+(i-5)*2:])
+				default:
+					part[i] = binary.LittleEndian.Uint16(e[28+(i-11)*2:])
+				}
+			}
+			longNext = seq - 1
+			continue
+		}
+
+		var short [11]byte
+		copy(short[:], e[0:11])
+		attr := e[11]
+		name := shortEntryName(short, e[12])
+		if long != nil && longNext == 0 {
+			var sum byte
+			for _, c := range short {
+				sum = (sum&1)<<7 + sum>>1 + c
+			}
+			if sum == longSum {
+				for i, c := range long {
+					if c == 0x0000 {
+						long = long[:i]
+						break
+					}
+				}
+				name = string(utf16.Decode(long))
+			}
+		}
+		long = nil
+		if attr&attrVolumeID != 0 || name == "." || name == ".." {
+			continue
+		}
+
+		var entry *fatEntry
+		if attr&attrDirectory != 0 {
+			entry = newFATDir(name)
+		} else {
+			entry = &fatEntry{name: name, size: binary.LittleEndian.Uint32(e[28:32])}
+		}
+		entry.short = short
+		entry.cluster = uint32(binary.LittleEndian.Uint16(e[20:22]))<<16 | uint32(binary.LittleEndian.Uint16(e[26:28]))
+		dir.shorts[short] = true
+		dir.index[strings.ToUpper(name)] = entry
+		dir.children = append(dir.children, entry)
+
+		if entry.isDir {
+			if err := f.readDir(entry, seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shortEntryName turns an 8.3 directory entry name into its display form,
+// honouring the lower-case flags Windows stores in the reserved byte.
+func shortEntryName(short [11]byte, flags byte) string {
+	if short[0] == 0x05 {
+		short[0] = 0xE5 // escaped first byte
+	}
+	base := strings.TrimRight(string(short[0:8]), " ")
+	ext := strings.TrimRight(string(short[8:11]), " ")
+	if flags&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if flags&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// Close lays out and writes every directory, then both FATs, the FSInfo
+// sectors and finally the boot sectors.
+func (f *fatFS) Close() error {
+	if err := f.allocateDirs(f.root); err != nil {
+		return err
+	}
+	if err := f.writeDirs(f.root, nil); err != nil {
+		return err
+	}
+
+	fatBytes := make([]byte, int64(f.fatSectors)*sectorSize)
+	for i, v := range f.fat {
+		binary.LittleEndian.PutUint32(fatBytes[i*4:], v)
+	}
+	for i := uint32(0); i < fatCopies; i++ {
+		off := int64(f.reservedSectors+i*f.fatSectors) * sectorSize
+		if _, err := f.dev.WriteAt(fatBytes, off); err != nil {
+			return err
+		}
+	}
+
+	_, err := f.dev.WriteAt(f.reservedArea(), 0)
+	return err
+}
+
+// dirEntryCount returns the number of 32-byte slots a directory needs.
+func (f *fatFS) dirEntryCount(dir *fatEntry) int {
+	count := 2 // "." and "..", or the volume label plus end marker for the root
+	for _, child := range dir.children {
+		count += 1 + len(lfnSlots(child))
+	}
+	return count
+}
+
+// allocateDirs gives every directory enough clusters for its entries.
+func (f *fatFS) allocateDirs(dir *fatEntry) error {
+	needed := f.clustersFor(int64(f.dirEntryCount(dir)) * dirEntrySize)
+	if dir == f.root {
+		// The root always starts at cluster 2; extend its chain if needed
+		f.free(f.fat[2])
+		f.fat[2] = fatEOC
+		if needed > 1 {
+			more, err := f.allocate(needed - 1)
+			if err != nil {
+				return err
+			}
+			f.fat[2] = more[0]
+		}
+	} else {
+		clusters, err := f.allocate(needed)
+		if err != nil {
+			return err
+		}
+		dir.cluster = clusters[0]
+	}
+
+	for _, child := range dir.children {
+		if child.isDir {
+			if err := f.allocateDirs(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fatFS) writeDirs(dir, parent *fatEntry) error {
+	clusters, err := f.chain(dir.cluster)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, int64(len(clusters))*f.clusterSize)
+	slot := 0
+	put := func(entry []byte) {
+		copy(data[slot*dirEntrySize:], entry)
+		slot++
+	}
+
+	if dir == f.root {
+		var label [11]byte
+		copy(label[:], fmt.Sprintf("%-11s", f.label))
+		put(f.shortEntry(label, attrVolumeID, 0, 0))
+	} else {
+		parentCluster := parent.cluster
+		if parent == f.root {
+			parentCluster = 0 // ".." of a top-level directory points at cluster 0
+		}
+		put(f.shortEntry(dotName("."), attrDirectory, dir.cluster, 0))
+		put(f.shortEntry(dotName(".."), attrDirectory, parentCluster, 0))
+	}
+
+	for _, child := range dir.children {
+		for _, lfn := range lfnSlots(child) {
+			put(lfn)
+		}
+		if child.isDir {
+			put(f.shortEntry(child.short, attrDirectory, child.cluster, 0))
+		} else {
+			put(f.shortEntry(child.short, attrArchive, child.cluster, child.size))
+		}
+	}
+
+	for i, c := range clusters {
+		chunk := data[int64(i)*f.clusterSize : int64(i+1)*f.clusterSize]
+		if _, err := f.dev.WriteAt(chunk, f.clusterOffset(c)); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range dir.children {
+		if child.isDir {
+			if err := f.writeDirs(child, dir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f *fatFS) shortEntry(name [11]byte, attr byte, cluster, size uint32) []byte {
+	e := make([]byte, dirEntrySize)
+	copy(e[0:11], name[:])
+	e[11] = attr
+	t, d := dosDateTime(f.modTime)
+	binary.LittleEndian.PutUint16(e[14:16], t) // creation time
+	binary.LittleEndian.PutUint16(e[16:18], d) // creation date
+	binary.LittleEndian.PutUint16(e[18:20], d) // last access date
+	binary.LittleEndian.PutUint16(e[20:22], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:24], t) // write time
+	binary.LittleEndian.PutUint16(e[24:26], d) // write date
+	binary.LittleEndian.PutUint16(e[26:28], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:32], size)
+	return e
+}
+
+// reservedArea returns the boot sector, FSInfo sector and their backups at
+// sectors 6 and 7.
+func (f *fatFS) reservedArea() []byte {
+	area := make([]byte, int64(f.reservedSectors)*sectorSize)
+
+	boot := area[0:sectorSize]
+	copy(boot[0:3], []byte{0xEB, 0x58, 0x90})
+	copy(boot[3:11], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(boot[11:13], sectorSize)
+	boot[13] = byte(f.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(boot[14:16], uint16(f.reservedSectors))
+	boot[16] = fatCopies
+	boot[21] = 0xF8                                // fixed disk
+	binary.LittleEndian.PutUint16(boot[24:26], 32) // sectors per track
+	binary.LittleEndian.PutUint16(boot[26:28], 64) // heads
+	binary.LittleEndian.PutUint32(boot[28:32], f.hiddenSectors)
+	binary.LittleEndian.PutUint32(boot[32:36], f.sectors)
+	binary.LittleEndian.PutUint32(boot[36:40], f.fatSectors)
+	binary.LittleEndian.PutUint32(boot[44:48], 2) // root directory cluster
+	binary.LittleEndian.PutUint16(boot[48:50], 1) // FSInfo sector
+	binary.LittleEndian.PutUint16(boot[50:52], 6) // backup boot sector
+	boot[64] = 0x80
+	boot[66] = 0x29
+	binary.LittleEndian.PutUint32(boot[67:71], f.volumeID)
+	copy(boot[71:82], fmt.Sprintf("%-11s", f.label))
+	copy(boot[82:90], "FAT32   ")
+	boot[510], boot[511] = 0x55, 0xAA
+
+	freeCount := uint32(0)
+	for _, v := range f.fat[2:] {
+		if v == fatFree {
+			freeCount++
+		}
+	}
+	info := area[sectorSize : 2*sectorSize]
+	binary.LittleEndian.PutUint32(info[0:4], 0x41615252)
+	binary.LittleEndian.PutUint32(info[484:488], 0x61417272)
+	binary.LittleEndian.PutUint32(info[488:492], freeCount)
+	binary.LittleEndian.PutUint32(info[492:496], f.nextFree)
+	binary.LittleEndian.PutUint32(info[508:512], 0xAA550000)
+
+	copy(area[6*sectorSize:], area[0:2*sectorSize])
+	return area
+}
+
+// add creates a child entry with a unique short name.
+func (dir *fatEntry) add(name string, isDir bool) (*fatEntry, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `"*/:<>?\|`) {
+		return nil, fmt.Errorf("invalid FAT file name %q", name)
+	}
+	if len(utf16.Encode([]rune(name))) > fatMaxNameLength {
+		return nil, fmt.Errorf("file name %q is longer than %d characters", name, fatMaxNameLength)
+	}
+
+	var entry *fatEntry
+	if isDir {
+		entry = newFATDir(name)
+	} else {
+		entry = &fatEntry{name: name}
+	}
+	if short, ok := exactShortName(name); ok && !dir.shorts[short] {
+		entry.short = short
+	} else {
+		entry.short = dir.generateShortName(name)
+	}
+	dir.shorts[entry.short] = true
+	dir.index[strings.ToUpper(name)] = entry
+	dir.children = append(dir.children, entry)
+	return entry, nil
+}
+
+// generateShortName derives a unique BASIS~N 8.3 alias for a long name.
+func (dir *fatEntry) generateShortName(name string) [11]byte {
+	upper := strings.TrimLeft(strings.ToUpper(name), ".")
+	base, ext := upper, ""
+	if i := strings.LastIndex(upper, "."); i > 0 {
+		base, ext = upper[:i], upper[i+1:]
+	}
+	base, ext = shortNameChars(base), shortNameChars(ext)
+	if len(ext) > 3 {
+		ext = ext[:3]
+	}
+	if base == "" {
+		base = "_"
+	}
+
+	for n := 1; ; n++ {
+		tail := "~" + strconv.Itoa(n)
+		b := base
+		if len(b)+len(tail) > 8 {
+			b = b[:8-len(tail)]
+		}
+		var short [11]byte
+		copy(short[:], fmt.Sprintf("%-8s%-3s", b+tail, ext))
+		if !dir.shorts[short] {
+			return short
+		}
+	}
+}
+
+// exactShortName reports whether name is already a valid upper-case 8.3
+// name, which needs no long name entries.
+func exactShortName(name string) ([11]byte, bool) {
+	var short [11]byte
+	base, ext := name, ""
+	if i := strings.Index(name, "."); i >= 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	if len(base) == 0 || len(base) > 8 || len(ext) > 3 {
+		return short, false
+	}
+	if shortNameChars(base) != base || shortNameChars(ext) != ext || strings.ToUpper(name) != name {
+		return short, false
+	}
+	copy(short[:], fmt.Sprintf("%-8s%-3s", base, ext))
+	return short, true
+}
+
+// shortNameChars replaces characters not allowed in 8.3 names with '_' and
+// drops spaces and dots.
+func shortNameChars(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == ' ' || r == '.':
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune("!#$%&'()-@^_`{}~", r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// lfnSlots returns the long file name entries that precede an entry's short
+// entry, in on-disk order. Entries whose name is an exact 8.3 name need none.
+func lfnSlots(entry *fatEntry) [][]byte {
+	if short, ok := exactShortName(entry.name); ok && short == entry.short {
+		return nil
+	}
+
+	var sum byte
+	for _, c := range entry.short {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+
+	chars := utf16.Encode([]rune(entry.name))
+	count := (len(chars) + 12) / 13
+	if len(chars)%13 != 0 {
+		chars = append(chars, 0x0000)
+	}
+	for len(chars) < count*13 {
+		chars = append(chars, 0xFFFF)
+	}
+
+	slots := make([][]byte, 0, count)
+	for seq := count; seq >= 1; seq-- {
+		e := make([]byte, dirEntrySize)
+		e[0] = byte(seq)
+		if seq == count {
+			e[0] |= 0x40 // last logical entry comes first on disk
+		}
+		e[11] = attrLongName
+		e[13] = sum
+		part := chars[(seq-1)*13 : seq*13]
+		for i, c := range part {
+			var off int
+			switch {
+			case i < 5:
+				off = 1 + i*2
+			case i < 11:
+				off = 14 + (i-5)*2
+			default:
+				off = 28 + (i-11)*2
+			}
+			binary.LittleEndian.PutUint16(e[off:], c)
+		}
+		slots = append(slots, e)
+	}
+	return slots
+}
+
+func dotName(name string) [11]byte {
+	var short [11]byte
+	copy(short[:], fmt.Sprintf("%-11s", name))
+	return short
+}
+
+func fatLabel(label string) string {
+	label = shortNameChars(strings.ToUpper(label))
+	if len(label) > 11 {
+		label = label[:11]
+	}
+	if label == "" {
+		return "NO NAME"
+	}
+	return label
+}
+
+func firstCluster(clusters []uint32) uint32 {
+	if len(clusters) == 0 {
+		return 0
+	}
+	return clusters[0]
+}
+
+func splitFATPath(name string) []string {
+	var parts []string
+	for _, part := range strings.Split(name, "/") {
+		if part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func dosDateTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	dosTime := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	dosDate := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	return dosTime, dosDate
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// memDevice is a blockDevice in memory.
+type memDevice []byte
+
+func (m memDevice) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(len(m)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, m[off:]), nil
+}
+
+func (m memDevice) WriteAt(p []byte, off int64) (int, error) {
+	if off%sectorSize != 0 || len(p)%sectorSize != 0 {
+		return 0, fmt.Errorf("write of %d bytes at %d is not sector aligned", len(p), off)
+	}
+	if off < 0 || off+int64(len(p)) > int64(len(m)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(m[off:], p), nil
+}
+
+// newTestFAT32 formats a 40 MiB volume in memory, which gets 512-byte
+// clusters.
+func newTestFAT32(t *testing.T) (memDevice, *fatFS) {
+	t.Helper()
+	dev := make(memDevice, 40<<20)
+	fsys, err := formatFAT32(dev, uint64(len(dev)/sectorSize), 2048, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsys.clusterSize != sectorSize {
+		t.Fatalf("cluster size is %d, want %d", fsys.clusterSize, sectorSize)
+	}
+	return dev, fsys
+}
+
+func writeTestFile(t *testing.T, fsys *fatFS, name string, data []byte) {
+	t.Helper()
+	if err := fsys.WriteFile(name, bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFAT32RoundTrip(t *testing.T) {
+	dev, fsys := newTestFAT32(t)
+
+	files := map[string][]byte{
+		"README.TXT":           []byte("an exact 8.3 name\n"),
+		"readme.md":            []byte("lower case needs a long name\n"),
+		"EFI/boot/bootx64.efi": bytes.Repeat([]byte{0xEF}, 3000),
+		// Names with the same 8.3 alias get ~1, ~2...
+		"casper/filesystem.manifest":                []byte("manifest 1"),
+		"casper/filesystem.manifest-remove":         []byte("manifest 2"),
+		"casper/filesystem.manifest-minimal-remove": []byte("manifest 3"),
+		// The longest name allowed, in several long name entries
+		"pool/" + strings.Repeat("x", fatMaxNameLength-4) + ".deb": []byte("255 characters"),
+		"pool/Ubuntu Server 24.04 LTS – ünïcödé.txt":               []byte("spaces and non-ASCII"),
+		"empty": nil,
+		// Many clusters, written in several chunks
+		"casper/vmlinuz": bytes.Repeat([]byte("kernel!"), (fatWriteChunk*2+777)/7),
+	}
+	// Enough entries that the directory spans several clusters
+	for i := 0; i < 100; i++ {
+		files[fmt.Sprintf("dists/noble/main/binary-amd64/Packages-%03d.gz", i)] = []byte(fmt.Sprint(i))
+	}
+	for name, data := range files {
+		writeTestFile(t, fsys, name, data)
+	}
+
+	// Replacing a file with a larger one moves it to a longer chain
+	grown := bytes.Repeat([]byte("grown"), 1000)
+	writeTestFile(t, fsys, "readme.md", []byte("short"))
+	writeTestFile(t, fsys, "readme.md", grown)
+	files["readme.md"] = grown
+
+	if err := fsys.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	read, err := openFAT32(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.label != "TEST" || read.hiddenSectors != 2048 {
+		t.Errorf("label %q and hidden sectors %d, want TEST and 2048", read.label, read.hiddenSectors)
+	}
+	for name, want := range files {
+		got, err := read.ReadFile(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: read %d bytes that differ from the %d written", name, len(got), len(want))
+		}
+		entry, err := read.lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := name[strings.LastIndex(name, "/")+1:]; entry.name != want {
+			t.Errorf("%s is listed as %q", want, entry.name)
+		}
+	}
+
+	dir, err := read.lookup("dists/noble/main/binary-amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.children) != 100 {
+		t.Errorf("directory has %d entries, want 100", len(dir.children))
+	}
+	if clusters, _ := read.chain(dir.cluster); len(clusters) < 2 {
+		t.Errorf("directory of 100 long names fits in %d cluster", len(clusters))
+	}
+
+	readme, err := read.lookup("readme.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clusters, _ := read.chain(readme.cluster); len(clusters) != 10 {
+		t.Errorf("the grown file has a chain of %d clusters, want 10", len(clusters))
+	}
+
+	casper, err := read.lookup("casper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shorts := make(map[string]bool)
+	for _, child := range casper.children {
+		if shorts[string(child.short[:])] {
+			t.Errorf("short name %q is used twice", child.short)
+		}
+		shorts[string(child.short[:])] = true
+	}
+}
+
+func TestFAT32FileSizeLimit(t *testing.T) {
+	_, fsys := newTestFAT32(t)
+	// The size is checked before any data is read
+	err := fsys.WriteFile("casper/filesystem.squashfs", strings.NewReader(""), fatMaxFileSize+1)
+	if err == nil || !strings.Contains(err.Error(), "too large for FAT32") {
+		t.Errorf("writing a 4 GB file: got %v, want a size error", err)
+	}
+	if _, err := fsys.lookup("casper/filesystem.squashfs"); err == nil {
+		t.Errorf("the rejected file was added to the directory")
+	}
+}
+
+func TestFAT32VolumeFull(t *testing.T) {
+	_, fsys := newTestFAT32(t)
+	size := int64(len(fsys.fat)) * fsys.clusterSize
+	if err := fsys.WriteFile("big", io.LimitReader(zeroReader{}, size), size); err == nil {
+		t.Errorf("a file larger than the volume was written")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestFAT32Names(t *testing.T) {
+	dir := newFATDir("")
+	for _, tc := range []struct {
+		name, short string
+	}{
+		{"README.TXT", "README  TXT"},
+		{"readme.txt", "README~1TXT"},
+		{"filesystem.manifest", "FILESY~1MAN"},
+		{"filesystem.manifest-remove", "FILESY~2MAN"},
+		{".disk", "DISK~1     "},
+		{"a b.c d", "AB~1    CD "},
+	} {
+		entry, err := dir.add(tc.name, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(entry.short[:]); got != tc.short {
+			t.Errorf("short name of %q = %q, want %q", tc.name, got, tc.short)
+		}
+	}
+	for _, name := range []string{"", "..", "a:b", "a*b", strings.Repeat("x", fatMaxNameLength+1)} {
+		if _, err := dir.add(name, false); err == nil {
+			t.Errorf("add(%q) succeeded", name)
+		}
+	}
+}
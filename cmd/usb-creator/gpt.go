@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	sectorSize = 512
+
+	// Partitions start on 1 MiB boundaries, as diskpart aligns them
+	alignSectors = (1 << 20) / sectorSize
+
+	gptEntryCount   = 128
+	gptEntrySize    = 128
+	gptHeaderSize   = 92
+	gptEntrySectors = gptEntryCount * gptEntrySize / sectorSize
+	gptRevision     = 0x00010000
+
+	// Sectors reserved at each end of the disk: protective MBR (start
+	// only), header and partition entry array
+	gptPrimarySectors = 1 + 1 + gptEntrySectors
+	gptBackupSectors  = gptEntrySectors + 1
+)
+
+// guid is a GUID in its on-disk form, with the first three fields stored
+// little-endian as the UEFI specification requires.
+type guid [16]byte
+
+// GPT partition type GUIDs
+var (
+	gptTypeESP       = mustParseGUID("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	gptTypeBasicData = mustParseGUID("EBD0A0A2-B9E5-4433-87C0-68B6B72699C7")
+)
+
+// parseGUID converts the textual form (as printed by sgdisk or PowerShell)
+// into the on-disk byte order.
+func parseGUID(s string) (guid, error) {
+	var g guid
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 {
+		return g, fmt.Errorf("invalid GUID %q", s)
+	}
+	g[0], g[1], g[2], g[3] = raw[3], raw[2], raw[1], raw[0]
+	g[4], g[5] = raw[5], raw[4]
+	g[6], g[7] = raw[7], raw[6]
+	copy(g[8:], raw[8:])
+	return g, nil
+}
+
+func mustParseGUID(s string) guid {
+	g, err := parseGUID(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+// newRandomGUID returns a version 4 GUID in on-disk byte order.
+func newRandomGUID() guid {
+	var g guid
+	rand.Read(g[:])
+	g[7] = g[7]&0x0f | 0x40 // version 4, high byte of the little-endian third field
+	g[8] = g[8]&0x3f | 0x80 // RFC 4122 variant
+	return g
+}
+
+func (g guid) String() string {
+	return fmt.Sprintf("%08X-%04X-%04X-%X-%X",
+		binary.LittleEndian.Uint32(g[0:4]),
+		binary.LittleEndian.Uint16(g[4:6]),
+		binary.LittleEndian.Uint16(g[6:8]),
+		g[8:10], g[10:16])
+}
+
+// partitionSizes holds the requested partition sizes in bytes. A zero Data
+// size gives the data partition the rest of the disk.
+type partitionSizes struct {
+	ESP  uint64
+	Data uint64
+}
+
+// parsePartitionSizes parses the --esp-size and --data-size flags. An empty
+// data size leaves the rest of the disk to the data partition.
+func parsePartitionSizes(esp, data string) (partitionSizes, error) {
+	var sizes partitionSizes
+	var err error
+	if sizes.ESP, err = parseSize(esp); err != nil {
+		return sizes, fmt.Errorf("invalid ESP size %q: %v", esp, err)
+	}
+	// FAT32 needs at least 65525 clusters, which with 512-byte clusters and
+	// the two FATs takes just over 32 MB
+	if sizes.ESP < 33<<20 {
+		return sizes, fmt.Errorf("ESP size %q is below the 33 MB FAT32 minimum", esp)
+	}
+	if data != "" {
+		if sizes.Data, err = parseSize(data); err != nil {
+			return sizes, fmt.Errorf("invalid data partition size %q: %v", data, err)
+		}
+	}
+	return sizes, nil
+}
+
+// diskLayout places the ESP and data partition on a disk, in 512-byte
+// sectors.
+type diskLayout struct {
+	TotalSectors uint64
+	ESPStart     uint64
+	ESPSectors   uint64
+	DataStart    uint64
+	DataSectors  uint64
+}
+
+// planLayout fits the requested partition sizes onto a disk of diskSize
+// bytes, rounding each partition to whole sectors and aligning both starts
+// to 1 MiB.
+func planLayout(diskSize uint64, sizes partitionSizes) (diskLayout, error) {
+	total := diskSize / sectorSize
+	if total < alignSectors+gptBackupSectors {
+		return diskLayout{}, fmt.Errorf("disk of %d bytes is too small for a GPT", diskSize)
+	}
+	lastUsable := total - gptBackupSectors - 1
+
+	espSectors := (sizes.ESP + sectorSize - 1) / sectorSize
+	if espSectors == 0 {
+		return diskLayout{}, fmt.Errorf("ESP size must not be zero")
+	}
+	espStart := uint64(alignSectors)
+	dataStart := (espStart + espSectors + alignSectors - 1) / alignSectors * alignSectors
+
+	// By default the data partition runs to the last aligned sector
+	dataEnd := (lastUsable + 1) / alignSectors * alignSectors
+	if sizes.Data != 0 {
+		dataEnd = dataStart + (sizes.Data+sectorSize-1)/sectorSize
+	}
+	if dataEnd <= dataStart || dataEnd > lastUsable+1 {
+		return diskLayout{}, fmt.Errorf("a %d MB ESP and %d MB data partition do not fit on a %d MB disk",
+			sizes.ESP>>20, sizes.Data>>20, diskSize>>20)
+	}
+
+	return diskLayout{
+		TotalSectors: total,
+		ESPStart:     espStart,
+		ESPSectors:   espSectors,
+		DataStart:    dataStart,
+		DataSectors:  dataEnd - dataStart,
+	}, nil
+}
+
+// gptPartition is one entry of the partition array. LastLBA is inclusive.
+type gptPartition struct {
+	Type       guid
+	GUID       guid
+	FirstLBA   uint64
+	LastLBA    uint64
+	Attributes uint64
+	Name       string
+}
+
+// partitions returns the GPT entries for the layout, with fresh unique GUIDs.
+func (l diskLayout) partitions() []gptPartition {
+	return []gptPartition{
+		{
+			Type:     gptTypeESP,
+			GUID:     newRandomGUID(),
+			FirstLBA: l.ESPStart,
+			LastLBA:  l.ESPStart + l.ESPSectors - 1,
+			Name:     VolumeESP.String(),
+		},
+		{
+			Type:     gptTypeBasicData,
+			GUID:     newRandomGUID(),
+			FirstLBA: l.DataStart,
+			LastLBA:  l.DataStart + l.DataSectors - 1,
+			Name:     VolumeData.String(),
+		},
+	}
+}
+
+// writeGPT writes a protective MBR, the primary GPT header and partition
+// array at the start of the disk, and the backup array and header at the
+// end. Every write covers whole, sector-aligned sectors, so w may be a raw
+// Windows device handle.
+func writeGPT(w io.WriterAt, totalSectors uint64, diskGUID guid, parts []gptPartition) error {
+	if len(parts) > gptEntryCount {
+		return fmt.Errorf("too many partitions: %d", len(parts))
+	}
+	if totalSectors < gptPrimarySectors+gptBackupSectors+1 {
+		return fmt.Errorf("disk of %d sectors is too small for a GPT", totalSectors)
+	}
+
+	firstUsable := uint64(gptPrimarySectors)
+	lastUsable := totalSectors - gptBackupSectors - 1
+	lastLBA := totalSectors - 1
+
+	entries := make([]byte, gptEntryCount*gptEntrySize)
+	for i, p := range parts {
+		if p.FirstLBA < firstUsable || p.LastLBA > lastUsable || p.LastLBA < p.FirstLBA {
+			return fmt.Errorf("partition %d (%d-%d) is outside the usable range %d-%d",
+				i+1, p.FirstLBA, p.LastLBA, firstUsable, lastUsable)
+		}
+		e := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		copy(e[0:16], p.Type[:])
+		copy(e[16:32], p.GUID[:])
+		binary.LittleEndian.PutUint64(e[32:40], p.FirstLBA)
+		binary.LittleEndian.PutUint64(e[40:48], p.LastLBA)
+		binary.LittleEndian.PutUint64(e[48:56], p.Attributes)
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > 36 {
+			return fmt.Errorf("partition name %q is longer than 36 characters", p.Name)
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(e[56+j*2:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	if _, err := w.WriteAt(protectiveMBR(totalSectors), 0); err != nil {
+		return err
+	}
+
+	primary := gptHeader(1, lastLBA, 2, firstUsable, lastUsable, diskGUID, entriesCRC)
+	if _, err := w.WriteAt(primary, sectorSize); err != nil {
+		return err
+	}
+	if _, err := w.WriteAt(entries, 2*sectorSize); err != nil {
+		return err
+	}
+
+	backupEntriesLBA := totalSectors - gptBackupSectors
+	if _, err := w.WriteAt(entries, int64(backupEntriesLBA*sectorSize)); err != nil {
+		return err
+	}
+	backup := gptHeader(lastLBA, 1, backupEntriesLBA, firstUsable, lastUsable, diskGUID, entriesCRC)
+	_, err := w.WriteAt(backup, int64(lastLBA*sectorSize))
+	return err
+}
+
+// protectiveMBR returns sector 0: a single partition of type 0xEE covering
+// the disk, so MBR-only tools see the disk as in use.
+func protectiveMBR(totalSectors uint64) []byte {
+	mbr := make([]byte, sectorSize)
+	entry := mbr[446:462]
+	entry[1], entry[2], entry[3] = 0x00, 0x02, 0x00 // CHS of LBA 1
+	entry[4] = 0xEE
+	entry[5], entry[6], entry[7] = 0xFF, 0xFF, 0xFF
+	binary.LittleEndian.PutUint32(entry[8:12], 1)
+	size := totalSectors - 1
+	if size > 0xFFFFFFFF {
+		size = 0xFFFFFFFF
+	}
+	binary.LittleEndian.PutUint32(entry[12:16], uint32(size))
+	mbr[510], mbr[511] = 0x55, 0xAA
+	return mbr
+}
+
+func gptHeader(myLBA, alternateLBA, entriesLBA, firstUsable, lastUsable uint64, diskGUID guid, entriesCRC uint32) []byte {
+	h := make([]byte, sectorSize)
+	copy(h[0:8], "EFI PART")
+	binary.LittleEndian.PutUint32(h[8:12], gptRevision)
+	binary.LittleEndian.PutUint32(h[12:16], gptHeaderSize)
+	binary.LittleEndian.PutUint64(h[24:32], myLBA)
+	binary.LittleEndian.PutUint64(h[32:40], alternateLBA)
+	binary.LittleEndian.PutUint64(h[40:48], firstUsable)
+	binary.LittleEndian.PutUint64(h[48:56], lastUsable)
+	copy(h[56:72], diskGUID[:])
+	binary.LittleEndian.PutUint64(h[72:80], entriesLBA)
+	binary.LittleEndian.PutUint32(h[80:84], gptEntryCount)
+	binary.LittleEndian.PutUint32(h[84:88], gptEntrySize)
+	binary.LittleEndian.PutUint32(h[88:92], entriesCRC)
+	// The header CRC is computed with its own field zeroed
+	binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:gptHeaderSize]))
+	return h
+}
+
+// writePartitionTable partitions the disk or image at path with a fresh GPT
+// for layout.
+func writePartitionTable(path string, layout diskLayout) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := writeGPT(f, layout.TotalSectors, newRandomGUID(), layout.partitions()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readGPT returns the non-empty entries of the primary GPT on r, after
+// checking the header and partition array checksums.
+func readGPT(r io.ReaderAt) ([]gptPartition, error) {
+	h := make([]byte, sectorSize)
+	if _, err := r.ReadAt(h, sectorSize); err != nil {
+		return nil, err
+	}
+	if string(h[0:8]) != "EFI PART" {
+		return nil, fmt.Errorf("no GPT found")
+	}
+	size := binary.LittleEndian.Uint32(h[12:16])
+	if size < gptHeaderSize || size > sectorSize {
+		return nil, fmt.Errorf("invalid GPT header size %d", size)
+	}
+	stored := binary.LittleEndian.Uint32(h[16:20])
+	binary.LittleEndian.PutUint32(h[16:20], 0)
+	if crc32.ChecksumIEEE(h[:size]) != stored {
+		return nil, fmt.Errorf("GPT header checksum mismatch")
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(h[72:80])
+	count := binary.LittleEndian.Uint32(h[80:84])
+	entrySize := binary.LittleEndian.Uint32(h[84:88])
+	if entrySize < gptEntrySize || entrySize%8 != 0 || count > 1024 {
+		return nil, fmt.Errorf("invalid GPT partition array of %d entries of %d bytes", count, entrySize)
+	}
+	length := uint64(count) * uint64(entrySize)
+	entries := make([]byte, (length+sectorSize-1)/sectorSize*sectorSize)
+	if _, err := r.ReadAt(entries, int64(entriesLBA*sectorSize)); err != nil {
+		return nil, err
+	}
+	entries = entries[:length]
+	if crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(h[88:92]) {
+		return nil, fmt.Errorf("GPT partition array checksum mismatch")
+	}
+
+	var parts []gptPartition
+	for i := uint32(0); i < count; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		var p gptPartition
+		copy(p.Type[:], e[0:16])
+		if p.Type == (guid{}) {
+			continue
+		}
+		copy(p.GUID[:], e[16:32])
+		p.FirstLBA = binary.LittleEndian.Uint64(e[32:40])
+		p.LastLBA = binary.LittleEndian.Uint64(e[40:48])
+		p.Attributes = binary.LittleEndian.Uint64(e[48:56])
+		name := make([]uint16, 36)
+		for j := range name {
+			name[j] = binary.LittleEndian.Uint16(e[56+j*2:])
+		}
+		for j, c := range name {
+			if c == 0 {
+				name = name[:j]
+				break
+			}
+		}
+		p.Name = string(utf16.Decode(name))
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
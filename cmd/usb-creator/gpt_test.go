@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+// sectorRecorder keeps every sector written to it and fails the test on a
+// write that does not cover whole, aligned sectors.
+type sectorRecorder struct {
+	t       *testing.T
+	sectors map[int64][]byte
+}
+
+func (r *sectorRecorder) WriteAt(p []byte, off int64) (int, error) {
+	if off%sectorSize != 0 || len(p)%sectorSize != 0 {
+		r.t.Errorf("write of %d bytes at offset %d is not sector aligned", len(p), off)
+	}
+	for i := 0; i < len(p); i += sectorSize {
+		r.sectors[(off+int64(i))/sectorSize] = append([]byte(nil), p[i:i+sectorSize]...)
+	}
+	return len(p), nil
+}
+
+// ReadAt reads back what was written; unwritten sectors read as zeroes.
+func (r *sectorRecorder) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		if s, ok := r.sectors[(off+int64(i))/sectorSize]; ok {
+			p[i] = s[(off+int64(i))%sectorSize]
+		} else {
+			p[i] = 0
+		}
+	}
+	return len(p), nil
+}
+
+func (r *sectorRecorder) read(lba, n int64) []byte {
+	b := make([]byte, n*sectorSize)
+	r.ReadAt(b, lba*sectorSize)
+	return b
+}
+
+// The expected GPT of a 64 MiB disk with a 33 MiB ESP at 2048 and the data
+// partition from 69632 to 129023, with the GUIDs fixed. The bytes were built
+// from the field layout of the UEFI specification, independently of
+// writeGPT.
+const (
+	wantEntriesCRC = 0xf88e8b28
+
+	wantPrimaryHeader = "" +
+		"4546492050415254000001005c00000068a35091000000000100000000000000" +
+		"ffff0100000000002200000000000000deff0100000000001111111122223333" +
+		"444455555555555502000000000000008000000080000000288b8ef8"
+
+	wantBackupHeader = "" +
+		"4546492050415254000001005c000000ad6f5c1f00000000ffff010000000000" +
+		"01000000000000002200000000000000deff0100000000001111111122223333" +
+		"4444555555555555dfff0100000000008000000080000000288b8ef8"
+
+	wantEntries = "" +
+		"28732ac11ff8d211ba4b00a0c93ec93baaaaaaaa000000408000000000000001" +
+		"0008000000000000ff0f01000000000000000000000000004500530050000000" +
+		"0000000000000000000000000000000000000000000000000000000000000000" +
+		"0000000000000000000000000000000000000000000000000000000000000000" +
+		"a2a0d0ebe5b9334487c068b6b72699c7bbbbbbbb000000408000000000000002" +
+		"0010010000000000fff701000000000000000000000000005500620075006e00" +
+		"7400750000000000000000000000000000000000000000000000000000000000" +
+		"0000000000000000000000000000000000000000000000000000000000000000"
+
+	// The 0xEE partition from LBA 1 to the end of the disk
+	wantMBREntry = "00000200eeffffff01000000ffff0100"
+)
+
+func TestWriteGPT(t *testing.T) {
+	layout, err := planLayout(64<<20, partitionSizes{ESP: 33 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := diskLayout{TotalSectors: 131072, ESPStart: 2048, ESPSectors: 67584, DataStart: 69632, DataSectors: 59392}
+	if layout != want {
+		t.Fatalf("planLayout = %+v, want %+v", layout, want)
+	}
+	for _, start := range []uint64{layout.ESPStart, layout.DataStart} {
+		if start%alignSectors != 0 {
+			t.Errorf("partition at sector %d is not 1 MiB aligned", start)
+		}
+	}
+
+	parts := layout.partitions()
+	parts[0].GUID = mustParseGUID("AAAAAAAA-0000-4000-8000-000000000001")
+	parts[1].GUID = mustParseGUID("BBBBBBBB-0000-4000-8000-000000000002")
+	disk := &sectorRecorder{t: t, sectors: make(map[int64][]byte)}
+	if err := writeGPT(disk, layout.TotalSectors, mustParseGUID("11111111-2222-3333-4444-555555555555"), parts); err != nil {
+		t.Fatal(err)
+	}
+	if len(disk.sectors) != 1+1+32+32+1 {
+		t.Errorf("wrote %d sectors, want 67", len(disk.sectors))
+	}
+
+	mbr := disk.read(0, 1)
+	if got := hex.EncodeToString(mbr[446:462]); got != wantMBREntry {
+		t.Errorf("MBR partition entry = %s, want %s", got, wantMBREntry)
+	}
+	if !bytes.Equal(mbr[462:510], make([]byte, 48)) || mbr[510] != 0x55 || mbr[511] != 0xAA {
+		t.Errorf("MBR has other entries or no boot signature")
+	}
+
+	last := int64(layout.TotalSectors - 1)
+	for _, tc := range []struct {
+		name       string
+		lba        int64
+		want       string
+		entriesLBA int64
+		wantCRC    uint32
+	}{
+		{"primary", 1, wantPrimaryHeader, 2, 0x9150a368},
+		{"backup", last, wantBackupHeader, last - 32, 0x1f5c6fad},
+	} {
+		header := disk.read(tc.lba, 1)
+		if got := hex.EncodeToString(header[:gptHeaderSize]); got != tc.want {
+			t.Errorf("%s header =\n%s\nwant\n%s", tc.name, got, tc.want)
+		}
+		if !bytes.Equal(header[gptHeaderSize:], make([]byte, sectorSize-gptHeaderSize)) {
+			t.Errorf("%s header sector is not zero-padded", tc.name)
+		}
+		if got := binary.LittleEndian.Uint32(header[16:20]); got != tc.wantCRC {
+			t.Errorf("%s header CRC32 = %#x, want %#x", tc.name, got, tc.wantCRC)
+		}
+		if got := binary.LittleEndian.Uint32(header[88:92]); got != wantEntriesCRC {
+			t.Errorf("%s partition array CRC32 = %#x, want %#x", tc.name, got, wantEntriesCRC)
+		}
+
+		entries := disk.read(tc.entriesLBA, gptEntrySectors)
+		if got := hex.EncodeToString(entries[:2*gptEntrySize]); got != wantEntries {
+			t.Errorf("%s partition entries =\n%s\nwant\n%s", tc.name, got, wantEntries)
+		}
+		if !bytes.Equal(entries[2*gptEntrySize:], make([]byte, len(entries)-2*gptEntrySize)) {
+			t.Errorf("%s partition array has more than two entries", tc.name)
+		}
+	}
+
+	read, err := readGPT(disk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || read[0] != parts[0] || read[1] != parts[1] {
+		t.Errorf("readGPT = %+v, want %+v", read, parts)
+	}
+}
+
+func TestReadGPTChecksums(t *testing.T) {
+	layout, err := planLayout(64<<20, partitionSizes{ESP: 33 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		off  int64
+	}{
+		{"header", sectorSize + 40},
+		{"partition array", 2*sectorSize + 32},
+	} {
+		disk := &sectorRecorder{t: t, sectors: make(map[int64][]byte)}
+		if err := writeGPT(disk, layout.TotalSectors, newRandomGUID(), layout.partitions()); err != nil {
+			t.Fatal(err)
+		}
+		disk.sectors[tc.off/sectorSize][tc.off%sectorSize] ^= 1
+		if _, err := readGPT(disk); err == nil {
+			t.Errorf("readGPT accepted a corrupt %s", tc.name)
+		}
+	}
+}
+
+func TestParsePartitionSizesFloor(t *testing.T) {
+	// The smallest ESP accepted must hold a FAT32 filesystem
+	sizes, err := parsePartitionSizes("33M", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, clusters := fatGeometry(uint32(sizes.ESP/sectorSize), 1); clusters < fatMinClusters {
+		t.Errorf("a %d byte ESP has only %d clusters", sizes.ESP, clusters)
+	}
+	if _, err := parsePartitionSizes("32M", ""); err == nil {
+		t.Errorf("parsePartitionSizes accepted a 32 MB ESP, which is too small for FAT32")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "fmt"
+
+// driveGuard holds the checks a drive must pass before it is erased.
+type driveGuard struct {
+	// MaxSize is the largest drive erased without Force; internal disks are
+	// usually larger than install sticks
+	MaxSize uint64
+	Force   bool
+	// Unmount lets drives with mounted filesystems through; the backend
+	// unmounts them before wiping
+	Unmount bool
+}
+
+// check refuses drives holding the running system, whatever Force says,
+// drives with mounted filesystems unless Unmount is set, and drives larger
+// than MaxSize unless Force is set.
+func (g *driveGuard) check(drive *DriveInfo) error {
+	if drive.System != "" {
+		return fmt.Errorf("%s holds %s and will not be erased", drive.DeviceID, drive.System)
+	}
+	if drive.Mounted != "" && !g.Unmount {
+		return fmt.Errorf("%s is in use, mounted at %s; unmount it, or pass --unmount if this really is the right drive", drive.DeviceID, drive.Mounted)
+	}
+	if drive.Size == 0 && !g.Force {
+		return fmt.Errorf("the size of %s is unknown; pass --force if this really is the right drive", drive.DeviceID)
+	}
+	if drive.Size > g.MaxSize && !g.Force {
+		return fmt.Errorf("%s is %s, larger than the %gGB --max-drive-size; pass --force if this really is the right drive",
+			drive.DeviceID, drive.SizeDisplay, float64(g.MaxSize)/(1<<30))
+	}
+	return nil
+}
+
+// recheck lists the drives again right before the erase and makes sure the
+// device still is the disk the user picked, so a drive plugged in or pulled
+// since then cannot shift the erase onto another disk.
+func (g *driveGuard) recheck(backend DiskBackend, drive *DriveInfo) error {
+	drives, err := backend.ListDrives()
+	if err != nil {
+		return err
+	}
+	for _, d := range drives {
+		if d.DeviceID != drive.DeviceID {
+			continue
+		}
+		if d.Serial != drive.Serial || d.Size != drive.Size || d.Model != drive.Model {
+			return fmt.Errorf("%s is now %s %s (serial %q), not the selected %s %s (serial %q); were drives plugged in or removed?",
+				d.DeviceID, d.Model, d.SizeDisplay, d.Serial, drive.Model, drive.SizeDisplay, drive.Serial)
+		}
+		return g.check(&d)
+	}
+	return fmt.Errorf("%s is no longer connected", drive.DeviceID)
+}
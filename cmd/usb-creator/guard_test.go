@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDriveGuardCheck(t *testing.T) {
+	stick := DriveInfo{DeviceID: "/dev/sdb", Size: 16 << 30, SizeDisplay: "16.00GB"}
+	for _, tc := range []struct {
+		name  string
+		edit  func(d *DriveInfo)
+		guard driveGuard
+		want  string // part of the error, or "" for none
+	}{
+		{"stick", func(d *DriveInfo) {}, driveGuard{}, ""},
+		{"system disk", func(d *DriveInfo) { d.System = "the / filesystem" }, driveGuard{}, "will not be erased"},
+		{"system disk with --force --unmount", func(d *DriveInfo) { d.System = "the / filesystem" }, driveGuard{Force: true, Unmount: true}, "will not be erased"},
+		{"mounted", func(d *DriveInfo) { d.Mounted = "/media/user/STICK" }, driveGuard{}, "mounted at /media/user/STICK"},
+		{"mounted with --force", func(d *DriveInfo) { d.Mounted = "/media/user/STICK" }, driveGuard{Force: true}, "--unmount"},
+		{"mounted with --unmount", func(d *DriveInfo) { d.Mounted = "/media/user/STICK" }, driveGuard{Unmount: true}, ""},
+		{"too large", func(d *DriveInfo) { d.Size = 512 << 30 }, driveGuard{}, "--max-drive-size"},
+		{"too large with --unmount", func(d *DriveInfo) { d.Size = 512 << 30 }, driveGuard{Unmount: true}, "--max-drive-size"},
+		{"too large with --force", func(d *DriveInfo) { d.Size = 512 << 30 }, driveGuard{Force: true}, ""},
+		{"unknown size", func(d *DriveInfo) { d.Size = 0 }, driveGuard{}, "size of /dev/sdb is unknown"},
+	} {
+		drive := stick
+		tc.edit(&drive)
+		guard := tc.guard
+		guard.MaxSize = 256 << 30
+		err := guard.check(&drive)
+		switch {
+		case tc.want == "" && err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)):
+			t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+}
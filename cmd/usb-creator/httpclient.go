@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+
+	// Longest a download may stall without receiving anything
+	defaultReadTimeout = 60 * time.Second
+)
+
+// httpClient makes every request of the tool. configureHTTP replaces it with
+// one using the proxy, CA and timeout settings from .env.
+var httpClient = mustHTTPClient(httpSettings{})
+
+// httpSettings are the network settings read from .env. Without a ProxyURL,
+// the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables apply.
+type httpSettings struct {
+	ProxyURL       string // PROXY_URL
+	ProxyUsername  string // PROXY_USERNAME
+	ProxyPassword  string // PROXY_PASSWORD
+	NoProxy        string // NO_PROXY, used with PROXY_URL
+	CABundle       string // CA_BUNDLE, PEM certificates trusted besides the system's
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+}
+
+// httpKeys are the settings of .env that configureHTTP reads.
+var httpKeys = []string{
+	"PROXY_URL", "PROXY_USERNAME", "PROXY_PASSWORD", "NO_PROXY", "CA_BUNDLE",
+	"HTTP_CONNECT_TIMEOUT", "HTTP_READ_TIMEOUT",
+}
+
+// configureHTTP sets up httpClient from the .env file, if there is one.
+// It reads only httpKeys, so a mistake in an installation setting does not
+// stop commands that need none of them.
+func configureHTTP() error {
+	envFile, err := findEnvFile()
+	if err != nil {
+		return nil
+	}
+	config, err := readConfigKeys(envFile, httpKeys)
+	if err != nil {
+		return err
+	}
+	if config.HTTPConnectTimeout <= 0 || config.HTTPReadTimeout <= 0 {
+		return fmt.Errorf("HTTP_CONNECT_TIMEOUT and HTTP_READ_TIMEOUT must be positive")
+	}
+
+	settings := httpSettings{
+		ProxyURL:       config.ProxyURL,
+		ProxyUsername:  config.ProxyUsername,
+		ProxyPassword:  config.ProxyPassword,
+		NoProxy:        config.NoProxy,
+		CABundle:       config.CABundle,
+		ConnectTimeout: config.HTTPConnectTimeout,
+		ReadTimeout:    config.HTTPReadTimeout,
+	}
+	client, err := newHTTPClient(settings)
+	if err != nil {
+		return err
+	}
+	httpClient = client
+	return nil
+}
+
+func mustHTTPClient(settings httpSettings) *http.Client {
+	client, err := newHTTPClient(settings)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// newHTTPClient builds a client for settings. It has no overall timeout,
+// which would cut long downloads short; instead connecting, the TLS
+// handshake and every read must finish within their timeouts.
+func newHTTPClient(settings httpSettings) (*http.Client, error) {
+	connectTimeout := settings.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultConnectTimeout
+	}
+	readTimeout := settings.ReadTimeout
+	if readTimeout == 0 {
+		readTimeout = defaultReadTimeout
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if settings.ProxyURL != "" {
+		proxyURL, err := url.Parse(settings.ProxyURL)
+		if err != nil || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid PROXY_URL %q", settings.ProxyURL)
+		}
+		if settings.ProxyUsername != "" {
+			proxyURL.User = url.UserPassword(settings.ProxyUsername, settings.ProxyPassword)
+		}
+		noProxy := splitList(settings.NoProxy)
+		proxy = func(req *http.Request) (*url.URL, error) {
+			if bypassProxy(req.URL.Hostname(), noProxy) {
+				return nil, nil
+			}
+			return proxyURL, nil
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if settings.CABundle != "" {
+		pool, err := loadCABundle(settings.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &readTimeoutConn{Conn: conn, timeout: readTimeout}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// loadCABundle returns the system's trusted certificates plus those in the
+// PEM file at path, such as the CA of a TLS-inspecting proxy.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA_BUNDLE: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA_BUNDLE %s holds no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// bypassProxy reports whether host matches an entry of noProxy: "*", an IP
+// address or CIDR range, a host name, or a domain given as example.com or
+// .example.com that also covers its subdomains.
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(entry)
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h // Ports are not told apart
+		}
+		switch {
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, network, err := net.ParseCIDR(entry); err == nil && network.Contains(ip) {
+				return true
+			}
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return true
+			}
+		default:
+			domain := strings.TrimPrefix(entry, ".")
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readTimeoutConn fails a read that receives nothing within timeout, so a
+// stalled connection is retried instead of hanging forever.
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *readTimeoutConn) Read(p []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
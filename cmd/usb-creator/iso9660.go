@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	isoSectorSize = 2048
+
+	// Volume descriptors start after the 32 KiB system area
+	isoDescriptorStart = 16
+	isoMaxDescriptors  = 64
+
+	isoDescPrimary       = 1
+	isoDescSupplementary = 2
+	isoDescTerminator    = 255
+
+	isoFlagDirectory   = 0x02
+	isoFlagMultiExtent = 0x80
+
+	// Continuation areas followed for one record, so a CE loop ends
+	isoMaxContinuations = 16
+
+	// POSIX file type bits from the Rock Ridge PX entry
+	rrTypeMask    = 0170000
+	rrTypeSymlink = 0120000
+)
+
+// Identifiers of the Rock Ridge extension in a SUSP ER entry: RRIP 1.09,
+// 1.10 and 1.12
+var rockRidgeIDs = []string{"RRIP_1991A", "IEEE_P1282", "IEEE_1282"}
+
+// isoImage reads files straight from an ISO 9660 image and serves them as
+// an fs.FS. Names come from Rock Ridge when the image has it, otherwise
+// from the Joliet tree, and only then from the plain ISO 9660 names.
+type isoImage struct {
+	r    io.ReaderAt
+	file *os.File
+
+	// VolumeID is the volume label from the primary volume descriptor
+	VolumeID string
+
+	// volumeSectors is the size of the volume; no extent may end past it
+	volumeSectors uint32
+
+	root      *isoEntry
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+
+	// Sector numbers and raw content of the primary and Joliet volume
+	// descriptors, kept for remastering
+	primaryLBA, jolietLBA uint32
+	primary, jolietDesc   []byte
+}
+
+// isoEntry is a file or directory record. It implements both fs.FileInfo
+// and fs.DirEntry.
+type isoEntry struct {
+	name    string
+	extents []isoExtent
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+
+	children []*isoEntry
+	loaded   bool
+
+	// records holds the entry's raw directory records (several for a
+	// multi-extent file), and for a directory, dots holds its own "." and
+	// ".." records
+	records   [][]byte
+	dots      [][]byte
+	relocated bool
+}
+
+type isoExtent struct {
+	lba    uint32
+	length uint32
+}
+
+// openISO opens the ISO image at path. Close releases the file.
+func openISO(path string) (*isoImage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	iso, err := readISO(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	iso.file = f
+	return iso, nil
+}
+
+// readISO parses the volume descriptors of an image and picks the
+// directory tree with the best names.
+func readISO(r io.ReaderAt) (*isoImage, error) {
+	iso := &isoImage{r: r}
+
+	for i := 0; ; i++ {
+		if i == isoMaxDescriptors {
+			return nil, fmt.Errorf("no volume descriptor terminator")
+		}
+		desc := make([]byte, isoSectorSize)
+		if _, err := r.ReadAt(desc, int64(isoDescriptorStart+i)*isoSectorSize); err != nil {
+			return nil, fmt.Errorf("not an ISO 9660 image: %v", err)
+		}
+		if string(desc[1:6]) != "CD001" {
+			return nil, fmt.Errorf("not an ISO 9660 image")
+		}
+		if desc[0] == isoDescTerminator {
+			break
+		}
+		switch desc[0] {
+		case isoDescPrimary:
+			if iso.primary == nil {
+				iso.primary, iso.primaryLBA = desc, uint32(isoDescriptorStart+i)
+			}
+		case isoDescSupplementary:
+			// Joliet is a supplementary descriptor with a UCS-2 escape sequence
+			switch string(desc[88:91]) {
+			case "%/@", "%/C", "%/E":
+				iso.jolietDesc, iso.jolietLBA = desc, uint32(isoDescriptorStart+i)
+			}
+		}
+	}
+	if iso.primary == nil {
+		return nil, fmt.Errorf("no primary volume descriptor")
+	}
+	iso.VolumeID = strings.TrimSpace(string(iso.primary[40:72]))
+	iso.volumeSectors = binary.LittleEndian.Uint32(iso.primary[80:84])
+
+	root, err := iso.rootEntry(iso.primary)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rock Ridge is announced by an SP entry in the root's "." record,
+	// which marks SUSP use, and an ER entry naming the RRIP extension
+	if err := iso.checkExtent(root.extents[0]); err != nil {
+		return nil, err
+	}
+	first := make([]byte, isoSectorSize)
+	if _, err := r.ReadAt(first, int64(root.extents[0].lba)*isoSectorSize); err != nil {
+		return nil, err
+	}
+	if su := systemUseArea(first[:first[0]]); len(su) >= 7 && string(su[0:2]) == "SP" && su[4] == 0xBE && su[5] == 0xEF {
+		if iso.rockRidge, err = iso.hasRockRidgeER(su); err != nil {
+			return nil, err
+		}
+		if iso.rockRidge {
+			iso.suspSkip = int(su[6])
+		}
+	}
+
+	if !iso.rockRidge && iso.jolietDesc != nil {
+		iso.joliet = true
+		if root, err = iso.rootEntry(iso.jolietDesc); err != nil {
+			return nil, err
+		}
+	}
+	iso.root = root
+	return iso, nil
+}
+
+func (iso *isoImage) rootEntry(desc []byte) (*isoEntry, error) {
+	rec := desc[156:190]
+	if rec[25]&isoFlagDirectory == 0 {
+		return nil, fmt.Errorf("root record is not a directory")
+	}
+	return &isoEntry{
+		name:    ".",
+		extents: []isoExtent{{lba: binary.LittleEndian.Uint32(rec[2:6]), length: binary.LittleEndian.Uint32(rec[10:14])}},
+		size:    int64(binary.LittleEndian.Uint32(rec[10:14])),
+		mode:    fs.ModeDir | 0555,
+		modTime: isoTime(rec[18:25]),
+	}, nil
+}
+
+// hasRockRidgeER reports whether the System Use area of the root's "."
+// record, or its continuation area, has an ER entry for Rock Ridge. An SP
+// entry alone only says SUSP is in use, possibly by another extension.
+func (iso *isoImage) hasRockRidgeER(su []byte) (bool, error) {
+	var continuation []byte
+	continuations := 0
+	for {
+		if len(su) < 4 {
+			if continuation == nil {
+				return false, nil
+			}
+			su, continuation = continuation, nil
+			continue
+		}
+		length := int(su[2])
+		if length < 4 || length > len(su) {
+			return false, nil
+		}
+		body := su[:length]
+		su = su[length:]
+
+		switch string(body[0:2]) {
+		case "ER":
+			if len(body) >= 8 && 8+int(body[4]) <= len(body) {
+				id := string(body[8 : 8+int(body[4])])
+				for _, rr := range rockRidgeIDs {
+					if id == rr {
+						return true, nil
+					}
+				}
+			}
+		case "CE":
+			if continuations++; continuations > isoMaxContinuations {
+				return false, fmt.Errorf("too many continuation areas")
+			}
+			var err error
+			if continuation, err = iso.readContinuation(body); err != nil {
+				return false, err
+			}
+		case "ST":
+			su = nil
+		}
+	}
+}
+
+// readContinuation reads the continuation area a CE entry points to. It
+// must lie within one sector of the volume.
+func (iso *isoImage) readContinuation(body []byte) ([]byte, error) {
+	if len(body) < 28 {
+		return nil, nil
+	}
+	block := binary.LittleEndian.Uint32(body[4:8])
+	offset := binary.LittleEndian.Uint32(body[12:16])
+	size := binary.LittleEndian.Uint32(body[20:24])
+	if offset >= isoSectorSize || size > isoSectorSize-offset || (iso.volumeSectors != 0 && block >= iso.volumeSectors) {
+		return nil, fmt.Errorf("corrupt continuation area at sector %d", block)
+	}
+	continuation := make([]byte, size)
+	if _, err := iso.r.ReadAt(continuation, int64(block)*isoSectorSize+int64(offset)); err != nil {
+		return nil, err
+	}
+	return continuation, nil
+}
+
+// checkExtent rejects an extent that does not fit in the volume, before
+// anything is allocated for it.
+func (iso *isoImage) checkExtent(ext isoExtent) error {
+	end := uint64(ext.lba)*isoSectorSize + uint64(ext.length)
+	if iso.volumeSectors != 0 && end > uint64(iso.volumeSectors)*isoSectorSize {
+		return fmt.Errorf("extent of %d bytes at sector %d is outside the %d sector volume", ext.length, ext.lba, iso.volumeSectors)
+	}
+	return nil
+}
+
+// Close releases the image file.
+func (iso *isoImage) Close() error {
+	if iso.file == nil {
+		return nil
+	}
+	return iso.file.Close()
+}
+
+// ReleaseInfo returns the release line from .disk/info, such as
+// `Ubuntu-Server 24.04.1 LTS "Noble Numbat" - Release amd64 (20240827.1)`,
+// or "" if the image has none.
+func (iso *isoImage) ReleaseInfo() string {
+	data, err := fs.ReadFile(iso, ".disk/info")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Open implements fs.FS.
+func (iso *isoImage) Open(name string) (fs.File, error) {
+	entry, err := iso.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := &isoFile{iso: iso, entry: entry}
+	if !entry.IsDir() {
+		readers := make([]io.Reader, len(entry.extents))
+		for i, ext := range entry.extents {
+			readers[i] = io.NewSectionReader(iso.r, int64(ext.lba)*isoSectorSize, int64(ext.length))
+		}
+		f.reader = io.MultiReader(readers...)
+	}
+	return f, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (iso *isoImage) ReadDir(name string) ([]fs.DirEntry, error) {
+	entry, err := iso.lookup(name)
+	if err == nil && !entry.IsDir() {
+		err = fmt.Errorf("not a directory")
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	children, err := iso.readDir(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	entries := make([]fs.DirEntry, len(children))
+	for i, child := range children {
+		entries[i] = child
+	}
+	return entries, nil
+}
+
+func (iso *isoImage) lookup(name string) (*isoEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+	entry := iso.root
+	if name == "." {
+		return entry, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if !entry.IsDir() {
+			return nil, fs.ErrNotExist
+		}
+		children, err := iso.readDir(entry)
+		if err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(children), func(i int) bool { return children[i].name >= part })
+		if i == len(children) || children[i].name != part {
+			return nil, fs.ErrNotExist
+		}
+		entry = children[i]
+	}
+	return entry, nil
+}
+
+// readDir parses and caches the records of a directory, sorted by name.
+func (iso *isoImage) readDir(dir *isoEntry) ([]*isoEntry, error) {
+	if dir.loaded {
+		return dir.children, nil
+	}
+
+	// The size comes from the image, so it is checked before allocating
+	if err := iso.checkExtent(dir.extents[0]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, dir.size)
+	if _, err := iso.r.ReadAt(data, int64(dir.extents[0].lba)*isoSectorSize); err != nil {
+		return nil, err
+	}
+
+	var children []*isoEntry
+	var continued *isoEntry
+	for off := 0; off < len(data); {
+		n := int(data[off])
+		if n == 0 {
+			// Records never cross a sector boundary; the rest is padding
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if n < 34 || off+n > len(data) || 33+int(data[off+32]) > n {
+			return nil, fmt.Errorf("corrupt directory record at sector %d", dir.extents[0].lba+uint32(off/isoSectorSize))
+		}
+		rec := data[off : off+n]
+		off += n
+
+		nameLen := int(rec[32])
+		rawName := rec[33 : 33+nameLen]
+		if nameLen == 1 && (rawName[0] == 0 || rawName[0] == 1) {
+			dir.dots = append(dir.dots, append([]byte(nil), rec...)) // "." and ".."
+			continue
+		}
+		flags := rec[25]
+		ext := isoExtent{lba: binary.LittleEndian.Uint32(rec[2:6]), length: binary.LittleEndian.Uint32(rec[10:14])}
+
+		// Files over 4 GiB are split into several records with the same name
+		if continued != nil {
+			continued.records = append(continued.records, append([]byte(nil), rec...))
+			continued.extents = append(continued.extents, ext)
+			continued.size += int64(ext.length)
+			if flags&isoFlagMultiExtent == 0 {
+				continued = nil
+			}
+			continue
+		}
+
+		entry := &isoEntry{
+			name:    iso.decodeName(rawName, flags&isoFlagDirectory != 0),
+			extents: []isoExtent{ext},
+			size:    int64(ext.length),
+			mode:    0444,
+			modTime: isoTime(rec[18:25]),
+			records: [][]byte{append([]byte(nil), rec...)},
+		}
+		if flags&isoFlagDirectory != 0 {
+			entry.mode = fs.ModeDir | 0555
+		}
+
+		if iso.rockRidge {
+			skip, err := iso.applyRockRidge(entry, systemUseArea(rec))
+			if err != nil {
+				return nil, err
+			}
+			if skip {
+				continue
+			}
+		}
+
+		if flags&isoFlagMultiExtent != 0 {
+			continued = entry
+		}
+		children = append(children, entry)
+	}
+
+	sort.Slice(children, func(i, j int) bool { return children[i].name < children[j].name })
+	dir.children = children
+	dir.loaded = true
+
+	if dir == iso.root && iso.rockRidge {
+		// Hide the directory that deep directories were relocated to once
+		// its entries have been filtered out
+		for i, child := range children {
+			if child.name != "rr_moved" && child.name != ".rr_moved" {
+				continue
+			}
+			if moved, err := iso.readDir(child); err == nil && len(moved) == 0 {
+				dir.children = append(children[:i:i], children[i+1:]...)
+			}
+			break
+		}
+	}
+	return dir.children, nil
+}
+
+// decodeName converts a record's file identifier. Plain ISO 9660 names are
+// lower-cased, as Linux mounts them, and lose their ";1" version suffix.
+func (iso *isoImage) decodeName(raw []byte, isDir bool) string {
+	var name string
+	if iso.joliet {
+		units := make([]uint16, len(raw)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(raw[i*2:])
+		}
+		name = string(utf16.Decode(units))
+	} else {
+		name = strings.ToLower(string(raw))
+	}
+	if !isDir {
+		if i := strings.LastIndexByte(name, ';'); i >= 0 {
+			name = name[:i]
+		}
+		name = strings.TrimSuffix(name, ".")
+	}
+	return name
+}
+
+// applyRockRidge reads the name, file type and directory relocation entries
+// of a record's System Use area, following continuation areas. It reports
+// whether the record should be hidden because it was relocated.
+func (iso *isoImage) applyRockRidge(entry *isoEntry, su []byte) (bool, error) {
+	if len(su) < iso.suspSkip {
+		return false, nil
+	}
+	su = su[iso.suspSkip:]
+
+	var name strings.Builder
+	var hasName bool
+	var continuation []byte
+	continuations := 0
+	for {
+		if len(su) < 4 {
+			if continuation == nil {
+				break
+			}
+			su, continuation = continuation, nil
+			continue
+		}
+		length := int(su[2])
+		if length < 4 || length > len(su) {
+			break
+		}
+		body := su[:length]
+		su = su[length:]
+
+		switch string(body[0:2]) {
+		case "NM":
+			// Flags 2 and 4 mark "." and ".."; names may span several NM entries
+			if len(body) >= 5 && body[4]&0x06 == 0 {
+				name.Write(body[5:])
+				hasName = true
+			}
+		case "PX":
+			if len(body) >= 8 && binary.LittleEndian.Uint32(body[4:8])&rrTypeMask == rrTypeSymlink {
+				entry.mode = fs.ModeSymlink | 0777
+			}
+		case "SL":
+			entry.mode = fs.ModeSymlink | 0777
+		case "RE":
+			// A deep directory moved elsewhere; it is listed under its CL entry
+			return true, nil
+		case "CL":
+			if len(body) >= 8 {
+				if err := iso.relinkChild(entry, binary.LittleEndian.Uint32(body[4:8])); err != nil {
+					return false, err
+				}
+			}
+		case "CE":
+			if continuations++; continuations > isoMaxContinuations {
+				return false, fmt.Errorf("too many continuation areas")
+			}
+			var err error
+			if continuation, err = iso.readContinuation(body); err != nil {
+				return false, err
+			}
+		case "ST":
+			su = nil
+		}
+	}
+	if hasName {
+		entry.name = name.String()
+	}
+	return false, nil
+}
+
+// relinkChild points a CL placeholder at the relocated directory, whose
+// size is in the "." record of its first sector.
+func (iso *isoImage) relinkChild(entry *isoEntry, lba uint32) error {
+	first := make([]byte, isoSectorSize)
+	if _, err := iso.r.ReadAt(first, int64(lba)*isoSectorSize); err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint32(first[10:14])
+	entry.extents = []isoExtent{{lba: lba, length: size}}
+	entry.size = int64(size)
+	entry.mode = fs.ModeDir | 0555
+	entry.relocated = true
+	return nil
+}
+
+// systemUseArea returns the bytes after the file identifier and its padding.
+func systemUseArea(rec []byte) []byte {
+	if len(rec) < 34 {
+		return nil
+	}
+	start := 33 + int(rec[32])
+	if rec[32]%2 == 0 {
+		start++ // padding byte after even-length identifiers
+	}
+	if start > len(rec) {
+		return nil
+	}
+	return rec[start:]
+}
+
+// isoTime decodes the 7-byte recording date of a directory record.
+func isoTime(b []byte) time.Time {
+	if b[1] == 0 {
+		return time.Time{}
+	}
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+func (e *isoEntry) Name() string               { return e.name }
+func (e *isoEntry) Size() int64                { return e.size }
+func (e *isoEntry) Mode() fs.FileMode          { return e.mode }
+func (e *isoEntry) ModTime() time.Time         { return e.modTime }
+func (e *isoEntry) IsDir() bool                { return e.mode.IsDir() }
+func (e *isoEntry) Sys() any                   { return nil }
+func (e *isoEntry) Type() fs.FileMode          { return e.mode.Type() }
+func (e *isoEntry) Info() (fs.FileInfo, error) { return e, nil }
+
+// isoFile is an open file or directory of an isoImage.
+type isoFile struct {
+	iso    *isoImage
+	entry  *isoEntry
+	reader io.Reader
+	dirPos int
+}
+
+func (f *isoFile) Stat() (fs.FileInfo, error) {
+	return f.entry, nil
+}
+
+func (f *isoFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.entry.name, Err: fmt.Errorf("is a directory")}
+	}
+	return f.reader.Read(p)
+}
+
+func (f *isoFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.entry.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.entry.name, Err: fmt.Errorf("not a directory")}
+	}
+	children, err := f.iso.readDir(f.entry)
+	if err != nil {
+		return nil, err
+	}
+	rest := children[f.dirPos:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	f.dirPos += len(rest)
+	entries := make([]fs.DirEntry, len(rest))
+	for i, child := range rest {
+		entries[i] = child
+	}
+	return entries, nil
+}
+
+func (f *isoFile) Close() error {
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sectors of the test images
+const (
+	testISORoot         = 18
+	testISOData         = 19
+	testISOContinuation = 20
+	testISOSectors      = 21
+)
+
+// testISO builds a small image with one file, hello.txt, whose Rock Ridge
+// name is Hello.txt. rootSU is the System Use area of the root's "."
+// record, continuation the content of sector testISOContinuation, and
+// extra more records for the root directory.
+func testISO(rootSU, continuation []byte, extra ...[]byte) []byte {
+	img := make([]byte, testISOSectors*isoSectorSize)
+	when := time.Date(2024, 8, 27, 12, 0, 0, 0, time.UTC)
+
+	root := isoExtent{lba: testISORoot, length: isoSectorSize}
+	pvd := img[isoDescriptorStart*isoSectorSize:]
+	pvd[0] = isoDescPrimary
+	copy(pvd[1:6], "CD001")
+	pvd[6] = 1
+	copy(pvd[40:72], fmt.Sprintf("%-32s", "TEST"))
+	putBothEndian32(pvd[80:88], testISOSectors)
+	copy(pvd[156:190], isoRecord([]byte{0}, root, isoFlagDirectory, when, nil))
+
+	term := img[(isoDescriptorStart+1)*isoSectorSize:]
+	term[0] = isoDescTerminator
+	copy(term[1:6], "CD001")
+	term[6] = 1
+
+	data := []byte("hello\n")
+	nm := append([]byte{'N', 'M', byte(5 + len("Hello.txt")), 1, 0}, "Hello.txt"...)
+	records := [][]byte{
+		isoRecord([]byte{0}, root, isoFlagDirectory, when, rootSU),
+		isoRecord([]byte{1}, root, isoFlagDirectory, when, nil),
+		isoRecord([]byte("HELLO.TXT;1"), isoExtent{lba: testISOData, length: uint32(len(data))}, 0, when, nm),
+	}
+	copy(img[testISORoot*isoSectorSize:], packDirectory(append(records, extra...)))
+	copy(img[testISOData*isoSectorSize:], data)
+	copy(img[testISOContinuation*isoSectorSize:], continuation)
+	return img
+}
+
+func suspSP() []byte {
+	return []byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0}
+}
+
+func suspER(id string) []byte {
+	return append([]byte{'E', 'R', byte(8 + len(id)), 1, byte(len(id)), 0, 0, 1}, id...)
+}
+
+func suspCE(lba, offset, size uint32) []byte {
+	ce := make([]byte, 28)
+	copy(ce, "CE")
+	ce[2], ce[3] = 28, 1
+	putBothEndian32(ce[4:12], lba)
+	putBothEndian32(ce[12:20], offset)
+	putBothEndian32(ce[20:28], size)
+	return ce
+}
+
+func TestReadISORockRidgeDetection(t *testing.T) {
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	for _, tc := range []struct {
+		name         string
+		rootSU       []byte
+		continuation []byte
+		rockRidge    bool
+	}{
+		{"no SUSP", nil, nil, false},
+		{"SP only", suspSP(), nil, false},
+		{"SP and RRIP_1991A", join(suspSP(), suspER("RRIP_1991A")), nil, true},
+		{"SP and IEEE_P1282", join(suspSP(), suspER("IEEE_P1282")), nil, true},
+		{"SP and another extension", join(suspSP(), suspER("AAIP_0200")), nil, false},
+		{"ER in a continuation area", join(suspSP(), suspCE(testISOContinuation, 100, 18)),
+			append(make([]byte, 100), suspER("RRIP_1991A")...), true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			iso, err := readISO(bytes.NewReader(testISO(tc.rootSU, tc.continuation)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if iso.rockRidge != tc.rockRidge {
+				t.Errorf("rockRidge = %v, want %v", iso.rockRidge, tc.rockRidge)
+			}
+			want := "hello.txt"
+			if tc.rockRidge {
+				want = "Hello.txt"
+			}
+			data, err := fs.ReadFile(iso, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "hello\n" {
+				t.Errorf("%s = %q", want, data)
+			}
+		})
+	}
+}
+
+func TestReadISOBadContinuation(t *testing.T) {
+	for _, ce := range [][]byte{
+		suspCE(testISOContinuation, 2000, 100),     // crosses the sector
+		suspCE(testISOSectors+5, 0, 18),            // outside the volume
+		suspCE(testISOContinuation, 0, 0xFFFFFFFF), // huge
+	} {
+		img := testISO(append(suspSP(), ce...), nil)
+		if _, err := readISO(bytes.NewReader(img)); err == nil {
+			t.Errorf("readISO accepted CE entry %x", ce)
+		}
+	}
+
+	// A continuation area that points at itself
+	img := testISO(append(suspSP(), suspCE(testISOContinuation, 0, 28)...), suspCE(testISOContinuation, 0, 28))
+	if _, err := readISO(bytes.NewReader(img)); err == nil {
+		t.Errorf("readISO followed a continuation loop without error")
+	}
+}
+
+func TestReadISOOversizedDirectory(t *testing.T) {
+	// The root directory claims 4 GB
+	img := testISO(nil, nil)
+	pvd := img[isoDescriptorStart*isoSectorSize:]
+	putBothEndian32(pvd[156+10:156+18], 0xFFFFF000)
+	if _, err := readISO(bytes.NewReader(img)); err == nil {
+		t.Errorf("readISO accepted a root directory larger than the volume")
+	}
+
+	// So does a subdirectory
+	when := time.Date(2024, 8, 27, 12, 0, 0, 0, time.UTC)
+	big := isoRecord([]byte("BIG"), isoExtent{lba: testISOData, length: 0xFFFFF000}, isoFlagDirectory, when, nil)
+	iso, err := readISO(bytes.NewReader(testISO(nil, nil, big)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.ReadDir(iso, "big"); err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("reading an oversized directory: got %v, want an extent error", err)
+	}
+}
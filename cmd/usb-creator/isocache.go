@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Older point releases, once replaced by a newer one
+const oldReleasesURL = "https://old-releases.ubuntu.com/releases/"
+
+// isoStamp records that an ISO in DefaultDownloadDir passed verification.
+// It is stored as <iso>.verified and holds as long as the ISO keeps its size
+// and modification time.
+type isoStamp struct {
+	SHA256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`
+	Verified time.Time `json:"verified"`
+}
+
+func stampPath(isoName string) string {
+	return filepath.Join(DefaultDownloadDir, isoName+".verified")
+}
+
+func writeVerifiedStamp(isoPath, isoName, hash string) {
+	info, err := os.Stat(isoPath)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(isoStamp{SHA256: hash, Size: info.Size(), ModTime: info.ModTime(), Verified: time.Now()})
+	if err != nil {
+		return
+	}
+	os.WriteFile(stampPath(isoName), data, 0644)
+}
+
+// cachedISO is one ISO in DefaultDownloadDir.
+type cachedISO struct {
+	Name    string
+	Path    string
+	Size    int64
+	ModTime time.Time
+	Release string // .disk/info
+	Version string
+	Arch    string
+	Flavor  string
+}
+
+// Series is the release series, such as 24.04, that prune groups by.
+func (c *cachedISO) Series() string {
+	return seriesOf(c.Version)
+}
+
+// readStamp reads the verification stamp of isoName.
+func readStamp(isoName string) (*isoStamp, error) {
+	data, err := os.ReadFile(stampPath(isoName))
+	if err != nil {
+		return nil, err
+	}
+	var stamp isoStamp
+	if err := json.Unmarshal(data, &stamp); err != nil {
+		return nil, err
+	}
+	return &stamp, nil
+}
+
+// hasValidStamp reports whether the ISO at isoPath is isoName in
+// DefaultDownloadDir and passed verification as it is now.
+func hasValidStamp(isoPath, isoName string) bool {
+	if filepath.Clean(isoPath) != filepath.Join(DefaultDownloadDir, isoName) {
+		return false
+	}
+	info, err := os.Stat(isoPath)
+	if err != nil {
+		return false
+	}
+	stamp, err := readStamp(isoName)
+	return err == nil && stamp.Size == info.Size() && stamp.ModTime.Equal(info.ModTime())
+}
+
+// status describes whether the ISO passed verification as it is now.
+func (c *cachedISO) status() string {
+	stamp, err := readStamp(c.Name)
+	if err != nil {
+		return "not verified"
+	}
+	if stamp.Size != c.Size || !stamp.ModTime.Equal(c.ModTime) {
+		return "⚠️  changed since verified"
+	}
+	return "✓ verified " + stamp.Verified.Format("2006-01-02")
+}
+
+// scanISOCache lists the ISOs in DefaultDownloadDir, sorted by name.
+func scanISOCache() ([]*cachedISO, error) {
+	entries, err := os.ReadDir(DefaultDownloadDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var isos []*cachedISO
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.EqualFold(filepath.Ext(e.Name()), ".iso") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		c := &cachedISO{
+			Name:    e.Name(),
+			Path:    filepath.Join(DefaultDownloadDir, e.Name()),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		c.Release, c.Version, c.Arch, c.Flavor = describeISO(c.Path)
+		isos = append(isos, c)
+	}
+	return isos, nil
+}
+
+// describeISO reads the release line from the ISO's .disk/info and takes
+// version, architecture and flavor from it, or from the file name for
+// whatever it lacks.
+func describeISO(isoPath string) (release, version, arch, flavor string) {
+	if iso, err := openISO(isoPath); err == nil {
+		release = iso.ReleaseInfo()
+		iso.Close()
+	}
+	version, arch, flavor = parseReleaseInfo(release)
+	if m := isoNamePattern.FindStringSubmatch(filepath.Base(isoPath)); m != nil {
+		if version == "" {
+			version = m[1]
+		}
+		if arch == "" {
+			arch = m[3]
+		}
+		if flavor == "" {
+			flavor = m[2]
+		}
+	}
+	return release, version, arch, flavor
+}
+
+// parseReleaseInfo takes apart a .disk/info line such as
+// `Ubuntu-Server 24.04.1 LTS "Noble Numbat" - Release amd64 (20240827.1)`.
+func parseReleaseInfo(release string) (version, arch, flavor string) {
+	fields := strings.Fields(release)
+	if len(fields) < 2 {
+		return "", "", ""
+	}
+	switch fields[0] {
+	case "Ubuntu-Server":
+		flavor = "live-server"
+	case "Ubuntu":
+		flavor = "desktop"
+	}
+	if seriesOf(fields[1]) != "" {
+		version = fields[1]
+	}
+	for i := 1; i < len(fields); i++ {
+		if strings.HasPrefix(fields[i], "(") {
+			arch = fields[i-1]
+		}
+	}
+	return version, arch, flavor
+}
+
+// isoSourceURLs returns where an ISO with an official name, such as
+// ubuntu-24.04.1-live-server-amd64.iso, is published: its release folder
+// while it is the current point release, old-releases after that.
+func isoSourceURLs(isoName string) []string {
+	m := isoNamePattern.FindStringSubmatch(isoName)
+	if m == nil {
+		return nil
+	}
+	series := seriesOf(m[1])
+	return []string{releaseDirURL(series, m[3]) + isoName, oldReleasesURL + series + "/" + isoName}
+}
+
+// runISO implements the `usb-creator iso` commands, which manage the ISOs
+// in DefaultDownloadDir.
+func runISO(args []string) int {
+	usage := func() {
+		fmt.Println("Usage: usb-creator iso <command>")
+		fmt.Println()
+		fmt.Println("  list                 Show the cached ISOs and whether they are verified")
+		fmt.Println("  verify [iso...]      Check cached ISOs against their signed SHA256SUMS")
+		fmt.Println("  prune [--keep N]     Keep only the newest N ISOs of each series")
+		fmt.Println("  import <path>        Verify an ISO and copy it into " + DefaultDownloadDir + "/")
+	}
+	if len(args) == 0 {
+		usage()
+		return 1
+	}
+	switch args[0] {
+	case "list":
+		return runISOList()
+	case "verify":
+		return runISOVerify(args[1:])
+	case "prune":
+		return runISOPrune(args[1:])
+	case "import":
+		return runISOImport(args[1:])
+	}
+	usage()
+	return 1
+}
+
+func runISOList() int {
+	isos, err := scanISOCache()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if len(isos) == 0 {
+		fmt.Printf("No ISOs in %s/\n", DefaultDownloadDir)
+		return 0
+	}
+
+	var total int64
+	fmt.Printf("%-42s %-10s %-6s %9s  %s\n", "ISO", "VERSION", "ARCH", "SIZE", "STATUS")
+	for _, c := range isos {
+		fmt.Printf("%-42s %-10s %-6s %7.2fGB  %s\n", c.Name, c.Version, c.Arch, float64(c.Size)/(1024*1024*1024), c.status())
+		total += c.Size
+	}
+	if partials, _ := filepath.Glob(filepath.Join(DefaultDownloadDir, "*.iso.tmp")); len(partials) > 0 {
+		fmt.Printf("\n%d interrupted download(s), resumed when that ISO is downloaded again\n", len(partials))
+	}
+	fmt.Printf("\n%d ISO(s), %.2f GB\n", len(isos), float64(total)/(1024*1024*1024))
+	return 0
+}
+
+func runISOVerify(args []string) int {
+	isos, err := scanISOCache()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	if len(args) > 0 {
+		var selected []*cachedISO
+		for _, name := range args {
+			found := false
+			for _, c := range isos {
+				if c.Name == filepath.Base(name) {
+					selected, found = append(selected, c), true
+				}
+			}
+			if !found {
+				fmt.Printf("Error: %s is not in %s/\n", name, DefaultDownloadDir)
+				return 1
+			}
+		}
+		isos = selected
+	}
+
+	failed := 0
+	for _, c := range isos {
+		fmt.Printf("🔐 %s... ", c.Name)
+		// Checksums not stored yet, for ISOs cached by older versions
+		var err error
+		if _, statErr := os.Stat(checksumsPath(c.Name)); statErr != nil {
+			if urls := isoSourceURLs(c.Name); urls != nil {
+				err = fetchChecksums(c.Name, urls)
+			}
+		}
+		if err == nil {
+			err = verifyStoredISO(c.Path, c.Name)
+		}
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			failed++
+			continue
+		}
+		fmt.Println("✓")
+	}
+	if failed > 0 {
+		fmt.Printf("\n❌ %d of %d ISO(s) failed verification\n", failed, len(isos))
+		return 1
+	}
+	fmt.Printf("\n✅ %d ISO(s) verified\n", len(isos))
+	return 0
+}
+
+func runISOPrune(args []string) int {
+	flags := flag.NewFlagSet("iso prune", flag.ExitOnError)
+	keep := flags.Int("keep", 1, "Number of ISOs to keep per series, architecture and flavor")
+	dryRun := flags.Bool("dry-run", false, "Only show what would be deleted")
+	flags.Parse(args)
+	if *keep < 1 {
+		fmt.Println("Error: --keep must be at least 1")
+		return 1
+	}
+
+	isos, err := scanISOCache()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	groups := make(map[string][]*cachedISO)
+	for _, c := range isos {
+		if c.Version == "" {
+			continue // Unknown ISOs are left alone
+		}
+		key := c.Series() + " " + c.Arch + " " + c.Flavor
+		groups[key] = append(groups[key], c)
+	}
+
+	var freed int64
+	removed := 0
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		group := groups[key]
+		sort.Slice(group, func(i, j int) bool { return compareVersions(group[i].Version, group[j].Version) > 0 })
+		for _, c := range group[min(*keep, len(group)):] {
+			if *dryRun {
+				fmt.Printf("Would delete %s\n", c.Name)
+			} else {
+				if err := os.Remove(c.Path); err != nil {
+					fmt.Printf("❌ %v\n", err)
+					continue
+				}
+				sumsPath := checksumsPath(c.Name)
+				os.Remove(sumsPath)
+				os.Remove(sumsPath + ".gpg")
+				os.Remove(stampPath(c.Name))
+				fmt.Printf("🗑️  Deleted %s\n", c.Name)
+			}
+			freed += c.Size
+			removed++
+		}
+	}
+
+	verb := "Freed"
+	if *dryRun {
+		verb = "Would free"
+	}
+	fmt.Printf("\n%s %.2f GB from %d ISO(s)\n", verb, float64(freed)/(1024*1024*1024), removed)
+	return 0
+}
+
+func runISOImport(args []string) int {
+	if len(args) != 1 {
+		fmt.Println("Usage: usb-creator iso import <path to Ubuntu ISO>")
+		return 1
+	}
+	src := args[0]
+	if _, err := os.Stat(src); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	// A renamed ISO gets its official name back, so it can be verified
+	isoName := filepath.Base(src)
+	if !isoNamePattern.MatchString(isoName) {
+		release, version, arch, flavor := describeISO(src)
+		if version == "" || arch == "" || flavor == "" {
+			fmt.Printf("Error: cannot tell which Ubuntu release %s is (%q)\n", src, release)
+			return 1
+		}
+		isoName = fmt.Sprintf("ubuntu-%s-%s-%s.iso", version, flavor, arch)
+	}
+	destPath := filepath.Join(DefaultDownloadDir, isoName)
+	if _, err := os.Stat(destPath); err == nil {
+		fmt.Printf("%s is already in %s/; run `usb-creator iso verify %s` to check it\n", isoName, DefaultDownloadDir, isoName)
+		return 1
+	}
+
+	fmt.Printf("📂 Importing %s as %s\n", src, isoName)
+	if err := importISO(src, destPath, isoSourceURLs(isoName)); err != nil {
+		fmt.Printf("❌ Not importing %s: %v\n", src, err)
+		return 1
+	}
+	fmt.Printf("✅ Imported %s\n", destPath)
+	return 0
+}
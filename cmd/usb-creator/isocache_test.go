@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHasValidStamp(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	const isoName = "ubuntu-24.04.1-live-server-amd64.iso"
+	isoPath := filepath.Join(DefaultDownloadDir, isoName)
+	if err := os.MkdirAll(DefaultDownloadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(isoPath, []byte("iso"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if hasValidStamp(isoPath, isoName) {
+		t.Errorf("an ISO without a stamp counts as verified")
+	}
+
+	writeVerifiedStamp(isoPath, isoName, "00")
+	if !hasValidStamp(isoPath, isoName) {
+		t.Errorf("a freshly stamped ISO does not count as verified")
+	}
+	if hasValidStamp(isoPath, "ubuntu-24.04.2-live-server-amd64.iso") {
+		t.Errorf("the stamp of one ISO counts for another")
+	}
+
+	// Any change to the file voids the stamp
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(isoPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if hasValidStamp(isoPath, isoName) {
+		t.Errorf("an ISO modified after it was stamped counts as verified")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// First releases whose installer takes an autoinstall configuration:
+// subiquity on the server ISO, and the new desktop installer
+const (
+	minServerAutoinstallVersion  = "20.04"
+	minDesktopAutoinstallVersion = "23.04"
+)
+
+// isoIdentity is what an ISO, or a folder of extracted ISO contents, says
+// about itself.
+type isoIdentity struct {
+	VolumeID string // empty for a folder
+	Release  string // .disk/info
+	Version  string
+	Arch     string
+	Flavor   string // live-server or desktop
+}
+
+// FileName is the official name of the ISO, whatever it is called locally.
+func (id *isoIdentity) FileName() string {
+	return fmt.Sprintf("ubuntu-%s-%s-%s.iso", id.Version, id.Flavor, id.Arch)
+}
+
+// identifyISOFile opens the ISO, or folder of ISO contents, at isoPath and
+// identifies it with identifyISO.
+func identifyISOFile(isoPath string) (*isoIdentity, error) {
+	info, err := os.Stat(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return identifyISO(os.DirFS(isoPath))
+	}
+	iso, err := openISO(isoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer iso.Close()
+	id, err := identifyISO(iso)
+	if id != nil {
+		id.VolumeID = iso.VolumeID
+	}
+	return id, err
+}
+
+// identifyISO reads release, flavor and architecture from .disk/info and
+// checks the casper live system and boot menu the autoinstall configuration
+// hooks into. ISOs whose installer cannot be automated are refused; the
+// identity is returned along with the error where it is known.
+func identifyISO(fsys fs.FS) (*isoIdentity, error) {
+	data, err := fs.ReadFile(fsys, ".disk/info")
+	if err != nil {
+		return nil, fmt.Errorf("not an Ubuntu installer ISO: it has no .disk/info")
+	}
+	id := &isoIdentity{Release: strings.TrimSpace(string(data))}
+	id.Version, id.Arch, id.Flavor = parseReleaseInfo(id.Release)
+	if id.Version == "" || id.Arch == "" {
+		return id, fmt.Errorf("unrecognized release %q", id.Release)
+	}
+
+	switch id.Flavor {
+	case "live-server":
+		if compareVersions(id.Version, minServerAutoinstallVersion) < 0 {
+			return id, fmt.Errorf("Ubuntu Server %s predates autoinstall, which needs %s or later", id.Version, minServerAutoinstallVersion)
+		}
+	case "desktop":
+		if compareVersions(id.Version, minDesktopAutoinstallVersion) < 0 {
+			return id, fmt.Errorf("the Ubuntu Desktop %s installer does not support autoinstall; use the server ISO or Desktop %s or later",
+				id.Version, minDesktopAutoinstallVersion)
+		}
+	default:
+		name, _, _ := strings.Cut(id.Release, " ")
+		return id, fmt.Errorf("%s ISOs do not support autoinstall; use Ubuntu Server or Ubuntu Desktop", name)
+	}
+
+	if !fileExists(fsys, "casper/vmlinuz") && !fileExists(fsys, "casper/hwe-vmlinuz") {
+		return id, fmt.Errorf("no kernel in casper/; not a live installer ISO")
+	}
+	if !fileExists(fsys, "casper/initrd") && !fileExists(fsys, "casper/hwe-initrd") {
+		return id, fmt.Errorf("no initrd in casper/; not a live installer ISO")
+	}
+	if !fileExists(fsys, grubConfigPath) {
+		return id, fmt.Errorf("no %s to add the autoinstall boot options to", grubConfigPath)
+	}
+	return id, nil
+}
+
+// mismatches describes how the ISO differs from the release, architecture
+// and flavor picked for this run.
+func (id *isoIdentity) mismatches(picked ubuntuRelease, arch, flavor string) []string {
+	var warnings []string
+	if seriesOf(id.Version) != picked.Series {
+		warnings = append(warnings, fmt.Sprintf("This ISO is Ubuntu %s, but %s was selected", id.Version, picked))
+	}
+	if id.Arch != arch {
+		warnings = append(warnings, fmt.Sprintf("This ISO is for %s, not %s", id.Arch, arch))
+	}
+	if id.Flavor != flavor {
+		warnings = append(warnings, fmt.Sprintf("This is the %s ISO, not %s", id.Flavor, flavor))
+	}
+	return warnings
+}
+
+func fileExists(fsys fs.FS, name string) bool {
+	info, err := fs.Stat(fsys, name)
+	return err == nil && info.Mode().IsRegular()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+)
+
+// Fingerprints of the Ubuntu CD Image Automatic Signing Keys, which sign the
+// SHA256SUMS file of every release on releases.ubuntu.com. Only keys with one
+// of these fingerprints are ever trusted, wherever they were read from.
+var ubuntuSigningKeyFingerprints = []string{
+	"843938DF228D22F7B3742BC0D94AA3F0EFE21092", // 2012 key
+	"C5986B4F1257FFA86632CBA746181433FBB75451", // 2004 key
+}
+
+// ubuntuSigningKeys holds the armored signing keys, built into the binary so
+// verification never depends on a keyserver. See the file for how to
+// regenerate it.
+//
+//go:embed data/ubuntu-cdimage-keys.asc
+var ubuntuSigningKeys []byte
+
+// errChecksumMismatch is returned by verifyISO for an ISO whose hash differs
+// from the signed one.
+var errChecksumMismatch = errors.New("SHA-256 does not match the signed SHA256SUMS")
+
+// verifyISO checks the ISO at isoPath against the signed SHA256SUMS of the
+// release isoURLs belongs to, all of which are copies of the same ISO. The
+// checksum files are fetched once, from the first of them that lists it,
+// and stored in DefaultDownloadDir next to the downloaded ISO, so a cached
+// ISO can be re-verified offline.
+func verifyISO(isoPath string, isoURLs ...string) error {
+	isoName := path.Base(isoURLs[0])
+	if _, err := os.Stat(checksumsPath(isoName)); err != nil {
+		if err := fetchChecksums(isoName, isoURLs); err != nil {
+			return err
+		}
+	}
+	return verifyStoredISO(isoPath, isoName)
+}
+
+// checksumsPath is where the SHA256SUMS listing isoName is stored; its
+// signature is stored next to it with a .gpg suffix.
+func checksumsPath(isoName string) string {
+	return filepath.Join(DefaultDownloadDir, isoName+".SHA256SUMS")
+}
+
+// fetchChecksums stores SHA256SUMS and its signature from the release folder
+// of the first of isoURLs whose SHA256SUMS lists isoName. Point releases
+// replaced by a newer one are only listed in the SHA256SUMS of old-releases.
+func fetchChecksums(isoName string, isoURLs []string) error {
+	err := fmt.Errorf("%s is not listed in SHA256SUMS", isoName)
+	for _, u := range isoURLs {
+		releaseURL := u[:strings.LastIndex(u, "/")+1]
+		sums, fetchErr := httpGetBytes(releaseURL + "SHA256SUMS")
+		if fetchErr != nil {
+			err = fmt.Errorf("failed to get SHA256SUMS: %v", fetchErr)
+			continue
+		}
+		if _, ok := lookupChecksum(sums, isoName); !ok {
+			continue
+		}
+		sig, fetchErr := httpGetBytes(releaseURL + "SHA256SUMS.gpg")
+		if fetchErr != nil {
+			err = fmt.Errorf("failed to get SHA256SUMS.gpg: %v", fetchErr)
+			continue
+		}
+
+		sumsPath := checksumsPath(isoName)
+		if err := os.MkdirAll(filepath.Dir(sumsPath), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(sumsPath+".gpg", sig, 0644); err != nil {
+			return err
+		}
+		return os.WriteFile(sumsPath, sums, 0644)
+	}
+	return err
+}
+
+// verifyStoredISO checks the ISO at isoPath against the stored SHA256SUMS
+// for isoName, whose signature is checked on every use. An ISO in
+// DefaultDownloadDir that passes is stamped as verified.
+func verifyStoredISO(isoPath, isoName string) error {
+	sumsPath := checksumsPath(isoName)
+	sums, err := os.ReadFile(sumsPath)
+	if err != nil {
+		return fmt.Errorf("no stored SHA256SUMS for %s", isoName)
+	}
+	sig, err := os.ReadFile(sumsPath + ".gpg")
+	if err != nil {
+		return fmt.Errorf("no stored SHA256SUMS.gpg for %s", isoName)
+	}
+
+	keys, err := loadSigningKeys()
+	if err != nil {
+		return fmt.Errorf("failed to load the Ubuntu signing keys: %v", err)
+	}
+	if err := checkSignature(keys, sums, sig); err != nil {
+		// A corrupt or tampered download should not stay stored
+		os.Remove(sumsPath)
+		os.Remove(sumsPath + ".gpg")
+		return fmt.Errorf("SHA256SUMS signature is not valid: %v", err)
+	}
+
+	want, ok := lookupChecksum(sums, isoName)
+	if !ok {
+		return fmt.Errorf("%s is not listed in SHA256SUMS", isoName)
+	}
+	got, err := sha256Hash(isoPath)
+	if err != nil {
+		return err
+	}
+	cached := filepath.Clean(filepath.Dir(isoPath)) == filepath.Clean(DefaultDownloadDir)
+	if got != want {
+		if cached {
+			os.Remove(stampPath(isoName))
+		}
+		return errChecksumMismatch
+	}
+	if cached {
+		writeVerifiedStamp(isoPath, isoName, got)
+	}
+	return nil
+}
+
+// checkSignature verifies the detached signature sig, armored or binary, of
+// data.
+func checkSignature(keys openpgp.EntityList, data, sig []byte) error {
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN")) {
+		_, err = openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	} else {
+		_, err = openpgp.CheckDetachedSignature(keys, bytes.NewReader(data), bytes.NewReader(sig), nil)
+	}
+	return err
+}
+
+// lookupChecksum finds name in a SHA256SUMS file, whose lines are a hash,
+// a space, and the name prefixed with '*' for binary mode or ' ' for text.
+func lookupChecksum(sums []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		hash, file, ok := strings.Cut(strings.TrimRight(scanner.Text(), "\r"), " ")
+		if !ok || len(file) < 2 || file[1:] != name {
+			continue
+		}
+		if _, err := hex.DecodeString(hash); err == nil && len(hash) == 64 {
+			return strings.ToLower(hash), true
+		}
+	}
+	return "", false
+}
+
+// loadSigningKeys returns the Ubuntu CD image signing keys built into the
+// binary. Only keys with a pinned fingerprint are kept.
+func loadSigningKeys() (openpgp.EntityList, error) {
+	keys, err := readArmoredKeys(ubuntuSigningKeys)
+	if err != nil {
+		return nil, err
+	}
+	var trusted openpgp.EntityList
+	for _, key := range keys {
+		fp := strings.ToUpper(hex.EncodeToString(key.PrimaryKey.Fingerprint[:]))
+		for _, pinned := range ubuntuSigningKeyFingerprints {
+			if fp == pinned {
+				trusted = append(trusted, key)
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no key with a known fingerprint is built in; see data/ubuntu-cdimage-keys.asc")
+	}
+	return trusted, nil
+}
+
+// readArmoredKeys reads every armored public key block in data, which may
+// hold one block per key and comments around them.
+func readArmoredKeys(data []byte) (openpgp.EntityList, error) {
+	const endMarker = "-----END PGP PUBLIC KEY BLOCK-----"
+	var keys openpgp.EntityList
+	for {
+		start := bytes.Index(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----"))
+		if start < 0 {
+			return keys, nil
+		}
+		end := bytes.Index(data[start:], []byte(endMarker))
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated public key block")
+		}
+		end += start + len(endMarker)
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data[start:end]))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, entities...)
+		data = data[end:]
+	}
+}
+
+// httpGetBytes downloads a small file.
+func httpGetBytes(url string) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
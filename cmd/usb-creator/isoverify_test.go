@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// withSigningKey builds a throwaway key in place of the embedded Ubuntu keys
+// for the duration of a test, pinned if pin is set, and returns it.
+func withSigningKey(t *testing.T, pin bool) *openpgp.Entity {
+	t.Helper()
+	key, err := openpgp.NewEntity("Test CD Image Signing Key", "", "cdimage@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var armored bytes.Buffer
+	w, err := armor.Encode(&armored, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	keys, fingerprints := ubuntuSigningKeys, ubuntuSigningKeyFingerprints
+	t.Cleanup(func() { ubuntuSigningKeys, ubuntuSigningKeyFingerprints = keys, fingerprints })
+	ubuntuSigningKeys = append([]byte("Comment lines are ignored\n\n"), armored.Bytes()...)
+	if pin {
+		ubuntuSigningKeyFingerprints = []string{strings.ToUpper(hex.EncodeToString(key.PrimaryKey.Fingerprint))}
+	}
+	return key
+}
+
+func TestCheckSignature(t *testing.T) {
+	key := withSigningKey(t, true)
+	keys, err := loadSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sums := []byte("0123  *ubuntu-24.04.1-live-server-amd64.iso\n")
+	var binarySig, armoredSig bytes.Buffer
+	if err := openpgp.DetachSign(&binarySig, key, bytes.NewReader(sums), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := openpgp.ArmoredDetachSign(&armoredSig, key, bytes.NewReader(sums), nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, sig := range map[string][]byte{"binary": binarySig.Bytes(), "armored": armoredSig.Bytes()} {
+		if err := checkSignature(keys, sums, sig); err != nil {
+			t.Errorf("%s signature: %v", name, err)
+		}
+		if err := checkSignature(keys, append(sums, '\n'), sig); err == nil {
+			t.Errorf("%s signature of other data was accepted", name)
+		}
+	}
+}
+
+func TestLoadSigningKeysPinned(t *testing.T) {
+	withSigningKey(t, false)
+	if _, err := loadSigningKeys(); err == nil {
+		t.Errorf("a key without a pinned fingerprint was loaded")
+	}
+}
+
+// TestEmbeddedSigningKeys loads the keyring built into the binary, with no
+// key swapped in: without both keys no ISO can be verified.
+func TestEmbeddedSigningKeys(t *testing.T) {
+	keys, err := loadSigningKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]bool)
+	for _, key := range keys {
+		found[strings.ToUpper(hex.EncodeToString(key.PrimaryKey.Fingerprint))] = true
+	}
+	for _, fp := range ubuntuSigningKeyFingerprints {
+		if !found[fp] {
+			t.Errorf("key %s is missing from data/ubuntu-cdimage-keys.asc; export it as the file describes", fp)
+		}
+	}
+}
@@ -7,25 +7,17 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
-
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
-	// Ubuntu ISO URLs
-	Ubuntu2404URL = "https://releases.ubuntu.com/24.04/ubuntu-24.04.1-live-server-amd64.iso"
-	Ubuntu2204URL = "https://releases.ubuntu.com/22.04/ubuntu-22.04.5-live-server-amd64.iso"
-
 	// Default download directory
 	DefaultDownloadDir = "downloads"
 )
@@ -39,26 +31,15 @@ type DriveInfo struct {
 	SizeDisplay string
 	Model       string
 	Letters     string
+	Serial      string
 	IsRemovable bool
-}
-
-// Config holds the installation configuration
-type Config struct {
-	Username         string
-	Password         string
-	Hostname         string
-	Timezone         string
-	Locale           string
-	KeyboardLayout   string
-	InstallGUI       bool
-	SSHAuthorizedKey string
-	StaticIP         bool
-	IPAddress        string
-	Netmask          string
-	Gateway          string
-	DNSServers       string
-	ExtraPackages    string
-	AutoMountDrives  bool
+	// System describes what of the running system the drive holds, such as
+	// the / filesystem or a page file. Such drives are never erased.
+	System string
+	// Mounted lists the mount points of filesystems on the drive, directly
+	// or through LVM, dm-crypt or RAID. Such drives are erased only with
+	// --unmount.
+	Mounted string
 }
 
 func main() {
@@ -68,15 +49,69 @@ func main() {
 	fmt.Println("╚════════════════════════════════════════════════════════════╝")
 	fmt.Println()
 
-	if runtime.GOOS != "windows" {
-		fmt.Println("This tool is designed for Windows. Use the shell script version for Linux.")
+	if err := configureHTTP(); err != nil {
+		fmt.Printf("Error reading settings: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "watch":
+			os.Exit(runWatch(os.Args[2:]))
+		case "iso":
+			os.Exit(runISO(os.Args[2:]))
+		}
+	}
+
+	output := flag.String("output", "", "Write a bootable disk image to this file instead of a USB drive")
+	isoOutput := flag.String("iso-output", "", "Write a remastered autoinstall ISO to this file instead of a USB drive")
+	imageSize := flag.String("image-size", "", "Size of the disk image, e.g. 8G (default: just large enough for the ISO)")
+	espSize := flag.String("esp-size", defaultESPSize, "Size of the EFI system partition")
+	dataSize := flag.String("data-size", "", "Size of the data partition (default: rest of the drive)")
+	maxDriveSize := flag.String("max-drive-size", defaultMaxDriveSize, "Refuse to erase drives larger than this without --force")
+	force := flag.Bool("force", false, "Erase a drive even if it is larger than --max-drive-size")
+	unmount := flag.Bool("unmount", false, "Erase a drive even if it has mounted filesystems, unmounting them first")
+	catalogPath := flag.String("catalog", "", "Read the Ubuntu releases from this JSON file instead of releases.ubuntu.com")
+	arch := flag.String("arch", defaultArch, "Architecture of the Ubuntu ISO (amd64 or arm64)")
+	flavor := flag.String("flavor", defaultFlavor, "Flavor of the Ubuntu ISO (live-server or desktop)")
+	mirrors := flag.String("mirror", "", "Comma-separated ISO mirror base URLs to try besides ISO_MIRRORS")
+	isoDirs := flag.String("iso-dir", "", "Comma-separated folders to look for the ISO in before downloading, besides ISO_SEARCH_DIRS")
+	connections := flag.Int("connections", 1, "Download the ISO over this many connections at once, from sources that support it")
+	flag.Parse()
+
+	if *connections < 1 {
+		fmt.Println("Error: --connections must be at least 1")
+		os.Exit(1)
+	}
+	if *output != "" && *isoOutput != "" {
+		fmt.Println("Error: --output and --iso-output cannot be combined")
+		os.Exit(1)
+	}
+
+	sizes, err := parsePartitionSizes(*espSize, *dataSize)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	maxSize, err := parseSize(*maxDriveSize)
+	if err != nil {
+		fmt.Printf("Error: invalid --max-drive-size %q: %v\n", *maxDriveSize, err)
+		os.Exit(1)
+	}
+
+	// Disk images and ISOs need neither a supported platform nor admin rights
+	writesDrive := *output == "" && *isoOutput == ""
+	if writesDrive && runtime.GOOS != "windows" && runtime.GOOS != "linux" {
+		fmt.Println("This tool supports Windows and Linux only. Use --output to build a disk image.")
 		os.Exit(1)
 	}
 
 	// Check for admin privileges
-	if !isAdmin() {
+	if writesDrive && !isAdmin() {
 		fmt.Println("⚠️  This program requires Administrator privileges.")
-		fmt.Println("   Please run as Administrator.")
+		fmt.Println("   " + adminHint)
 		os.Exit(1)
 	}
 
@@ -84,35 +119,62 @@ func main() {
 	config, err := loadConfig()
 	if err != nil {
 		fmt.Printf("Error loading configuration: %v\n", err)
-		fmt.Println("Please ensure .env file exists (copy from .env.sample)")
 		os.Exit(1)
 	}
 
 	// Select Ubuntu version
+	catalog, err := loadCatalog(*catalogPath)
+	if err != nil {
+		fmt.Printf("Error loading release catalog: %v\n", err)
+		os.Exit(1)
+	}
+	releases := catalog.find(*arch, *flavor)
+	if len(releases) == 0 {
+		fmt.Printf("Error: no Ubuntu LTS release found for %s %s\n", *flavor, *arch)
+		os.Exit(1)
+	}
+
 	fmt.Println("\n📦 Select Ubuntu Version:")
-	fmt.Println("  1. Ubuntu 24.04 LTS (Noble Numbat) - Recommended")
-	fmt.Println("  2. Ubuntu 22.04 LTS (Jammy Jellyfish)")
+	for i, r := range releases {
+		if i == 0 {
+			fmt.Printf("  %d. %s - Recommended\n", i+1, r)
+		} else {
+			fmt.Printf("  %d. %s\n", i+1, r)
+		}
+	}
 	fmt.Println()
 
-	ubuntuChoice := promptChoice("Enter choice (1 or 2)", "1")
-
-	var isoURL string
-	var isoName string
-	switch ubuntuChoice {
-	case "2":
-		isoURL = Ubuntu2204URL
-		isoName = "ubuntu-22.04.5-live-server-amd64.iso"
-	default:
-		isoURL = Ubuntu2404URL
-		isoName = "ubuntu-24.04.1-live-server-amd64.iso"
+	release := releases[0]
+	ubuntuChoice := promptChoice(fmt.Sprintf("Enter choice (1-%d)", len(releases)), "1")
+	if n, err := strconv.Atoi(ubuntuChoice); err == nil && n >= 1 && n <= len(releases) {
+		release = releases[n-1]
 	}
+	isoURL := release.URL
+	isoName := release.FileName()
+	isoMirrors := append(splitList(*mirrors), config.ISOMirrors...)
+	isoSources := mirrorURLs(isoMirrors, isoURL)
 
-	// Check for existing ISO or download
+	// Check for existing ISO, then the local ISO folders, or download
 	isoPath := filepath.Join(DefaultDownloadDir, isoName)
+	verified := false
+	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
+		if local := findLocalISO(append(splitList(*isoDirs), config.ISOSearchDirs...), isoName); local != "" {
+			fmt.Printf("\n📂 Copying %s from %s\n", isoName, local)
+			if err := importISO(local, isoPath, isoSources); err != nil {
+				fmt.Printf("⚠️  Not using %s: %v\n", local, err)
+			} else {
+				verified = true
+			}
+		}
+	}
 	if _, err := os.Stat(isoPath); os.IsNotExist(err) {
-		fmt.Printf("\n📥 ISO not found. Download %s? (y/n): ", isoName)
+		if _, err := os.Stat(isoPath + ".tmp"); err == nil {
+			fmt.Printf("\n📥 ISO not found. Resume the interrupted download of %s? (y/n): ", isoName)
+		} else {
+			fmt.Printf("\n📥 ISO not found. Download %s? (y/n): ", isoName)
+		}
 		if promptYesNo("", true) {
-			if err := downloadISO(isoURL, isoPath); err != nil {
+			if err := downloadISO(rankMirrors(isoSources), isoPath, *connections); err != nil {
 				fmt.Printf("Error downloading ISO: %v\n", err)
 				os.Exit(1)
 			}
@@ -123,89 +185,150 @@ func main() {
 				fmt.Printf("ISO file not found: %s\n", isoPath)
 				os.Exit(1)
 			}
+			// Verify it as the release it says it is, which the checks
+			// below may warn differs from the one selected
+			id, err := identifyISOFile(isoPath)
+			if err != nil {
+				fmt.Printf("❌ Refusing to use %s: %v\n", isoPath, err)
+				os.Exit(1)
+			}
+			sources := isoSources
+			if name := id.FileName(); name != isoName {
+				urls := isoSourceURLs(name)
+				sources = append(mirrorURLs(isoMirrors, urls[0]), urls[1:]...)
+			}
+			fmt.Println("🔐 Verifying ISO checksum...")
+			if err := verifyISO(isoPath, sources...); err != nil {
+				fmt.Printf("❌ Refusing to use %s: %v\n", isoPath, err)
+				os.Exit(1)
+			}
+			fmt.Println("✓ ISO matches the signed Ubuntu checksum")
 		}
-	} else {
+	} else if !verified {
 		fmt.Printf("✓ Found existing ISO: %s\n", isoPath)
+		fmt.Println("🔐 Verifying ISO checksum...")
+		if err := verifyISO(isoPath, isoSources...); err != nil {
+			fmt.Printf("❌ Refusing to use %s: %v\n", isoPath, err)
+			if err == errChecksumMismatch {
+				fmt.Println("   Delete it and run again to download a fresh copy")
+			}
+			os.Exit(1)
+		}
+		fmt.Println("✓ ISO matches the signed Ubuntu checksum")
 	}
 
-	// List USB drives
-	fmt.Println("\n🔍 Scanning for USB drives...")
-	drives, err := listUSBDrives()
+	// Make sure the ISO is readable and can autoinstall before touching any
+	// drive
+	id, err := identifyISOFile(isoPath)
 	if err != nil {
-		fmt.Printf("Error listing drives: %v\n", err)
+		fmt.Printf("❌ Refusing to use %s: %v\n", isoPath, err)
 		os.Exit(1)
 	}
-
-	if len(drives) == 0 {
-		fmt.Println("❌ No USB drives found. Please insert a USB drive and try again.")
-		os.Exit(1)
+	if id.VolumeID != "" {
+		fmt.Printf("   Volume:  %s\n", id.VolumeID)
 	}
-
-	// Display drives
-	fmt.Println("\n💾 Available USB Drives:")
-	fmt.Println("   ────────────────────────────────────────────────────────────")
-	for _, d := range drives {
-		fmt.Printf("   [%d] %s - %s - %s (%s)\n", d.Number, d.Letters, d.Model, d.SizeDisplay, d.MediaType)
+	fmt.Printf("   Release: %s\n", id.Release)
+	for _, warning := range id.mismatches(release, *arch, *flavor) {
+		fmt.Printf("⚠️  %s\n", warning)
 	}
-	fmt.Println("   ────────────────────────────────────────────────────────────")
 
-	// Select drive
-	fmt.Print("\n⚠️  WARNING: All data on the selected drive will be ERASED!\n")
-	fmt.Print("Enter drive number to use: ")
-	driveNumStr := promptString("")
-	driveNum, err := strconv.Atoi(driveNumStr)
-	if err != nil {
-		fmt.Println("Invalid drive number")
-		os.Exit(1)
-	}
+	if *isoOutput != "" {
+		printConfigSummary(config)
+		fmt.Println("🔧 Creating autoinstall ISO...")
 
-	var selectedDrive *DriveInfo
-	for _, d := range drives {
-		if d.Number == driveNum {
-			selectedDrive = &d
-			break
+		if err := remasterAutoinstallISO(isoPath, *isoOutput, config); err != nil {
+			fmt.Printf("\n❌ Error creating ISO: %v\n", err)
+			os.Exit(1)
 		}
-	}
 
-	if selectedDrive == nil {
-		fmt.Println("Invalid drive selection")
-		os.Exit(1)
+		fmt.Printf("\n✅ Autoinstall ISO created successfully: %s\n", *isoOutput)
+		fmt.Println("\n📝 Next steps:")
+		fmt.Println("   1. Attach the ISO as virtual media (iDRAC, IPMI) or to a VM's CD drive")
+		fmt.Println("   2. Boot the target computer from it, with UEFI or legacy BIOS")
+		fmt.Println("   3. Installation will complete automatically")
+		fmt.Println()
+		return
+	}
+
+	var backends []DiskBackend
+	var selectedDrives []*DriveInfo
+	var guard *driveGuard // images need no protection
+	if *output != "" {
+		size, err := imageSizeFor(*imageSize, isoPath, sizes)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		image := newFileBackend(*output, size, sizes)
+		drives, _ := image.ListDrives()
+		backends = []DiskBackend{image}
+		selectedDrives = []*DriveInfo{&drives[0]}
+		fmt.Printf("\n💾 Writing disk image: %s (%s)\n", drives[0].DeviceID, drives[0].SizeDisplay)
+	} else {
+		backend, err := newPlatformBackend(sizes)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		guard = &driveGuard{MaxSize: maxSize, Force: *force, Unmount: *unmount}
+		selectedDrives = selectUSBDrives(backend, guard)
+
+		// Backends keep per-drive state, so every stick gets its own
+		backends = append(backends, backend)
+		for len(backends) < len(selectedDrives) {
+			backend, err := newPlatformBackend(sizes)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			backends = append(backends, backend)
+		}
 	}
 
-	// Confirm
-	fmt.Printf("\n⚠️  You are about to ERASE all data on:\n")
-	fmt.Printf("   Drive: %s\n", selectedDrive.Model)
-	fmt.Printf("   Size:  %s\n", selectedDrive.SizeDisplay)
-	fmt.Printf("   ID:    %s\n", selectedDrive.DeviceID)
-	fmt.Println()
-	fmt.Print("Type 'YES' to confirm: ")
-	confirmation := promptString("")
-	if confirmation != "YES" {
-		fmt.Println("Operation cancelled.")
-		os.Exit(0)
-	}
+	printConfigSummary(config)
 
-	// Show configuration summary
-	fmt.Println("\n📋 Installation Configuration:")
-	fmt.Printf("   Username:     %s\n", config.Username)
-	fmt.Printf("   Hostname:     %s\n", config.Hostname)
-	fmt.Printf("   Timezone:     %s\n", config.Timezone)
-	fmt.Printf("   Install GUI:  %v\n", config.InstallGUI)
-	fmt.Printf("   Static IP:    %v\n", config.StaticIP)
-	if config.StaticIP {
-		fmt.Printf("   IP Address:   %s\n", config.IPAddress)
+	// Create USB
+	if len(selectedDrives) > 1 {
+		fmt.Printf("🔧 Creating %d bootable USB drives...\n\n", len(selectedDrives))
+	} else {
+		fmt.Println("🔧 Creating bootable USB drive...")
+		fmt.Println()
 	}
-	fmt.Println()
 
-	// Create USB
-	fmt.Println("🔧 Creating bootable USB drive...")
+	errs := createBootableUSBs(backends, selectedDrives, isoPath, config, guard)
 
-	if err := createBootableUSB(selectedDrive, isoPath, config); err != nil {
-		fmt.Printf("\n❌ Error creating USB: %v\n", err)
+	if len(selectedDrives) > 1 {
+		printDriveSummary(selectedDrives, errs)
+	} else if errs[0] != nil {
+		fmt.Printf("\n❌ Error creating USB: %v\n", errs[0])
 		os.Exit(1)
 	}
 
-	fmt.Println("\n✅ USB drive created successfully!")
+	if *output != "" {
+		fmt.Printf("\n✅ Disk image created successfully: %s\n", *output)
+		fmt.Println("\n📝 Next steps:")
+		fmt.Println("   1. Flash the image to a USB drive with any raw imaging tool (dd, Rufus, balenaEtcher)")
+		fmt.Println("      or attach it to a VM as a disk and boot it with UEFI firmware")
+		fmt.Println("   2. Boot the target computer from it")
+		fmt.Println("   3. Installation will complete automatically")
+		fmt.Println()
+		return
+	}
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	switch {
+	case failed == len(errs):
+		os.Exit(1)
+	case len(errs) > 1:
+		fmt.Printf("\n✅ %d of %d USB drives created successfully!\n", len(errs)-failed, len(errs))
+	default:
+		fmt.Println("\n✅ USB drive created successfully!")
+	}
 	fmt.Println("\n📝 Next steps:")
 	fmt.Println("   1. Safely eject the USB drive")
 	fmt.Println("   2. Insert into target computer")
@@ -213,361 +336,150 @@ func main() {
 	fmt.Println("   4. Select the target drive when prompted")
 	fmt.Println("   5. Installation will complete automatically")
 	fmt.Println()
-}
-
-func isAdmin() bool {
-	_, err := os.Open("\\\\.\\PHYSICALDRIVE0")
-	return err == nil
-}
-
-func generateRandomHostname() string {
-	b := make([]byte, 3)
-	rand.Read(b)
-	return fmt.Sprintf("ubuntu-%x", b)
-}
-
-func loadConfig() (*Config, error) {
-	// Try to load .env file
-	envFile := ".env"
-	if _, err := os.Stat(envFile); os.IsNotExist(err) {
-		// Try parent directory
-		envFile = filepath.Join("..", "..", ".env")
-		if _, err := os.Stat(envFile); os.IsNotExist(err) {
-			return nil, fmt.Errorf(".env file not found. Please copy .env.sample to .env and configure it")
-		}
-	}
-
-	env, err := parseEnvFile(envFile)
-	if err != nil {
-		return nil, err
-	}
-
-	// Validate required fields
-	username := env["INSTALL_USERNAME"]
-	if username == "" {
-		return nil, fmt.Errorf("INSTALL_USERNAME is not set in .env file")
-	}
-
-	password := env["INSTALL_PASSWORD"]
-	if password == "" {
-		return nil, fmt.Errorf("INSTALL_PASSWORD is not set in .env file")
-	}
-
-	// Generate random hostname if set to "random" or empty
-	hostname := getEnvOrDefault(env, "INSTALL_HOSTNAME", "random")
-	if hostname == "random" || hostname == "" {
-		hostname = generateRandomHostname()
-	}
-
-	config := &Config{
-		Username:         username,
-		Password:         password,
-		Hostname:         hostname,
-		Timezone:         getEnvOrDefault(env, "TIMEZONE", "America/New_York"),
-		Locale:           getEnvOrDefault(env, "LOCALE", "en_US.UTF-8"),
-		KeyboardLayout:   getEnvOrDefault(env, "KEYBOARD_LAYOUT", "us"),
-		InstallGUI:       getEnvOrDefault(env, "INSTALL_GUI", "false") == "true",
-		SSHAuthorizedKey: getEnvOrDefault(env, "SSH_AUTHORIZED_KEYS", ""),
-		StaticIP:         getEnvOrDefault(env, "STATIC_IP", "false") == "true",
-		IPAddress:        getEnvOrDefault(env, "IP_ADDRESS", "192.168.1.100"),
-		Netmask:          getEnvOrDefault(env, "NETMASK", "255.255.255.0"),
-		Gateway:          getEnvOrDefault(env, "GATEWAY", "192.168.1.1"),
-		DNSServers:       getEnvOrDefault(env, "DNS_SERVERS", "8.8.8.8,8.8.4.4"),
-		ExtraPackages:    getEnvOrDefault(env, "EXTRA_PACKAGES", "htop,vim,curl,wget,git"),
-		AutoMountDrives:  getEnvOrDefault(env, "AUTO_MOUNT_DRIVES", "true") == "true",
+	if failed > 0 {
+		os.Exit(1)
 	}
-
-	return config, nil
 }
 
-func parseEnvFile(filename string) (map[string]string, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	env := make(map[string]string)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-			// Remove quotes if present
-			value = strings.Trim(value, "\"'")
-			env[key] = value
+// printDriveSummary lists the outcome for each drive of a multi-drive run.
+func printDriveSummary(drives []*DriveInfo, errs []error) {
+	fmt.Println("\n📋 Summary:")
+	for i, d := range drives {
+		if errs[i] != nil {
+			fmt.Printf("   ❌ [%d] %s - %s: %v\n", d.Number, d.Model, d.SizeDisplay, errs[i])
+		} else {
+			fmt.Printf("   ✅ [%d] %s - %s\n", d.Number, d.Model, d.SizeDisplay)
 		}
 	}
-	return env, scanner.Err()
 }
 
-func getEnvOrDefault(env map[string]string, key, defaultValue string) string {
-	if value, ok := env[key]; ok && value != "" {
-		return value
+// printConfigSummary shows the settings the installation will use.
+func printConfigSummary(config *Config) {
+	fmt.Println("\n📋 Installation Configuration:")
+	fmt.Printf("   Username:     %s\n", config.Username)
+	fmt.Printf("   Password:     %s\n", config.passwordSource)
+	fmt.Printf("   Hostname:     %s\n", config.Hostname)
+	fmt.Printf("   Timezone:     %s\n", config.Timezone)
+	fmt.Printf("   Install GUI:  %v\n", config.InstallGUI)
+	fmt.Printf("   Static IP:    %v\n", config.StaticIP)
+	if config.StaticIP {
+		fmt.Printf("   IP Address:   %s\n", config.IPAddress)
 	}
-	return defaultValue
+	fmt.Println()
 }
 
-func listUSBDrives() ([]DriveInfo, error) {
-	// Use PowerShell to get disk information with drive letters
-	cmd := exec.Command("powershell", "-Command", `
-		Get-Disk | Where-Object { $_.BusType -eq 'USB' -or ($_.Size -lt 256GB -and $_.BusType -ne 'NVMe' -and $_.OperationalStatus -eq 'Online') } |
-		ForEach-Object {
-			$disk = $_
-			$letters = (Get-Partition -DiskNumber $disk.Number -ErrorAction SilentlyContinue | Get-Volume -ErrorAction SilentlyContinue | Where-Object DriveLetter | ForEach-Object { $_.DriveLetter + ':' }) -join ','
-			if (-not $letters) { $letters = '(none)' }
-			$size = [math]::Round($disk.Size / 1GB, 2)
-			"$($disk.Number)|$($letters)|$($disk.FriendlyName)|$($size)GB|$($disk.BusType)"
-		}
-	`)
-
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to list drives: %v", err)
-	}
-
-	var drives []DriveInfo
-	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		parts := strings.Split(line, "|")
-		if len(parts) >= 5 {
-			num, _ := strconv.Atoi(parts[0])
-			drives = append(drives, DriveInfo{
-				Number:      num,
-				Letters:     parts[1],
-				Model:       parts[2],
-				SizeDisplay: parts[3],
-				MediaType:   parts[4],
-				DeviceID:    fmt.Sprintf("\\\\.\\PhysicalDrive%d", num),
-				IsRemovable: parts[4] == "USB",
-			})
+// selectUSBDrives lists the drives the backend can write to, lets the user
+// pick one or more that pass guard and makes them confirm the erase. It
+// exits on any failure.
+func selectUSBDrives(backend DiskBackend, guard *driveGuard) []*DriveInfo {
+	selected := chooseUSBDrives(backend, "\n⚠️  WARNING: All data on the selected drives will be ERASED!\n"+
+		"Enter drive number to use (several, e.g. 1,3,4, to make identical sticks): ")
+	for _, d := range selected {
+		if err := guard.check(d); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
 		}
 	}
 
-	return drives, nil
-}
-
-func downloadISO(url, destPath string) error {
-	// Create downloads directory
-	dir := filepath.Dir(destPath)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return err
-	}
-
-	fmt.Printf("Downloading from: %s\n", url)
-	fmt.Printf("Saving to: %s\n", destPath)
-
-	// Create the file
-	out, err := os.Create(destPath + ".tmp")
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	// Get the data
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
+	// Confirm
+	fmt.Printf("\n⚠️  You are about to ERASE all data on:\n")
+	for _, d := range selected {
+		fmt.Printf("   Drive: %s\n", d.Model)
+		fmt.Printf("   Size:  %s\n", d.SizeDisplay)
+		fmt.Printf("   ID:    %s\n", d.DeviceID)
+		fmt.Println()
 	}
-	defer resp.Body.Close()
-
-	// Get file size
-	size := resp.ContentLength
-	fmt.Printf("File size: %.2f GB\n", float64(size)/(1024*1024*1024))
-
-	// Create progress wrapper
-	counter := &writeCounter{Total: size}
-	_, err = io.Copy(out, io.TeeReader(resp.Body, counter))
-	if err != nil {
-		return err
+	fmt.Print("Type 'YES' to confirm: ")
+	confirmation := promptString("")
+	if confirmation != "YES" {
+		fmt.Println("Operation cancelled.")
+		os.Exit(0)
 	}
 
-	fmt.Println("\n✓ Download complete")
-
-	// Rename temp file
-	return os.Rename(destPath+".tmp", destPath)
-}
-
-type writeCounter struct {
-	Total      int64
-	Downloaded int64
+	return selected
 }
 
-func (wc *writeCounter) Write(p []byte) (int, error) {
-	n := len(p)
-	wc.Downloaded += int64(n)
-	percentage := float64(wc.Downloaded) / float64(wc.Total) * 100
-	fmt.Printf("\r   Progress: %.1f%% (%.2f GB / %.2f GB)",
-		percentage,
-		float64(wc.Downloaded)/(1024*1024*1024),
-		float64(wc.Total)/(1024*1024*1024))
-	return n, nil
-}
-
-func hashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
+// chooseUSBDrive lists the backend's drives and asks for one by number. It
+// exits on any failure.
+func chooseUSBDrive(backend DiskBackend, prompt string) *DriveInfo {
+	selected := chooseUSBDrives(backend, prompt)
+	if len(selected) != 1 {
+		fmt.Println("Please select a single drive")
+		os.Exit(1)
 	}
-	return string(hash), nil
+	return selected[0]
 }
 
-func createBootableUSB(drive *DriveInfo, isoPath string, config *Config) error {
-	fmt.Println("\n   Step 1/5: Cleaning disk...")
-	// Clean the disk
-	cleanScript := fmt.Sprintf(`
-		$disk = Get-Disk -Number %d
-		$disk | Clear-Disk -RemoveData -RemoveOEM -Confirm:$false -ErrorAction SilentlyContinue
-	`, drive.Number)
-	cmd := exec.Command("powershell", "-Command", cleanScript)
-	cmd.Run() // Ignore error as disk might already be clean
-
-	fmt.Println("   Step 2/5: Creating partitions...")
-	// Create partitions using diskpart
-	diskpartScript := fmt.Sprintf(`
-select disk %d
-clean
-convert gpt
-create partition efi size=512
-format quick fs=fat32 label="ESP"
-assign letter=S
-create partition primary
-format quick fs=ntfs label="Ubuntu"
-assign letter=U
-exit
-`, drive.Number)
-
-	// Write diskpart script to temp file
-	tmpFile, err := os.CreateTemp("", "diskpart*.txt")
+// chooseUSBDrives lists the backend's drives and asks for one or more by
+// number, separated by commas or spaces. It exits on any failure.
+func chooseUSBDrives(backend DiskBackend, prompt string) []*DriveInfo {
+	// List USB drives
+	fmt.Println("\n🔍 Scanning for USB drives...")
+	drives, err := backend.ListDrives()
 	if err != nil {
-		return err
+		fmt.Printf("Error listing drives: %v\n", err)
+		os.Exit(1)
 	}
-	defer os.Remove(tmpFile.Name())
 
-	if _, err := tmpFile.WriteString(diskpartScript); err != nil {
-		return err
+	if len(drives) == 0 {
+		fmt.Println("❌ No USB drives found. Please insert a USB drive and try again.")
+		os.Exit(1)
 	}
-	tmpFile.Close()
 
-	cmd = exec.Command("diskpart", "/s", tmpFile.Name())
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("diskpart failed: %v\nOutput: %s", err, output)
+	// Display drives
+	fmt.Println("\n💾 Available USB Drives:")
+	fmt.Println("   ────────────────────────────────────────────────────────────")
+	for _, d := range drives {
+		fmt.Printf("   [%d] %s - %s - %s (%s)\n", d.Number, d.Letters, d.Model, d.SizeDisplay, d.MediaType)
+		if d.System != "" {
+			fmt.Printf("       ⛔ holds %s; cannot be erased\n", d.System)
+		} else if d.Mounted != "" {
+			fmt.Printf("       ⚠️  in use, mounted at %s\n", d.Mounted)
+		}
 	}
+	fmt.Println("   ────────────────────────────────────────────────────────────")
 
-	fmt.Println("   Step 3/5: Extracting ISO contents...")
-	// Mount ISO and copy contents
-	mountScript := `
-		$iso = Mount-DiskImage -ImagePath "` + isoPath + `" -PassThru
-		$driveLetter = ($iso | Get-Volume).DriveLetter
-		Write-Output $driveLetter
-	`
-	cmd = exec.Command("powershell", "-Command", mountScript)
-	output, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to mount ISO: %v", err)
+	// Select drives
+	fmt.Print(prompt)
+	fields := strings.FieldsFunc(promptString(""), func(r rune) bool { return r == ',' || r == ' ' })
+	if len(fields) == 0 {
+		fmt.Println("Invalid drive number")
+		os.Exit(1)
 	}
-	isoDrive := strings.TrimSpace(string(output)) + ":"
-
-	// Copy ISO contents to USB
-	copyScript := fmt.Sprintf(`
-		$source = "%s\"
-		$destUSB = "U:\"
-		$destESP = "S:\"
 
-		# Copy all ISO contents to USB data partition
-		robocopy $source $destUSB /E /NFL /NDL /NJH /NJS
-
-		# Copy EFI boot files to ESP
-		if (Test-Path "$source\EFI") {
-			robocopy "$source\EFI" "$destESP\EFI" /E /NFL /NDL /NJH /NJS
+	var selected []*DriveInfo
+	seen := make(map[int]bool)
+	for _, field := range fields {
+		driveNum, err := strconv.Atoi(field)
+		if err != nil {
+			fmt.Println("Invalid drive number")
+			os.Exit(1)
 		}
-
-		# Copy boot folder to ESP
-		if (Test-Path "$source\boot") {
-			robocopy "$source\boot" "$destESP\boot" /E /NFL /NDL /NJH /NJS
+		if seen[driveNum] {
+			continue
 		}
-	`, isoDrive)
-
-	cmd = exec.Command("powershell", "-Command", copyScript)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		// Unmount ISO on error
-		exec.Command("powershell", "-Command", `Dismount-DiskImage -ImagePath "`+isoPath+`"`).Run()
-		return fmt.Errorf("failed to copy ISO contents: %v", err)
-	}
-
-	// Unmount ISO
-	exec.Command("powershell", "-Command", `Dismount-DiskImage -ImagePath "`+isoPath+`"`).Run()
+		seen[driveNum] = true
 
-	fmt.Println("   Step 4/5: Creating autoinstall configuration...")
-	// Create autoinstall directory structure
-	if err := os.MkdirAll("U:\\autoinstall", 0755); err != nil {
-		// Try alternative approach
-		exec.Command("cmd", "/c", "mkdir", "U:\\autoinstall").Run()
-	}
-
-	// Generate password hash
-	passwordHash, err := hashPassword(config.Password)
-	if err != nil {
-		return fmt.Errorf("failed to hash password: %v", err)
-	}
-
-	// Create user-data file
-	userData := generateUserData(config, passwordHash)
-	if err := os.WriteFile("U:\\autoinstall\\user-data", []byte(userData), 0644); err != nil {
-		return fmt.Errorf("failed to write user-data: %v", err)
-	}
-
-	// Create meta-data file
-	metaData := fmt.Sprintf("instance-id: ubuntu-autoinstall\nlocal-hostname: %s\n", config.Hostname)
-	if err := os.WriteFile("U:\\autoinstall\\meta-data", []byte(metaData), 0644); err != nil {
-		return fmt.Errorf("failed to write meta-data: %v", err)
-	}
-
-	fmt.Println("   Step 5/5: Copying installation scripts...")
-	// Copy scripts
-	scriptsDir := "U:\\scripts"
-	if err := os.MkdirAll(scriptsDir, 0755); err != nil {
-		exec.Command("cmd", "/c", "mkdir", scriptsDir).Run()
-	}
-
-	// Copy scripts from local scripts directory
-	scriptFiles := []string{"install-drivers.sh", "post-install.sh", "mount-drives.sh", "install-gui.sh"}
-	scriptsSrcDir := filepath.Join(filepath.Dir(os.Args[0]), "..", "..", "scripts")
-	if _, err := os.Stat(scriptsSrcDir); os.IsNotExist(err) {
-		scriptsSrcDir = "scripts"
-	}
-
-	for _, script := range scriptFiles {
-		srcPath := filepath.Join(scriptsSrcDir, script)
-		dstPath := filepath.Join(scriptsDir, script)
-		if _, err := os.Stat(srcPath); err == nil {
-			copyFile(srcPath, dstPath)
+		var selectedDrive *DriveInfo
+		for i := range drives {
+			if drives[i].Number == driveNum {
+				selectedDrive = &drives[i]
+				break
+			}
 		}
+		if selectedDrive == nil {
+			fmt.Println("Invalid drive selection")
+			os.Exit(1)
+		}
+		selected = append(selected, selectedDrive)
 	}
+	return selected
+}
 
-	// Create config.env for the scripts
-	configEnv := generateConfigEnv(config)
-	if err := os.WriteFile(filepath.Join(scriptsDir, "config.env"), []byte(configEnv), 0644); err != nil {
-		return fmt.Errorf("failed to write config.env: %v", err)
-	}
-
-	// Modify grub.cfg to enable autoinstall
-	fmt.Println("   Configuring boot loader...")
-	modifyGrubConfig("U:\\boot\\grub\\grub.cfg")
-	modifyGrubConfig("S:\\boot\\grub\\grub.cfg")
-
-	return nil
+func generateRandomHostname() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("ubuntu-%x", b)
 }
 
 func generateUserData(config *Config, passwordHash string) string {
@@ -582,6 +494,7 @@ func generateUserData(config *Config, passwordHash string) string {
         dhcp6: true`
 
 	if config.StaticIP {
+		prefix, _ := config.prefixLength()
 		networkSection = fmt.Sprintf(`  network:
     version: 2
     ethernets:
@@ -590,12 +503,12 @@ func generateUserData(config *Config, passwordHash string) string {
           driver: "*"
         dhcp4: false
         addresses:
-          - %s/24
+          - %s/%d
         routes:
           - to: default
             via: %s
         nameservers:
-          addresses: [%s]`, config.IPAddress, config.Gateway, config.DNSServers)
+          addresses: [%s]`, config.IPAddress, prefix, config.Gateway, config.DNSServers)
 	}
 
 	userData := fmt.Sprintf(`#cloud-config
@@ -697,71 +610,6 @@ autoinstall:
 	return userData
 }
 
-func generateConfigEnv(config *Config) string {
-	return fmt.Sprintf(`# Auto-generated configuration
-INSTALL_USERNAME=%s
-INSTALL_HOSTNAME=%s
-TIMEZONE=%s
-LOCALE=%s
-KEYBOARD_LAYOUT=%s
-INSTALL_GUI=%v
-SSH_AUTHORIZED_KEYS=%s
-STATIC_IP=%v
-IP_ADDRESS=%s
-NETMASK=%s
-GATEWAY=%s
-DNS_SERVERS=%s
-EXTRA_PACKAGES=%s
-AUTO_MOUNT_DRIVES=%v
-`,
-		config.Username,
-		config.Hostname,
-		config.Timezone,
-		config.Locale,
-		config.KeyboardLayout,
-		config.InstallGUI,
-		config.SSHAuthorizedKey,
-		config.StaticIP,
-		config.IPAddress,
-		config.Netmask,
-		config.Gateway,
-		config.DNSServers,
-		config.ExtraPackages,
-		config.AutoMountDrives,
-	)
-}
-
-func modifyGrubConfig(grubPath string) error {
-	content, err := os.ReadFile(grubPath)
-	if err != nil {
-		return nil // File might not exist
-	}
-
-	modified := string(content)
-
-	// Add autoinstall parameter to linux boot line
-	re := regexp.MustCompile(`(linux\s+[^\n]+)`)
-	modified = re.ReplaceAllStringFunc(modified, func(match string) string {
-		if !strings.Contains(match, "autoinstall") {
-			return match + " autoinstall ds=nocloud;s=/cdrom/autoinstall/"
-		}
-		return match
-	})
-
-	// Set timeout to 5 seconds for automatic boot
-	timeoutRe := regexp.MustCompile(`set timeout=\d+`)
-	if timeoutRe.MatchString(modified) {
-		modified = timeoutRe.ReplaceAllString(modified, "set timeout=5")
-	}
-
-	// Add timeout_style for countdown display
-	if !strings.Contains(modified, "timeout_style") {
-		modified = strings.Replace(modified, "set timeout=5", "set timeout=5\nset timeout_style=countdown", 1)
-	}
-
-	return os.WriteFile(grubPath, []byte(modified), 0644)
-}
-
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -817,10 +665,14 @@ func sha256Hash(filepath string) (string, error) {
 	}
 	defer f.Close()
 
+	return sha256Sum(f)
+}
+
+// sha256Sum returns the hex SHA-256 of everything read from r.
+func sha256Sum(r io.Reader) (string, error) {
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	if _, err := io.Copy(h, r); err != nil {
 		return "", err
 	}
-
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
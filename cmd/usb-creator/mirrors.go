@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Bytes read from every source to measure its speed
+	mirrorProbeSize = 4 << 20
+
+	// Time a source gets to answer and deliver the probe
+	mirrorProbeTimeout = 15 * time.Second
+)
+
+// mirrorURLs returns the URLs to download an ISO from: each mirror, which
+// has the same layout as releases.ubuntu.com or cdimage.ubuntu.com/releases,
+// followed by the official URL.
+func mirrorURLs(mirrors []string, officialURL string) []string {
+	rel := ""
+	for _, base := range []string{releasesURL, cdimageReleasesURL} {
+		if strings.HasPrefix(officialURL, base) {
+			rel = strings.TrimPrefix(officialURL, base)
+		}
+	}
+	var urls []string
+	if rel != "" {
+		for _, m := range mirrors {
+			urls = append(urls, strings.TrimRight(m, "/")+"/"+rel)
+		}
+	}
+	return append(urls, officialURL)
+}
+
+// mirrorProbe is the outcome of probing one download source.
+type mirrorProbe struct {
+	URL   string
+	Speed float64 // bytes per second
+	Err   error
+}
+
+// rankMirrors probes every source at once with a small ranged download and
+// orders them fastest first. Sources that failed the probe keep their order
+// behind the healthy ones, as a last resort.
+func rankMirrors(urls []string) []string {
+	if len(urls) < 2 {
+		return urls
+	}
+	fmt.Println("🌐 Checking download sources...")
+	probes := make([]mirrorProbe, len(urls))
+	var wg sync.WaitGroup
+	for i, url := range urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			probes[i] = probeMirror(url)
+		}(i, url)
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].Err == nil) != (probes[j].Err == nil) {
+			return probes[i].Err == nil
+		}
+		return probes[i].Speed > probes[j].Speed
+	})
+	ranked := make([]string, len(probes))
+	for i, p := range probes {
+		if p.Err != nil {
+			fmt.Printf("   ✗ %s: %v\n", p.URL, p.Err)
+		} else {
+			fmt.Printf("   ✓ %s: %.1f MB/s\n", p.URL, p.Speed/(1024*1024))
+		}
+		ranked[i] = p.URL
+	}
+	return ranked
+}
+
+// probeMirror downloads the start of url and measures how fast it came.
+func probeMirror(url string) mirrorProbe {
+	probe := mirrorProbe{URL: url}
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", mirrorProbeSize-1))
+
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		probe.Err = fmt.Errorf("server returned %s", resp.Status)
+		return probe
+	}
+	if err := checkISOContentType(resp.Header.Get("Content-Type")); err != nil {
+		probe.Err = err
+		return probe
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, mirrorProbeSize))
+	if err != nil {
+		probe.Err = err
+		return probe
+	}
+	probe.Speed = float64(n) / time.Since(start).Seconds()
+	return probe
+}
+
+// findLocalISO looks for an ISO named name in dirs, such as a mounted share
+// of ISOs, and returns its path or "".
+func findLocalISO(dirs []string, name string) string {
+	for _, dir := range dirs {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// importISO copies the ISO at src to destPath, and like a download it only
+// gets its final name once it matches the signed checksum from urls. The
+// copy is written to destPath.import, apart from the .tmp of an interrupted
+// download, which stays resumable. A copy that could not be verified, e.g.
+// for want of SHA256SUMS, is kept and verified again by the next import.
+func importISO(src, destPath string, urls []string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+
+	importPath := destPath + ".import"
+	if kept, err := os.Stat(importPath); err == nil && kept.Size() == info.Size() {
+		fmt.Println("   Using the copy kept from the last import")
+	} else if err := copyISO(in, importPath, info.Size()); err != nil {
+		os.Remove(importPath)
+		return err
+	}
+
+	fmt.Println("🔐 Verifying ISO checksum...")
+	if err := verifyISO(importPath, urls...); err != nil {
+		if err == errChecksumMismatch {
+			os.Remove(importPath)
+		}
+		return err
+	}
+	fmt.Println("✓ ISO matches the signed Ubuntu checksum")
+	if err := os.Rename(importPath, destPath); err != nil {
+		return err
+	}
+	// An interrupted download of the same ISO is no longer needed
+	tmpPath := destPath + ".tmp"
+	os.Remove(tmpPath)
+	os.Remove(validatorPath(tmpPath))
+	os.Remove(segmentStatePath(tmpPath))
+	return nil
+}
+
+// copyISO copies size bytes from in to path, showing progress.
+func copyISO(in io.Reader, path string, size int64) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	counter := &writeCounter{Total: size}
+	_, err = io.Copy(out, io.TeeReader(in, counter))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	fmt.Println()
+	return err
+}
+
+// splitList splits a comma-separated setting, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
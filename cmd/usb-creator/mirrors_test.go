@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportISO(t *testing.T) {
+	inTempDir(t)
+	key := withSigningKey(t, true)
+	data := isoTestData(200 << 10)
+	server := newISOServer(t, data)
+	src := filepath.Join(t.TempDir(), testISOName)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An interrupted segmented download of the same ISO
+	destPath := filepath.Join(DefaultDownloadDir, testISOName)
+	tmpPath := destPath + ".tmp"
+	partial := map[string]string{tmpPath: "partial", segmentStatePath(tmpPath): `{"Size":1}`}
+	if err := os.MkdirAll(DefaultDownloadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range partial {
+		if err := os.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without SHA256SUMS the import fails but leaves the download alone
+	if err := importISO(src, destPath, []string{server.url}); err == nil || err == errChecksumMismatch {
+		t.Fatalf("importISO without SHA256SUMS: got %v, want a fetch error", err)
+	}
+	for name, content := range partial {
+		if got, err := os.ReadFile(name); err != nil || string(got) != content {
+			t.Errorf("%s was changed by the import: %q, %v", name, got, err)
+		}
+	}
+	if _, err := os.Stat(destPath + ".import"); err != nil {
+		t.Errorf("the unverified copy was not kept: %v", err)
+	}
+
+	// A copy that does not match is removed
+	server.sign(t, key, strings.Repeat("0", 64))
+	if err := importISO(src, destPath, []string{server.url}); err != errChecksumMismatch {
+		t.Fatalf("importISO = %v, want %v", err, errChecksumMismatch)
+	}
+	if _, err := os.Stat(destPath + ".import"); !os.IsNotExist(err) {
+		t.Errorf("the mismatching copy was kept")
+	}
+
+	os.Remove(checksumsPath(testISOName))
+	server.sign(t, key, sha256Hex(data))
+	if err := importISO(src, destPath, []string{server.url}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(destPath); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("%s differs from the imported ISO: %v", destPath, err)
+	}
+	for name := range partial {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Errorf("%s is left after the ISO was imported", name)
+		}
+	}
+}
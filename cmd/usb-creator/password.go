@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"golang.org/x/term"
+)
+
+// The password of the installed system's user comes from the first of:
+//
+//   - INSTALL_PASSWORD, or its hash INSTALL_PASSWORD_HASH, in .env
+//   - INSTALL_PASSWORD_FILE, a file only its owner can read
+//   - INSTALL_PASSWORD_COMMAND, whose output is the password, e.g. that of
+//     a password manager
+//   - the INSTALL_PASSWORD environment variable
+//   - a prompt, when the tool runs in a terminal
+//
+// Only one may be set in .env.
+
+// passwordKeys lists the password sources set in .env.
+func (config *Config) passwordKeys() []string {
+	var keys []string
+	for _, source := range []struct{ key, value string }{
+		{"INSTALL_PASSWORD", config.Password},
+		{"INSTALL_PASSWORD_HASH", config.PasswordHash},
+		{"INSTALL_PASSWORD_FILE", config.PasswordFile},
+		{"INSTALL_PASSWORD_COMMAND", config.PasswordCommand},
+	} {
+		if source.value != "" {
+			keys = append(keys, source.key)
+		}
+	}
+	return keys
+}
+
+// validatePassword checks the password source and the hash settings.
+func (config *Config) validatePassword(report func(key, format string, args ...any)) {
+	switch keys := config.passwordKeys(); {
+	case len(keys) > 1:
+		report(keys[1], "is set as well as %s; set only one", keys[0])
+	case len(keys) == 0 && os.Getenv("INSTALL_PASSWORD") == "" && !term.IsTerminal(int(os.Stdin.Fd())):
+		report("INSTALL_PASSWORD", "is not set, nor is INSTALL_PASSWORD_HASH, INSTALL_PASSWORD_FILE or INSTALL_PASSWORD_COMMAND, and there is no terminal to ask for it on")
+	}
+	if config.PasswordHash != "" && !cryptHashPattern.MatchString(config.PasswordHash) {
+		report("INSTALL_PASSWORD_HASH", "is not a SHA-512 ($6$) or yescrypt ($y$) hash; create one with mkpasswd -m sha-512")
+	}
+	if config.PasswordFile != "" {
+		if err := checkPasswordFile(config.PasswordFile); err != nil {
+			report("INSTALL_PASSWORD_FILE", "%v", err)
+		}
+	}
+	if config.PasswordAlgorithm != "sha512" && config.PasswordAlgorithm != "yescrypt" {
+		report("PASSWORD_HASH_ALGORITHM", "expected sha512 or yescrypt, got %q", config.PasswordAlgorithm)
+	}
+	// yescrypt has a fixed cost; the rounds apply to sha512 only
+	if config.PasswordAlgorithm == "sha512" && (config.PasswordRounds < sha512CryptMinRounds || config.PasswordRounds > sha512CryptMaxRounds) {
+		report("PASSWORD_HASH_ROUNDS", "must be from %d to %d", sha512CryptMinRounds, sha512CryptMaxRounds)
+	}
+}
+
+// resolvePassword gets the password from its source and hashes it into
+// PasswordHash, recording the source. The plaintext is zeroed once hashed;
+// only a password written in .env stays in memory as read.
+func (config *Config) resolvePassword() error {
+	var password []byte
+	var err error
+	switch {
+	case config.PasswordHash != "":
+		config.passwordSource = "INSTALL_PASSWORD_HASH in .env"
+		return nil
+	case config.Password != "":
+		password, config.passwordSource = []byte(config.Password), "INSTALL_PASSWORD in .env"
+		config.Password = ""
+	case config.PasswordFile != "":
+		password, err = readPasswordFile(config.PasswordFile)
+		config.passwordSource = "file " + config.PasswordFile
+	case config.PasswordCommand != "":
+		password, err = runPasswordCommand(config.PasswordCommand)
+		config.passwordSource = "INSTALL_PASSWORD_COMMAND"
+	case os.Getenv("INSTALL_PASSWORD") != "":
+		password, config.passwordSource = []byte(os.Getenv("INSTALL_PASSWORD")), "INSTALL_PASSWORD environment variable"
+	default:
+		password, err = promptPassword()
+		config.passwordSource = "entered at the prompt"
+	}
+	if err != nil {
+		return err
+	}
+	defer clear(password)
+
+	if config.PasswordHash, err = hashPassword(password, config.PasswordAlgorithm, config.PasswordRounds); err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	return nil
+}
+
+// checkPasswordFile refuses a password file other users can read or change,
+// as ssh does for private keys. Windows has no such permission bits.
+func checkPasswordFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	if perm := info.Mode().Perm(); runtime.GOOS != "windows" && perm&0077 != 0 {
+		return fmt.Errorf("%s is accessible by other users (mode %04o); run chmod 600 %s", path, perm, path)
+	}
+	return nil
+}
+
+// readPasswordFile reads the password from the first line of path.
+func readPasswordFile(path string) ([]byte, error) {
+	if err := checkPasswordFile(path); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	password := firstLine(data)
+	if len(password) == 0 {
+		clear(data)
+		return nil, fmt.Errorf("%s is empty", path)
+	}
+	return password, nil
+}
+
+// runPasswordCommand runs command with the shell and takes the first line
+// of its output as the password. The command can prompt on the terminal,
+// e.g. to unlock a password manager.
+func runPasswordCommand(command string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		clear(output)
+		return nil, fmt.Errorf("INSTALL_PASSWORD_COMMAND failed: %v", err)
+	}
+	password := firstLine(output)
+	if len(password) == 0 {
+		clear(output)
+		return nil, errors.New("INSTALL_PASSWORD_COMMAND printed no password")
+	}
+	return password, nil
+}
+
+// firstLine returns data up to the first line break.
+func firstLine(data []byte) []byte {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		// The rest is not needed, and not left behind either
+		clear(data[i:])
+		return data[:i]
+	}
+	return data
+}
+
+// promptPassword asks for the password twice without echoing it.
+func promptPassword() ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("no password is set and there is no terminal to ask for it on")
+	}
+	fmt.Println("\n🔑 No password is set in .env.")
+	for attempt := 0; attempt < 3; attempt++ {
+		fmt.Print("   Password for the installed system: ")
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return nil, err
+		}
+		if len(password) == 0 {
+			fmt.Println("   The password cannot be empty")
+			continue
+		}
+		fmt.Print("   Repeat the password: ")
+		confirm, err := term.ReadPassword(fd)
+		fmt.Println()
+		match := bytes.Equal(password, confirm)
+		clear(confirm)
+		if err == nil && match {
+			return password, nil
+		}
+		clear(password)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("   The passwords do not match")
+	}
+	return nil, errors.New("no password was entered")
+}
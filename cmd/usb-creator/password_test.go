@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/term"
+)
+
+// writePasswordFile writes content to a file with mode perm.
+func writePasswordFile(t *testing.T, content string, perm os.FileMode) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile's mode is subject to the umask
+	if err := os.Chmod(path, perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// sha512CryptMatches reports whether hash, made with the default rounds, is
+// that of password.
+func sha512CryptMatches(hash, password string) bool {
+	fields := strings.Split(hash, "$")
+	return len(fields) == 4 && sha512Crypt([]byte(password), fields[2], sha512CryptDefaultRounds) == hash
+}
+
+func TestResolvePassword(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("INSTALL_PASSWORD_COMMAND uses printf")
+	}
+	t.Setenv("INSTALL_PASSWORD", "from-environment")
+	hash := sha512Crypt([]byte("from-hash"), "saltsalt", sha512CryptDefaultRounds)
+	file := writePasswordFile(t, "from-file\nsecond line\n", 0600)
+	command := `printf 'from-command\nsecond line\n'`
+
+	// Each source is set along with all those after it
+	for _, tc := range []struct {
+		hash, password, file, command string
+		want, source                  string
+	}{
+		{hash, "from-dotenv", file, command, "from-hash", "INSTALL_PASSWORD_HASH in .env"},
+		{"", "from-dotenv", file, command, "from-dotenv", "INSTALL_PASSWORD in .env"},
+		{"", "", file, command, "from-file", "file " + file},
+		{"", "", "", command, "from-command", "INSTALL_PASSWORD_COMMAND"},
+		{"", "", "", "", "from-environment", "INSTALL_PASSWORD environment variable"},
+	} {
+		config := testConfig(t)
+		config.PasswordHash, config.Password, config.PasswordFile, config.PasswordCommand = tc.hash, tc.password, tc.file, tc.command
+		if err := config.resolvePassword(); err != nil {
+			t.Fatalf("%s: %v", tc.source, err)
+		}
+		if config.passwordSource != tc.source {
+			t.Errorf("source = %q, want %q", config.passwordSource, tc.source)
+		}
+		if !sha512CryptMatches(config.PasswordHash, tc.want) {
+			t.Errorf("%s: %s is not the hash of %q", tc.source, config.PasswordHash, tc.want)
+		}
+		if tc.hash == "" && config.Password != "" {
+			t.Errorf("%s: INSTALL_PASSWORD is kept after hashing", tc.source)
+		}
+	}
+}
+
+func TestCheckPasswordFile(t *testing.T) {
+	if err := checkPasswordFile(writePasswordFile(t, "secret\n", 0600)); err != nil {
+		t.Errorf("mode 0600: %v", err)
+	}
+	if err := checkPasswordFile(writePasswordFile(t, "secret\n", 0400)); err != nil {
+		t.Errorf("mode 0400: %v", err)
+	}
+	dir := t.TempDir()
+	if err := checkPasswordFile(dir); err == nil || err.Error() != dir+" is a directory" {
+		t.Errorf("directory: got %v", err)
+	}
+	if err := checkPasswordFile(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	for _, perm := range []os.FileMode{0644, 0640, 0604, 0620} {
+		path := writePasswordFile(t, "secret\n", perm)
+		want := fmt.Sprintf("%s is accessible by other users (mode %04o); run chmod 600 %s", path, perm, path)
+		if err := checkPasswordFile(path); err == nil || err.Error() != want {
+			t.Errorf("mode %04o: got %v", perm, err)
+		}
+	}
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	for _, tc := range []struct {
+		content, want string
+	}{
+		{"secret", "secret"},
+		{"secret\n", "secret"},
+		{"secret\r\nsecond line\r\n", "secret"},
+		{"pass word \n", "pass word "},
+	} {
+		password, err := readPasswordFile(writePasswordFile(t, tc.content, 0600))
+		if err != nil || string(password) != tc.want {
+			t.Errorf("readPasswordFile(%q) = %q, %v, want %q", tc.content, password, err, tc.want)
+		}
+	}
+	for _, content := range []string{"", "\nsecret\n"} {
+		path := writePasswordFile(t, content, 0600)
+		if _, err := readPasswordFile(path); err == nil || err.Error() != path+" is empty" {
+			t.Errorf("readPasswordFile(%q): got %v, want %s is empty", content, err, path)
+		}
+	}
+}
+
+func TestRunPasswordCommand(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands use printf")
+	}
+	for _, tc := range []struct {
+		command, want string
+	}{
+		{`printf 'first'`, "first"},
+		{`printf 'first\nsecond\n'`, "first"},
+		{`printf 'first\r\nsecond'`, "first"},
+		{`printf ' spaced out \n'`, " spaced out "},
+	} {
+		password, err := runPasswordCommand(tc.command)
+		if err != nil || string(password) != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.command, password, err, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		command, want string
+	}{
+		{`printf ''`, "INSTALL_PASSWORD_COMMAND printed no password"},
+		{`printf '\nsecond\n'`, "INSTALL_PASSWORD_COMMAND printed no password"},
+		{`printf 'first\n'; exit 3`, "INSTALL_PASSWORD_COMMAND failed: exit status 3"},
+	} {
+		if password, err := runPasswordCommand(tc.command); err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got %q, %v, want error %q", tc.command, password, err, tc.want)
+		}
+	}
+}
+
+func TestValidatePassword(t *testing.T) {
+	file := writePasswordFile(t, "secret\n", 0600)
+	for _, tc := range []struct {
+		name string
+		edit func(c *Config)
+		want []configProblem
+	}{
+		{"hash", func(c *Config) {}, nil},
+		{"password and hash", func(c *Config) { c.Password = "secret" }, []configProblem{
+			{0, "INSTALL_PASSWORD_HASH", "is set as well as INSTALL_PASSWORD; set only one"}}},
+		{"file and command", func(c *Config) { c.PasswordHash, c.PasswordFile, c.PasswordCommand = "", file, "pass show lab" }, []configProblem{
+			{0, "INSTALL_PASSWORD_COMMAND", "is set as well as INSTALL_PASSWORD_FILE; set only one"}}},
+		{"all four", func(c *Config) { c.Password, c.PasswordFile, c.PasswordCommand = "secret", file, "pass show lab" }, []configProblem{
+			{0, "INSTALL_PASSWORD_HASH", "is set as well as INSTALL_PASSWORD; set only one"}}},
+		{"invalid hash", func(c *Config) { c.PasswordHash = "$1$saltsalt$qjXMvbEw8oaL.CzflDugX/" }, []configProblem{
+			{0, "INSTALL_PASSWORD_HASH", "is not a SHA-512 ($6$) or yescrypt ($y$) hash; create one with mkpasswd -m sha-512"}}},
+		{"unknown algorithm", func(c *Config) { c.PasswordAlgorithm = "md5" }, []configProblem{
+			{0, "PASSWORD_HASH_ALGORITHM", `expected sha512 or yescrypt, got "md5"`}}},
+		{"too few sha512 rounds", func(c *Config) { c.PasswordRounds = 999 }, []configProblem{
+			{0, "PASSWORD_HASH_ROUNDS", "must be from 1000 to 999999999"}}},
+		{"too many sha512 rounds", func(c *Config) { c.PasswordRounds = 1000000000 }, []configProblem{
+			{0, "PASSWORD_HASH_ROUNDS", "must be from 1000 to 999999999"}}},
+		{"rounds do not apply to yescrypt", func(c *Config) { c.PasswordAlgorithm, c.PasswordRounds = "yescrypt", 0 }, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig(t)
+			tc.edit(config)
+			if got := config.validate(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("problems =\n%+v\nwant\n%+v", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("no source", func(t *testing.T) {
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			t.Skip("the password would be asked for on the terminal")
+		}
+		t.Setenv("INSTALL_PASSWORD", "")
+		config := testConfig(t)
+		config.PasswordHash = ""
+		want := []configProblem{{0, "INSTALL_PASSWORD",
+			"is not set, nor is INSTALL_PASSWORD_HASH, INSTALL_PASSWORD_FILE or INSTALL_PASSWORD_COMMAND, and there is no terminal to ask for it on"}}
+		if got := config.validate(); !reflect.DeepEqual(got, want) {
+			t.Errorf("problems =\n%+v\nwant\n%+v", got, want)
+		}
+		t.Setenv("INSTALL_PASSWORD", "from-environment")
+		if got := config.validate(); got != nil {
+			t.Errorf("with INSTALL_PASSWORD in the environment: %+v", got)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// rawDisk fills both partitions of a disk or image through a single handle
+// with the FAT32 writer, so no backend has to mount or format anything. The
+// SHA-256 of every file is recorded as it is written and saved as a manifest
+// on each volume, for verifyDisk to check against.
+type rawDisk struct {
+	file      *os.File
+	layout    diskLayout
+	volumes   map[Volume]*fatFS
+	manifests map[Volume]manifest
+}
+
+// openRawDisk opens the disk or image at path and creates empty FAT32
+// filesystems for both partitions of layout. Nothing is written to the
+// volumes' metadata areas until finish.
+func openRawDisk(path string, layout diskLayout) (*rawDisk, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := &rawDisk{
+		file:      f,
+		layout:    layout,
+		volumes:   make(map[Volume]*fatFS),
+		manifests: make(map[Volume]manifest),
+	}
+
+	for _, vol := range []Volume{VolumeESP, VolumeData} {
+		start, sectors := layout.volumeExtent(vol)
+		region := &regionDevice{dev: f, offset: int64(start * sectorSize), size: int64(sectors * sectorSize)}
+		fsys, err := formatFAT32(region, sectors, start, strings.ToUpper(vol.String()))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %v", vol, err)
+		}
+		d.volumes[vol] = fsys
+		d.manifests[vol] = make(manifest)
+	}
+	return d, nil
+}
+
+// volumeExtent returns the first sector and sector count of a volume.
+func (l diskLayout) volumeExtent(vol Volume) (uint64, uint64) {
+	if vol == VolumeESP {
+		return l.ESPStart, l.ESPSectors
+	}
+	return l.DataStart, l.DataSectors
+}
+
+// copyTree copies the ISO contents to the data volume, and the EFI and
+// boot folders to the ESP as well, in a single pass over src.
+func (d *rawDisk) copyTree(src treeSource) error {
+	for {
+		item, err := src.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		top, _, _ := strings.Cut(item.Name, "/")
+		toESP := top == "EFI" || top == "boot"
+		if item.IsDir {
+			if _, err := d.volumes[VolumeData].MkdirAll(item.Name); err != nil {
+				return err
+			}
+			if toESP {
+				if _, err := d.volumes[VolumeESP].MkdirAll(item.Name); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if toESP {
+			// Boot loader files are small; read them once for both volumes
+			data, err := io.ReadAll(item.Data)
+			if err != nil {
+				return err
+			}
+			for _, vol := range []Volume{VolumeData, VolumeESP} {
+				if err := d.writeFile(vol, item.Name, data); err != nil {
+					return fmt.Errorf("%s: %v", vol, err)
+				}
+			}
+			continue
+		}
+
+		h := sha256.New()
+		if err := d.volumes[VolumeData].WriteFile(item.Name, io.TeeReader(item.Data, h), item.Size); err != nil {
+			return err
+		}
+		d.manifests[VolumeData].add(item.Name, hex.EncodeToString(h.Sum(nil)))
+	}
+}
+
+func (d *rawDisk) writeFile(vol Volume, name string, data []byte) error {
+	if err := d.volumes[vol].WriteFile(name, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	d.manifests[vol].add(name, hex.EncodeToString(sum[:]))
+	return nil
+}
+
+func (d *rawDisk) readFile(vol Volume, name string) ([]byte, error) {
+	return d.volumes[vol].ReadFile(name)
+}
+
+// finish saves the manifests, writes the directories, FATs and boot sectors
+// of both volumes and flushes the device.
+func (d *rawDisk) finish() error {
+	for _, vol := range []Volume{VolumeESP, VolumeData} {
+		sums := d.manifests[vol].bytes()
+		if err := d.volumes[vol].WriteFile(manifestName, bytes.NewReader(sums), int64(len(sums))); err != nil {
+			return fmt.Errorf("%s: %v", vol, err)
+		}
+		if err := d.volumes[vol].Close(); err != nil {
+			return fmt.Errorf("%s: %v", vol, err)
+		}
+	}
+	return d.file.Sync()
+}
+
+func (d *rawDisk) close() error {
+	return d.file.Close()
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// remasterNode is a file or directory of the rewritten tree. entry is nil
+// for entries the remaster adds.
+type remasterNode struct {
+	name     string
+	ident    []byte
+	isDir    bool
+	entry    *isoEntry
+	parent   *remasterNode
+	children []*remasterNode
+
+	// extent is the new location of a directory, or of a file whose
+	// content is replaced
+	extent  isoExtent
+	changed bool
+}
+
+// isoAppender writes sector-aligned data after the end of the image.
+type isoAppender struct {
+	f    *os.File
+	next uint32
+}
+
+func (a *isoAppender) write(data []byte) (isoExtent, error) {
+	ext := isoExtent{lba: a.next, length: uint32(len(data))}
+	sectors := (len(data) + isoSectorSize - 1) / isoSectorSize
+	padded := make([]byte, sectors*isoSectorSize)
+	copy(padded, data)
+	if _, err := a.f.WriteAt(padded, int64(a.next)*isoSectorSize); err != nil {
+		return ext, err
+	}
+	a.next += uint32(sectors)
+	return ext, nil
+}
+
+// remasterAutoinstallISO writes a copy of the Ubuntu ISO at isoPath to
+// outPath that carries the same autoinstall configuration, scripts and
+// boot menu changes createBootableUSB puts on a stick.
+func remasterAutoinstallISO(isoPath, outPath string, config *Config) error {
+	fmt.Println("\n   Step 1/3: Creating autoinstall configuration...")
+	files, err := autoinstallConfigFiles(config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("   Step 2/3: Adding installation scripts...")
+	scripts, err := scriptFiles(config)
+	if err != nil {
+		return err
+	}
+	files = append(files, scripts...)
+
+	fmt.Println("   Configuring boot loader...")
+	iso, err := openISO(isoPath)
+	if err != nil {
+		return err
+	}
+	content, err := fs.ReadFile(iso, grubConfigPath)
+	iso.Close()
+	if err == nil {
+		files = append(files, autoinstallFile{Name: grubConfigPath, Data: []byte(patchGrubConfig(string(content)))})
+	}
+
+	fmt.Println("   Step 3/3: Writing ISO...")
+	if err := remasterISO(isoPath, outPath, files); err != nil {
+		os.Remove(outPath)
+		return err
+	}
+	return nil
+}
+
+// remasterISO copies the ISO image at srcPath to dstPath with files added
+// or replaced. Everything in the original image stays where it is,
+// including the El Torito boot catalog and boot images, an appended EFI
+// partition image and the hybrid boot code in the system area, so the copy
+// boots the same way on UEFI and BIOS. The new file data, a rewritten
+// directory tree with new path tables for the primary and Joliet volumes,
+// are appended, and the volume descriptors are pointed at them.
+//
+// Partition tables in the system area keep describing the original image,
+// so the result is meant for virtual media and VMs; sticks are better made
+// by writing the drive directly.
+func remasterISO(srcPath, dstPath string, files []autoinstallFile) error {
+	iso, err := openISO(srcPath)
+	if err != nil {
+		return err
+	}
+	defer iso.Close()
+
+	info, err := iso.file.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// Copy the original image byte for byte
+	if _, err := io.Copy(out, io.NewSectionReader(iso.file, 0, info.Size())); err != nil {
+		return err
+	}
+	w := &isoAppender{f: out, next: uint32((info.Size() + isoSectorSize - 1) / isoSectorSize)}
+
+	// The new contents are written once; both trees point at them
+	extents := make(map[string]isoExtent)
+	for _, file := range files {
+		ext, err := w.write(file.Data)
+		if err != nil {
+			return err
+		}
+		extents[file.Name] = ext
+	}
+
+	type volume struct {
+		desc   []byte
+		lba    uint32
+		reader *isoImage
+	}
+	volumes := []volume{{
+		desc:   iso.primary,
+		lba:    iso.primaryLBA,
+		reader: &isoImage{r: iso.r, volumeSectors: iso.volumeSectors, rockRidge: iso.rockRidge, suspSkip: iso.suspSkip},
+	}}
+	if iso.jolietDesc != nil {
+		volumes = append(volumes, volume{
+			desc:   iso.jolietDesc,
+			lba:    iso.jolietLBA,
+			reader: &isoImage{r: iso.r, volumeSectors: iso.volumeSectors, joliet: true},
+		})
+	}
+
+	now := time.Now().UTC()
+	for i := range volumes {
+		vol := &volumes[i]
+		root, err := vol.reader.rootEntry(vol.desc)
+		if err != nil {
+			return err
+		}
+		tree, err := loadRemasterTree(vol.reader, root, nil)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := tree.add(vol.reader, file.Name, extents[file.Name]); err != nil {
+				return err
+			}
+		}
+
+		dirs := tree.directories()
+		// Directory sizes do not depend on where they go, so lay them out
+		// first and fill in the locations afterwards
+		next := w.next
+		for _, dir := range dirs {
+			size := len(packDirectory(dir.records(vol.reader, now)))
+			dir.extent = isoExtent{lba: next, length: uint32(size)}
+			next += uint32(size / isoSectorSize)
+		}
+		for _, dir := range dirs {
+			if _, err := w.write(packDirectory(dir.records(vol.reader, now))); err != nil {
+				return err
+			}
+		}
+
+		little, err := w.write(pathTable(dirs, false))
+		if err != nil {
+			return err
+		}
+		big, err := w.write(pathTable(dirs, true))
+		if err != nil {
+			return err
+		}
+
+		desc := append([]byte(nil), vol.desc...)
+		binary.LittleEndian.PutUint32(desc[132:136], little.length)
+		binary.BigEndian.PutUint32(desc[136:140], little.length)
+		binary.LittleEndian.PutUint32(desc[140:144], little.lba)
+		binary.LittleEndian.PutUint32(desc[144:148], 0)
+		binary.BigEndian.PutUint32(desc[148:152], big.lba)
+		binary.BigEndian.PutUint32(desc[152:156], 0)
+		setRecordExtent(desc[156:190], tree.extent)
+		vol.desc = desc
+	}
+
+	// Only now is the final size known
+	for _, vol := range volumes {
+		binary.LittleEndian.PutUint32(vol.desc[80:84], w.next)
+		binary.BigEndian.PutUint32(vol.desc[84:88], w.next)
+		if _, err := out.WriteAt(vol.desc, int64(vol.lba)*isoSectorSize); err != nil {
+			return err
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// loadRemasterTree reads a whole directory tree of the original image.
+func loadRemasterTree(reader *isoImage, entry *isoEntry, parent *remasterNode) (*remasterNode, error) {
+	node := &remasterNode{name: entry.name, isDir: entry.IsDir(), entry: entry, parent: parent}
+	if entry.records != nil {
+		rec := entry.records[0]
+		node.ident = rec[33 : 33+int(rec[32])]
+	}
+	if !node.isDir {
+		return node, nil
+	}
+	if entry.relocated {
+		return nil, fmt.Errorf("%s: relocated directories are not supported", entry.name)
+	}
+
+	children, err := reader.readDir(entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		childNode, err := loadRemasterTree(reader, child, node)
+		if err != nil {
+			return nil, err
+		}
+		node.children = append(node.children, childNode)
+	}
+	// Records are ordered by identifier, not by the names the reader shows
+	sort.SliceStable(node.children, func(a, b int) bool {
+		return bytes.Compare(node.children[a].ident, node.children[b].ident) < 0
+	})
+	return node, nil
+}
+
+// add creates or replaces the file at name, creating missing directories.
+func (n *remasterNode) add(reader *isoImage, name string, ext isoExtent) error {
+	dir := n
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		last := i == len(parts)-1
+		var child *remasterNode
+		for _, c := range dir.children {
+			if c.name == part {
+				child = c
+				break
+			}
+		}
+
+		switch {
+		case child == nil && len(part) > 180:
+			// The record, with its Rock Ridge entries, must fit in 255 bytes
+			return fmt.Errorf("%s: name is too long", part)
+		case child == nil:
+			child = &remasterNode{name: part, isDir: !last, parent: dir, changed: last, extent: ext}
+			child.ident = dir.newIdentifier(reader, part, !last)
+			dir.children = append(dir.children, child)
+			sort.SliceStable(dir.children, func(a, b int) bool {
+				return bytes.Compare(dir.children[a].ident, dir.children[b].ident) < 0
+			})
+		case last && child.isDir:
+			return fmt.Errorf("%s: is a directory", name)
+		case last:
+			child.changed = true
+			child.extent = ext
+		case !child.isDir:
+			return fmt.Errorf("%s: not a directory", path.Join(parts[:i+1]...))
+		}
+		dir = child
+	}
+	return nil
+}
+
+// directories returns every directory in breadth-first order, the order
+// path tables require.
+func (n *remasterNode) directories() []*remasterNode {
+	dirs := []*remasterNode{n}
+	for i := 0; i < len(dirs); i++ {
+		for _, child := range dirs[i].children {
+			if child.isDir {
+				dirs = append(dirs, child)
+			}
+		}
+	}
+	return dirs
+}
+
+// records returns the directory records of a directory: the original
+// records where they exist, with the locations of directories and replaced
+// files updated.
+func (n *remasterNode) records(reader *isoImage, now time.Time) [][]byte {
+	parent := n.parent
+	if parent == nil {
+		parent = n // the root's ".." refers to itself
+	}
+
+	var records [][]byte
+	for i, target := range []*remasterNode{n, parent} {
+		var rec []byte
+		if n.entry != nil && len(n.entry.dots) == 2 {
+			rec = append([]byte(nil), n.entry.dots[i]...)
+		} else {
+			rec = isoRecord([]byte{byte(i)}, isoExtent{}, isoFlagDirectory, now, reader.rockRidgeEntries("", true))
+		}
+		setRecordExtent(rec, target.extent)
+		records = append(records, rec)
+	}
+
+	for _, child := range n.children {
+		switch {
+		case child.entry == nil:
+			flags := byte(0)
+			if child.isDir {
+				flags = isoFlagDirectory
+			}
+			rec := isoRecord(child.ident, child.extent, flags, now, reader.rockRidgeEntries(child.name, child.isDir))
+			records = append(records, rec)
+		case child.isDir || child.changed:
+			rec := append([]byte(nil), child.entry.records[0]...)
+			rec[25] &^= isoFlagMultiExtent
+			setRecordExtent(rec, child.extent)
+			records = append(records, rec)
+		default:
+			records = append(records, child.entry.records...)
+		}
+	}
+	return records
+}
+
+// newIdentifier returns a file identifier for a new entry that no sibling
+// uses: the UCS-2 name on Joliet volumes, an 8.3 name otherwise.
+func (n *remasterNode) newIdentifier(reader *isoImage, name string, isDir bool) []byte {
+	if reader.joliet {
+		if !isDir {
+			name += ";1"
+		}
+		units := utf16.Encode([]rune(name))
+		ident := make([]byte, len(units)*2)
+		for i, u := range units {
+			binary.BigEndian.PutUint16(ident[i*2:], u)
+		}
+		return ident
+	}
+
+	taken := make(map[string]bool)
+	for _, child := range n.children {
+		taken[strings.SplitN(string(child.ident), ";", 2)[0]] = true
+	}
+
+	base, ext := strings.ToUpper(name), ""
+	if i := strings.LastIndex(base, "."); i > 0 && !isDir {
+		base, ext = base[:i], base[i+1:]
+	}
+	base = isoDChars(base, 8)
+	if ext != "" {
+		ext = isoDChars(ext, 3)
+	}
+	for i := 0; ; i++ {
+		candidate := base
+		if i > 0 {
+			suffix := strconv.Itoa(i)
+			if len(candidate)+len(suffix) > 8 {
+				candidate = candidate[:8-len(suffix)]
+			}
+			candidate += suffix
+		}
+		if !isDir {
+			candidate += "." + ext
+		}
+		if !taken[candidate] {
+			if !isDir {
+				candidate += ";1"
+			}
+			return []byte(candidate)
+		}
+	}
+}
+
+// isoDChars maps a name to ISO 9660 d-characters and truncates it.
+func isoDChars(s string, max int) string {
+	var b strings.Builder
+	for _, r := range s {
+		if b.Len() == max {
+			break
+		}
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// rockRidgeEntries returns the System Use area for a new record: a PX entry
+// with the file type and permissions and, except for "." and "..", an NM
+// entry with the full name. It is empty on volumes without Rock Ridge.
+func (iso *isoImage) rockRidgeEntries(name string, isDir bool) []byte {
+	if !iso.rockRidge {
+		return nil
+	}
+	su := make([]byte, iso.suspSkip)
+
+	mode := uint32(0100444)
+	links := uint32(1)
+	if isDir {
+		mode, links = 040555, 2
+	}
+	px := make([]byte, 36)
+	copy(px, "PX")
+	px[2], px[3] = 36, 1
+	putBothEndian32(px[4:12], mode)
+	putBothEndian32(px[12:20], links)
+	su = append(su, px...)
+
+	if name != "" {
+		nm := append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+		su = append(su, nm...)
+	}
+	return su
+}
+
+// isoRecord builds a directory record.
+func isoRecord(ident []byte, ext isoExtent, flags byte, when time.Time, su []byte) []byte {
+	n := 33 + len(ident)
+	if len(ident)%2 == 0 {
+		n++ // padding byte after even-length identifiers
+	}
+	n += len(su)
+	if n%2 != 0 {
+		n++
+	}
+
+	rec := make([]byte, n)
+	rec[0] = byte(n)
+	setRecordExtent(rec, ext)
+	rec[18] = byte(when.Year() - 1900)
+	rec[19] = byte(when.Month())
+	rec[20] = byte(when.Day())
+	rec[21] = byte(when.Hour())
+	rec[22] = byte(when.Minute())
+	rec[23] = byte(when.Second())
+	rec[25] = flags
+	binary.LittleEndian.PutUint16(rec[28:30], 1) // volume sequence number
+	binary.BigEndian.PutUint16(rec[30:32], 1)
+	rec[32] = byte(len(ident))
+	copy(rec[33:], ident)
+	start := 33 + len(ident)
+	if len(ident)%2 == 0 {
+		start++
+	}
+	copy(rec[start:], su)
+	return rec
+}
+
+// setRecordExtent stores the location and size of a record's data in both
+// byte orders.
+func setRecordExtent(rec []byte, ext isoExtent) {
+	putBothEndian32(rec[2:10], ext.lba)
+	putBothEndian32(rec[10:18], ext.length)
+}
+
+func putBothEndian32(b []byte, v uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], v)
+	binary.BigEndian.PutUint32(b[4:8], v)
+}
+
+// packDirectory lays records out in sectors; a record never crosses a
+// sector boundary.
+func packDirectory(records [][]byte) []byte {
+	var data []byte
+	for _, rec := range records {
+		if room := isoSectorSize - len(data)%isoSectorSize; len(rec) > room {
+			data = append(data, make([]byte, room)...)
+		}
+		data = append(data, rec...)
+	}
+	if rest := len(data) % isoSectorSize; rest != 0 {
+		data = append(data, make([]byte, isoSectorSize-rest)...)
+	}
+	return data
+}
+
+// pathTable builds the little- or big-endian path table of directories in
+// breadth-first order.
+func pathTable(dirs []*remasterNode, bigEndian bool) []byte {
+	order := binary.ByteOrder(binary.LittleEndian)
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	number := make(map[*remasterNode]uint16, len(dirs))
+	var table []byte
+	for i, dir := range dirs {
+		number[dir] = uint16(i + 1)
+		ident, parent := dir.ident, uint16(1)
+		if dir.parent == nil {
+			ident = []byte{0}
+		} else {
+			parent = number[dir.parent]
+		}
+
+		rec := make([]byte, 8+len(ident)+len(ident)%2)
+		rec[0] = byte(len(ident))
+		order.PutUint32(rec[2:6], dir.extent.lba)
+		order.PutUint16(rec[6:8], parent)
+		copy(rec[8:], ident)
+		table = append(table, rec...)
+	}
+	return table
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Size of the byte ranges a segmented download is split into
+	segmentSize = 16 << 20
+
+	// How often the progress line and the segment state are updated
+	segmentStateInterval = time.Second
+)
+
+// errRangesUnsupported means a server answers range requests with the whole
+// file, so it can only be downloaded over one connection.
+var errRangesUnsupported = errors.New("the server does not support range requests")
+
+// errFileChanged means the file on the server changed during a download.
+var errFileChanged = errors.New("the file on the server changed; starting over")
+
+// segmentState records how far each segment of a segmented download got. It
+// is stored as <iso>.tmp.segments next to the preallocated <iso>.tmp, so an
+// interrupted download resumes every segment where it stopped.
+type segmentState struct {
+	URL         string  `json:"url"`
+	Validator   string  `json:"validator"`
+	Size        int64   `json:"size"`
+	SegmentSize int64   `json:"segment_size"`
+	Done        []int64 `json:"done"` // bytes written from the start of each segment
+}
+
+func segmentStatePath(tmpPath string) string {
+	return tmpPath + ".segments"
+}
+
+func newSegmentState(size int64) *segmentState {
+	return &segmentState{Size: size, SegmentSize: segmentSize, Done: make([]int64, (size+segmentSize-1)/segmentSize)}
+}
+
+// segment returns the byte range [start, end) of segment i.
+func (s *segmentState) segment(i int) (start, end int64) {
+	start = int64(i) * s.SegmentSize
+	return start, min(start+s.SegmentSize, s.Size)
+}
+
+func (s *segmentState) downloaded() int64 {
+	var total int64
+	for _, done := range s.Done {
+		total += done
+	}
+	return total
+}
+
+// loadSegmentState returns the state of an interrupted download into tmpPath
+// of a file of size bytes. A .tmp left by a download over one connection
+// counts as done as far as it goes.
+func loadSegmentState(tmpPath string, size int64) *segmentState {
+	state := newSegmentState(size)
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return state
+	}
+	data, err := os.ReadFile(segmentStatePath(tmpPath))
+	if err == nil {
+		var saved segmentState
+		if json.Unmarshal(data, &saved) == nil && saved.Size == size && info.Size() == size && saved.SegmentSize > 0 &&
+			int64(len(saved.Done)) == (size+saved.SegmentSize-1)/saved.SegmentSize {
+			return &saved
+		}
+		// The .tmp was preallocated for another file, so none of it counts
+		return state
+	}
+
+	if info.Size() <= size {
+		for i := range state.Done {
+			start, end := state.segment(i)
+			state.Done[i] = min(max(info.Size()-start, 0), end-start)
+		}
+		if data, err := os.ReadFile(validatorPath(tmpPath)); err == nil {
+			state.URL, state.Validator, _ = strings.Cut(string(data), "\n")
+		}
+	}
+	return state
+}
+
+// abandonSegments turns an interrupted segmented download into one a single
+// connection can resume: the .tmp is cut after the segments done from the
+// start on.
+func abandonSegments(tmpPath string) {
+	data, err := os.ReadFile(segmentStatePath(tmpPath))
+	if err != nil {
+		return
+	}
+	var state segmentState
+	var prefix int64
+	if json.Unmarshal(data, &state) == nil && state.SegmentSize > 0 {
+		for i, done := range state.Done {
+			prefix += done
+			if start, end := state.segment(i); start+done < end {
+				break
+			}
+		}
+	}
+	os.Truncate(tmpPath, prefix)
+	os.Remove(segmentStatePath(tmpPath))
+}
+
+// segmentedDownload is one attempt at downloading url into tmpPath in
+// segments, several at once.
+type segmentedDownload struct {
+	url     string
+	tmpPath string
+	out     *os.File
+
+	mu    sync.Mutex // guards state.Done
+	state *segmentState
+
+	// Shared progress counter of all connections
+	downloaded atomic.Int64
+}
+
+// downloadSegmented downloads url into tmpPath over up to connections
+// connections at once, each fetching one segment after another with a range
+// request and writing it in place, and reports how many bytes it received.
+// Segments done by earlier attempts are skipped.
+func downloadSegmented(url, tmpPath string, connections int) (int64, error) {
+	size, validator, err := probeRanges(url)
+	if err != nil {
+		return 0, err
+	}
+	state := loadSegmentState(tmpPath, size)
+	if state.URL == url && state.Validator != "" && state.Validator != validator {
+		fmt.Println("   The file on the server changed; starting over")
+		state = newSegmentState(size)
+	}
+	// Without a validator, or when resuming from another mirror, the
+	// checksum still catches a file that changed in between
+	state.URL, state.Validator = url, validator
+
+	out, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	defer out.Close()
+	// Preallocate, so every segment can be written where it belongs
+	if err := out.Truncate(size); err != nil {
+		return 0, &permanentError{err}
+	}
+	os.Remove(validatorPath(tmpPath))
+
+	d := &segmentedDownload{url: url, tmpPath: tmpPath, out: out, state: state}
+	if err := d.saveState(); err != nil {
+		return 0, &permanentError{err}
+	}
+	d.downloaded.Store(state.downloaded())
+
+	pending := make(chan int, len(state.Done))
+	for i, done := range state.Done {
+		if start, end := state.segment(i); start+done < end {
+			pending <- i
+		}
+	}
+	close(pending)
+	connections = min(connections, len(pending))
+
+	fmt.Printf("File size: %.2f GB\n", float64(size)/(1024*1024*1024))
+	if resumed := d.downloaded.Load(); resumed > 0 {
+		fmt.Printf("   Resuming at %.2f GB\n", float64(resumed)/(1024*1024*1024))
+	}
+	if connections > 1 {
+		fmt.Printf("   Using %d connections\n", connections)
+	}
+
+	// The first connection to fail stops the others; the next attempt
+	// resumes every segment
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan error, connections)
+	var received atomic.Int64
+	for c := 0; c < connections; c++ {
+		go func() {
+			for i := range pending {
+				n, err := d.fetchSegment(ctx, i)
+				received.Add(n)
+				if err != nil {
+					// Reported before the others fail for being cancelled
+					results <- err
+					cancel()
+					return
+				}
+			}
+			results <- nil
+		}()
+	}
+
+	ticker := time.NewTicker(segmentStateInterval)
+	defer ticker.Stop()
+	var firstErr error
+	for running := connections; running > 0; {
+		select {
+		case err := <-results:
+			running--
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-ticker.C:
+			printProgress(d.downloaded.Load(), size)
+			d.saveState()
+		}
+	}
+	printProgress(d.downloaded.Load(), size)
+
+	if errors.Is(firstErr, errFileChanged) {
+		// Nothing downloaded so far can be trusted
+		out.Truncate(0)
+		os.Remove(segmentStatePath(tmpPath))
+		return received.Load(), firstErr
+	}
+	if err := d.saveState(); err != nil && firstErr == nil {
+		firstErr = &permanentError{err}
+	}
+	if firstErr != nil {
+		return received.Load(), firstErr
+	}
+	return received.Load(), out.Close()
+}
+
+// probeRanges asks url for its first byte to learn the size of the file,
+// its validator for If-Range, and whether the server supports ranges.
+func probeRanges(url string) (size int64, validator string, err error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, "", &permanentError{err}
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if err := checkISOContentType(resp.Header.Get("Content-Type")); err != nil {
+			return 0, "", &permanentError{err}
+		}
+		return 0, "", &permanentError{errRangesUnsupported}
+	default:
+		return 0, "", statusError(resp)
+	}
+	if err := checkISOContentType(resp.Header.Get("Content-Type")); err != nil {
+		return 0, "", &permanentError{err}
+	}
+	_, size, err = parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || size <= 0 {
+		// Segments need the size up front
+		return 0, "", &permanentError{errRangesUnsupported}
+	}
+	return size, responseValidator(resp.Header), nil
+}
+
+// fetchSegment downloads the rest of segment i and reports how many bytes it
+// received.
+func (d *segmentedDownload) fetchSegment(ctx context.Context, i int) (int64, error) {
+	start, end := d.state.segment(i)
+	d.mu.Lock()
+	offset := start + d.state.Done[i]
+	d.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end-1))
+	if d.state.Validator != "" {
+		req.Header.Set("If-Range", d.state.Validator)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if first, _, err := parseContentRange(resp.Header.Get("Content-Range")); err != nil || first != offset {
+			return 0, fmt.Errorf("server sent an unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// If-Range no longer matched
+		return 0, errFileChanged
+	default:
+		return 0, statusError(resp)
+	}
+
+	buf := make([]byte, 256<<10)
+	body := io.LimitReader(resp.Body, end-offset)
+	var received int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := d.out.WriteAt(buf[:n], offset); err != nil {
+				return received, &permanentError{err}
+			}
+			offset += int64(n)
+			received += int64(n)
+			d.mu.Lock()
+			d.state.Done[i] += int64(n)
+			d.mu.Unlock()
+			d.downloaded.Add(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return received, err
+		}
+	}
+	if offset < end {
+		return received, io.ErrUnexpectedEOF
+	}
+	return received, nil
+}
+
+// saveState replaces the segment state file. Segments only count data that
+// was written, so an interrupted run loses at most some progress.
+func (d *segmentedDownload) saveState() error {
+	d.mu.Lock()
+	data, err := json.Marshal(d.state)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	statePath := segmentStatePath(d.tmpPath)
+	if err := os.WriteFile(statePath+".new", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(statePath+".new", statePath)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// interruptSegmented runs a segmented download of server's ISO into tmpPath
+// that is cut off after cut bytes of every segment, and returns the state
+// it left.
+func interruptSegmented(t *testing.T, server *isoServer, tmpPath string, cut int64) *segmentState {
+	t.Helper()
+	server.cutAfter = cut
+	defer func() { server.cutAfter = 0 }()
+	if _, err := downloadSegmented(server.url, tmpPath, 3); err == nil {
+		t.Fatal("the interrupted download succeeded")
+	}
+	server.idle()
+	state := loadSegmentState(tmpPath, int64(len(server.data)))
+	if state.URL != server.url || state.Validator != server.etag() {
+		t.Fatalf("the state records %q and %q, want %q and %q", state.URL, state.Validator, server.url, server.etag())
+	}
+	if done := state.downloaded(); done == 0 || done >= int64(len(server.data)) {
+		t.Fatalf("the state records %d of %d bytes", done, len(server.data))
+	}
+	return state
+}
+
+func TestDownloadSegmentedResume(t *testing.T) {
+	// Three segments, the last of them short
+	data := isoTestData(2*segmentSize + 1<<20)
+	server := newISOServer(t, data)
+	tmpPath := filepath.Join(t.TempDir(), testISOName+".tmp")
+	state := interruptSegmented(t, server, tmpPath, 1<<20)
+
+	// The next run reloads the state and fetches only what is missing
+	before := server.served.Load()
+	if _, err := downloadSegmented(server.url, tmpPath, 3); err != nil {
+		t.Fatal(err)
+	}
+	if sent, want := server.served.Load()-before, int64(len(data))-state.downloaded()+1; sent != want {
+		t.Errorf("the resumed download fetched %d bytes, want the missing %d and the 1 of the probe", sent, want)
+	}
+	if header := server.lastRequest(); header.Get("If-Range") != server.etag() {
+		t.Errorf("segment resumed with If-Range %q, want %q", header.Get("If-Range"), server.etag())
+	}
+	if got, err := os.ReadFile(tmpPath); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the resumed download differs from the served ISO: %v", err)
+	}
+}
+
+func TestDownloadSegmentedFileChanged(t *testing.T) {
+	server := newISOServer(t, isoTestData(segmentSize+1<<20))
+	tmpPath := filepath.Join(t.TempDir(), testISOName+".tmp")
+	interruptSegmented(t, server, tmpPath, 256<<10)
+
+	// None of the old file may be kept
+	server.data = bytes.Repeat([]byte{0xa5}, len(server.data))
+	before := server.served.Load()
+	if _, err := downloadSegmented(server.url, tmpPath, 3); err != nil {
+		t.Fatal(err)
+	}
+	if sent := server.served.Load() - before; sent != int64(len(server.data))+1 {
+		t.Errorf("fetched %d bytes, want the whole %d and the 1 of the probe", sent, len(server.data))
+	}
+	if got, err := os.ReadFile(tmpPath); err != nil || !bytes.Equal(got, server.data) {
+		t.Errorf("the download differs from the served ISO: %v", err)
+	}
+}
+
+func TestDownloadFromRangesUnsupported(t *testing.T) {
+	data := isoTestData(segmentSize + 1<<20)
+	server := newISOServer(t, data)
+	tmpPath := filepath.Join(t.TempDir(), testISOName+".tmp")
+	interruptSegmented(t, server, tmpPath, 256<<10)
+
+	// A mirror without ranges is downloaded whole over one connection
+	server.noRanges = true
+	if err := downloadFrom(server.url, tmpPath, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(segmentStatePath(tmpPath)); !os.IsNotExist(err) {
+		t.Errorf("the segment state is left: %v", err)
+	}
+	if got, err := os.ReadFile(tmpPath); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the download differs from the served ISO: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Lists the locale, keyboard layout and time zone settings are checked
+// against, so the check does not depend on the machine the tool runs on.
+// The header of each list says how to regenerate it.
+//
+//go:embed data/locales.txt data/keyboard-layouts.txt data/timezones.txt
+var knownLists embed.FS
+
+var (
+	usernamePattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+	// RFC 1123 host name label, as create-usb.bat checks it
+	hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+	// language_TERRITORY, optional .codeset and @modifier
+	localePattern = regexp.MustCompile(`^([a-z]{2,3}_[A-Z]{2})(\.[A-Za-z0-9-]+)?(@[a-z]+)?$`)
+
+	rtcWakePattern = regexp.MustCompile(`^([01][0-9]|2[0-3]):[0-5][0-9]$`)
+)
+
+// reservedUsernames are the system users and groups of Ubuntu and of the
+// optional features, which the installer cannot create an account as.
+var reservedUsernames = map[string]bool{
+	"root": true, "daemon": true, "bin": true, "sys": true, "sync": true, "games": true, "man": true,
+	"lp": true, "mail": true, "news": true, "uucp": true, "proxy": true, "www-data": true, "backup": true,
+	"list": true, "irc": true, "gnats": true, "nobody": true, "nogroup": true, "_apt": true,
+	"systemd-network": true, "systemd-resolve": true, "systemd-timesync": true, "systemd-coredump": true,
+	"messagebus": true, "syslog": true, "sshd": true, "tss": true, "uuidd": true, "tcpdump": true,
+	"landscape": true, "pollinate": true, "fwupd-refresh": true, "usbmux": true, "dnsmasq": true,
+	"polkitd": true, "adm": true, "sudo": true, "users": true, "staff": true, "plugdev": true,
+	"netdev": true, "lxd": true, "docker": true, "ubuntu": true,
+}
+
+// validate checks every setting and returns all the problems found.
+func (config *Config) validate() []configProblem {
+	var problems []configProblem
+	report := func(key, format string, args ...any) {
+		problems = append(problems, configProblem{config.lines[key], key, fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case config.Username == "":
+		report("INSTALL_USERNAME", "is not set")
+	case !usernamePattern.MatchString(config.Username):
+		report("INSTALL_USERNAME", "%q is not a valid Linux user name (lowercase letters, digits, - and _, starting with a letter or _, at most 32 characters)", config.Username)
+	case reservedUsernames[config.Username]:
+		report("INSTALL_USERNAME", "%q is reserved for the system", config.Username)
+	}
+	config.validatePassword(report)
+	if config.Hostname != "random" && !hostnamePattern.MatchString(config.Hostname) {
+		report("INSTALL_HOSTNAME", "%q is not a valid host name (letters, digits and hyphens, at most 63 characters, no hyphen at either end)", config.Hostname)
+	}
+
+	if !knownName("data/timezones.txt", config.Timezone) {
+		report("TIMEZONE", "unknown time zone %q; use a name such as Europe/London", config.Timezone)
+	}
+	if err := checkLocale(config.Locale); err != nil {
+		report("LOCALE", "%v", err)
+	}
+	if !knownName("data/keyboard-layouts.txt", config.KeyboardLayout) {
+		report("KEYBOARD_LAYOUT", "unknown keyboard layout %q; use an XKB layout such as us, gb or de", config.KeyboardLayout)
+	}
+
+	if config.StaticIP {
+		config.validateStaticIP(report)
+	}
+
+	for i, line := range strings.Split(config.SSHAuthorizedKey, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err != nil {
+			report("SSH_AUTHORIZED_KEYS", "key %d is not an SSH public key: %v", i+1, err)
+		}
+	}
+
+	if config.WebhookURL != "" {
+		if u, err := url.Parse(config.WebhookURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			report("WEBHOOK_URL", "%q is not an http:// or https:// URL", config.WebhookURL)
+		}
+	}
+
+	for _, network := range []struct{ key, value string }{
+		{"LAN_CIDR", config.LANCIDR},
+		{"NFS_ALLOWED_NETWORK", config.NFSAllowedNetwork},
+	} {
+		if _, _, err := net.ParseCIDR(network.value); network.value != "" && err != nil {
+			report(network.key, "%q is not a network such as 192.168.1.0/24", network.value)
+		}
+	}
+	if config.RTCWakeTime != "" && !rtcWakePattern.MatchString(config.RTCWakeTime) {
+		report("RTC_WAKE_TIME", "%q is not a time such as 01:00", config.RTCWakeTime)
+	}
+	if config.SwapSizeGB < 1 {
+		report("SWAP_SIZE_GB", "must be at least 1")
+	}
+	if size, err := strconv.Atoi(config.ZramSizeGB); config.ZramSizeGB != "auto" && (err != nil || size < 1 || size > 32) {
+		report("ZRAM_SIZE_GB", "expected auto or a number from 1 to 32, got %q", config.ZramSizeGB)
+	}
+	return problems
+}
+
+// validateStaticIP checks the address, netmask, gateway and DNS servers of a
+// static network configuration.
+func (config *Config) validateStaticIP(report func(key, format string, args ...any)) {
+	ip := net.ParseIP(config.IPAddress).To4()
+	if ip == nil {
+		report("IP_ADDRESS", "%q is not an IPv4 address", config.IPAddress)
+	}
+	var mask net.IPMask
+	if prefix, err := config.prefixLength(); err != nil {
+		key := "NETMASK"
+		if _, prefixErr := parsePrefix(config.CIDRPrefix); config.CIDRPrefix != "" && prefixErr != nil {
+			key = "CIDR_PREFIX"
+		}
+		report(key, "%v", err)
+	} else {
+		mask = net.CIDRMask(prefix, 32)
+	}
+	if ip != nil && mask != nil {
+		ones, _ := mask.Size()
+		network := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		broadcast := make(net.IP, len(network.IP))
+		for i := range broadcast {
+			broadcast[i] = network.IP[i] | ^mask[i]
+		}
+		if ones <= 30 && (ip.Equal(network.IP) || ip.Equal(broadcast)) {
+			report("IP_ADDRESS", "%s is the network or broadcast address of %s", config.IPAddress, network)
+		}
+	}
+
+	gateway := net.ParseIP(config.Gateway).To4()
+	switch {
+	case gateway == nil:
+		report("GATEWAY", "%q is not an IPv4 address", config.Gateway)
+	case ip != nil && mask != nil && !ip.Mask(mask).Equal(gateway.Mask(mask)):
+		report("GATEWAY", "%s is outside the network %s of IP_ADDRESS", config.Gateway, &net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	case gateway.Equal(ip):
+		report("GATEWAY", "is the same as IP_ADDRESS")
+	}
+	servers := splitList(config.DNSServers)
+	if len(servers) == 0 {
+		report("DNS_SERVERS", "is not set")
+	}
+	for _, server := range servers {
+		if net.ParseIP(server) == nil {
+			report("DNS_SERVERS", "%q is not an IP address", server)
+		}
+	}
+}
+
+// prefixLength returns the prefix length of the static network, from
+// CIDR_PREFIX or NETMASK, 24 if neither is set. Both accept a prefix length
+// such as 23 or /23 as well as a netmask such as 255.255.254.0.
+func (config *Config) prefixLength() (int, error) {
+	if config.CIDRPrefix == "" && config.Netmask == "" {
+		return 24, nil
+	}
+	var prefix, netmaskPrefix int
+	var err error
+	if config.CIDRPrefix != "" {
+		if prefix, err = parsePrefix(config.CIDRPrefix); err != nil {
+			return 0, err
+		}
+	}
+	if config.Netmask != "" {
+		if netmaskPrefix, err = parsePrefix(config.Netmask); err != nil {
+			return 0, err
+		}
+		if config.CIDRPrefix != "" && netmaskPrefix != prefix {
+			return 0, fmt.Errorf("CIDR_PREFIX %s and NETMASK %s disagree; set only one", config.CIDRPrefix, config.Netmask)
+		}
+		prefix = netmaskPrefix
+	}
+	return prefix, nil
+}
+
+// parsePrefix converts a prefix length such as 23 or /23, or a netmask
+// such as 255.255.254.0, to a prefix length.
+func parsePrefix(value string) (int, error) {
+	if n, err := strconv.Atoi(strings.TrimPrefix(value, "/")); err == nil {
+		if n < 1 || n > 32 {
+			return 0, fmt.Errorf("prefix length %s is not between 1 and 32", value)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return 0, fmt.Errorf("%q is neither a prefix length such as 24 nor a netmask such as 255.255.255.0", value)
+	}
+	ones, bits := net.IPMask(ip).Size()
+	if bits == 0 || ones == 0 {
+		return 0, fmt.Errorf("%s is not a valid netmask", value)
+	}
+	return ones, nil
+}
+
+// checkLocale accepts a known locale, with a UTF-8 codeset if it has one,
+// as well as C.UTF-8.
+func checkLocale(locale string) error {
+	if locale == "C.UTF-8" || locale == "C.utf8" {
+		return nil
+	}
+	m := localePattern.FindStringSubmatch(locale)
+	if m == nil || !knownName("data/locales.txt", m[1]) {
+		return fmt.Errorf("unknown locale %q; use a name such as en_US.UTF-8", locale)
+	}
+	if codeset := strings.ToLower(m[2]); codeset != "" && codeset != ".utf-8" && codeset != ".utf8" {
+		return fmt.Errorf("locale %q is not UTF-8; use %s.UTF-8", locale, m[1])
+	}
+	return nil
+}
+
+// knownName reports whether name is a line of the embedded list.
+func knownName(list, name string) bool {
+	f, err := knownLists.Open(list)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if scanner.Text() == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testAuthorizedKey returns a new ed25519 key in authorized_keys format.
+func testAuthorizedKey(t *testing.T) string {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " admin@example.com"
+}
+
+func TestValidate(t *testing.T) {
+	key := testAuthorizedKey(t)
+	staticIP := func(c *Config) {
+		c.StaticIP = true
+		c.IPAddress, c.Gateway, c.DNSServers = "192.168.1.100", "192.168.1.1", "1.1.1.1, 9.9.9.9"
+	}
+	for _, tc := range []struct {
+		name string
+		edit func(c *Config)
+		want []configProblem
+	}{
+		{"defaults", func(c *Config) {}, nil},
+		{"static IP", staticIP, nil},
+
+		// Users
+		{"no username", func(c *Config) { c.Username = "" }, []configProblem{{0, "INSTALL_USERNAME", "is not set"}}},
+		{"username with capitals", func(c *Config) { c.Username = "Admin" }, []configProblem{{0, "INSTALL_USERNAME",
+			`"Admin" is not a valid Linux user name (lowercase letters, digits, - and _, starting with a letter or _, at most 32 characters)`}}},
+		{"username too long", func(c *Config) { c.Username = strings.Repeat("a", 33) }, []configProblem{{0, "INSTALL_USERNAME",
+			`"` + strings.Repeat("a", 33) + `" is not a valid Linux user name (lowercase letters, digits, - and _, starting with a letter or _, at most 32 characters)`}}},
+		{"username root", func(c *Config) { c.Username = "root" }, []configProblem{{0, "INSTALL_USERNAME", `"root" is reserved for the system`}}},
+		{"username docker", func(c *Config) { c.Username = "docker" }, []configProblem{{0, "INSTALL_USERNAME", `"docker" is reserved for the system`}}},
+		{"username with - and _", func(c *Config) { c.Username = "_lab-admin2" }, nil},
+
+		// RFC 1123 host names
+		{"random hostname", func(c *Config) { c.Hostname = "random" }, nil},
+		{"hostname with digits and hyphens", func(c *Config) { c.Hostname = "web-01" }, nil},
+		{"hostname of 63 characters", func(c *Config) { c.Hostname = strings.Repeat("h", 63) }, nil},
+		{"hostname starting with -", func(c *Config) { c.Hostname = "-web" }, []configProblem{{0, "INSTALL_HOSTNAME",
+			`"-web" is not a valid host name (letters, digits and hyphens, at most 63 characters, no hyphen at either end)`}}},
+		{"hostname with _", func(c *Config) { c.Hostname = "web_01" }, []configProblem{{0, "INSTALL_HOSTNAME",
+			`"web_01" is not a valid host name (letters, digits and hyphens, at most 63 characters, no hyphen at either end)`}}},
+		{"hostname of 64 characters", func(c *Config) { c.Hostname = strings.Repeat("h", 64) }, []configProblem{{0, "INSTALL_HOSTNAME",
+			`"` + strings.Repeat("h", 64) + `" is not a valid host name (letters, digits and hyphens, at most 63 characters, no hyphen at either end)`}}},
+
+		// The embedded lists
+		{"time zone", func(c *Config) { c.Timezone = "Europe/London" }, nil},
+		{"time zone link", func(c *Config) { c.Timezone = "UTC" }, nil},
+		{"unknown time zone", func(c *Config) { c.Timezone = "Mars/Olympus" }, []configProblem{{0, "TIMEZONE",
+			`unknown time zone "Mars/Olympus"; use a name such as Europe/London`}}},
+		{"locale utf8", func(c *Config) { c.Locale = "de_DE.utf8" }, nil},
+		{"locale with modifier", func(c *Config) { c.Locale = "sr_RS.UTF-8@latin" }, nil},
+		{"C.UTF-8", func(c *Config) { c.Locale = "C.UTF-8" }, nil},
+		{"unknown locale", func(c *Config) { c.Locale = "xx_YY.UTF-8" }, []configProblem{{0, "LOCALE",
+			`unknown locale "xx_YY.UTF-8"; use a name such as en_US.UTF-8`}}},
+		{"locale not UTF-8", func(c *Config) { c.Locale = "de_DE.ISO-8859-1" }, []configProblem{{0, "LOCALE",
+			`locale "de_DE.ISO-8859-1" is not UTF-8; use de_DE.UTF-8`}}},
+		{"keyboard layout", func(c *Config) { c.KeyboardLayout = "gb" }, nil},
+		{"unknown keyboard layout", func(c *Config) { c.KeyboardLayout = "qwerty" }, []configProblem{{0, "KEYBOARD_LAYOUT",
+			`unknown keyboard layout "qwerty"; use an XKB layout such as us, gb or de`}}},
+
+		// Static networks
+		{"invalid IP address", func(c *Config) { staticIP(c); c.IPAddress = "192.168.1.300" }, []configProblem{
+			{0, "IP_ADDRESS", `"192.168.1.300" is not an IPv4 address`}}},
+		{"gateway outside the subnet", func(c *Config) { staticIP(c); c.Gateway = "192.168.2.1" }, []configProblem{
+			{0, "GATEWAY", "192.168.2.1 is outside the network 192.168.1.0/24 of IP_ADDRESS"}}},
+		{"gateway inside a /23", func(c *Config) { staticIP(c); c.Gateway = "192.168.0.1"; c.CIDRPrefix = "23" }, nil},
+		{"gateway is the address", func(c *Config) { staticIP(c); c.Gateway = c.IPAddress }, []configProblem{
+			{0, "GATEWAY", "is the same as IP_ADDRESS"}}},
+		{"network address", func(c *Config) { staticIP(c); c.IPAddress = "192.168.1.0" }, []configProblem{
+			{0, "IP_ADDRESS", "192.168.1.0 is the network or broadcast address of 192.168.1.0/24"}}},
+		{"broadcast address", func(c *Config) { staticIP(c); c.IPAddress = "192.168.1.255" }, []configProblem{
+			{0, "IP_ADDRESS", "192.168.1.255 is the network or broadcast address of 192.168.1.0/24"}}},
+		{"both addresses of a /31", func(c *Config) {
+			staticIP(c)
+			c.IPAddress, c.Gateway, c.CIDRPrefix = "10.0.0.0", "10.0.0.1", "31"
+		}, nil},
+		{"no DNS servers", func(c *Config) { staticIP(c); c.DNSServers = " , " }, []configProblem{{0, "DNS_SERVERS", "is not set"}}},
+		{"invalid DNS server", func(c *Config) { staticIP(c); c.DNSServers = "1.1.1.1,dns.example.com" }, []configProblem{
+			{0, "DNS_SERVERS", `"dns.example.com" is not an IP address`}}},
+		{"DHCP ignores the static settings", func(c *Config) { c.IPAddress, c.Gateway = "bad", "bad" }, nil},
+
+		// SSH keys, one per line
+		{"SSH keys", func(c *Config) { c.SSHAuthorizedKey = key + "\n\n# old key\n  " + key + "  " }, nil},
+		{"invalid SSH key", func(c *Config) { c.SSHAuthorizedKey = key + "\n# comment\nssh-rsa notbase64 me@host" }, []configProblem{
+			{0, "SSH_AUTHORIZED_KEYS", "key 3 is not an SSH public key: ssh: no key found"}}},
+
+		// Webhooks
+		{"https webhook", func(c *Config) { c.WebhookURL = "https://hooks.example.com/T000/B000" }, nil},
+		{"http webhook", func(c *Config) { c.WebhookURL = "http://10.0.0.5:8080/notify" }, nil},
+		{"ftp webhook", func(c *Config) { c.WebhookURL = "ftp://example.com/hook" }, []configProblem{
+			{0, "WEBHOOK_URL", `"ftp://example.com/hook" is not an http:// or https:// URL`}}},
+		{"webhook without a host", func(c *Config) { c.WebhookURL = "https:///hook" }, []configProblem{
+			{0, "WEBHOOK_URL", `"https:///hook" is not an http:// or https:// URL`}}},
+
+		// Optional features
+		{"networks", func(c *Config) { c.LANCIDR, c.NFSAllowedNetwork = "10.0.0.0/8", "" }, nil},
+		{"invalid networks", func(c *Config) { c.LANCIDR, c.NFSAllowedNetwork = "10.0.0.0", "192.168.1.0/33" }, []configProblem{
+			{0, "LAN_CIDR", `"10.0.0.0" is not a network such as 192.168.1.0/24`},
+			{0, "NFS_ALLOWED_NETWORK", `"192.168.1.0/33" is not a network such as 192.168.1.0/24`}}},
+		{"RTC wake time", func(c *Config) { c.RTCWakeTime = "24:00" }, []configProblem{{0, "RTC_WAKE_TIME", `"24:00" is not a time such as 01:00`}}},
+		{"no swap", func(c *Config) { c.SwapSizeGB = 0 }, []configProblem{{0, "SWAP_SIZE_GB", "must be at least 1"}}},
+		{"zram size", func(c *Config) { c.ZramSizeGB = "33" }, []configProblem{{0, "ZRAM_SIZE_GB", `expected auto or a number from 1 to 32, got "33"`}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig(t)
+			tc.edit(config)
+			if got := config.validate(); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("problems =\n%+v\nwant\n%+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsAllByLine(t *testing.T) {
+	path := writeEnv(t, strings.Join([]string{
+		"INSTALL_HOSTNAME=-bad",
+		"INSTALL_PASSWORD_HASH=" + sha512Crypt([]byte("secret"), "saltsalt", sha512CryptDefaultRounds),
+		"# Network",
+		"STATIC_IP=true",
+		"GATEWAY=10.0.0.1",
+		"WEBHOOK_URL=ftp://example.com/hook",
+		"INSTALL_USERNAME=root",
+		"TIMEZONE=Mars/Olympus",
+	}, "\n"))
+	config, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not set in the file, so without a line
+	config.Locale = "xx_YY"
+
+	err = newConfigError(path, config.validate())
+	configErr, ok := err.(*configError)
+	if !ok {
+		t.Fatalf("newConfigError = %v, want a *configError", err)
+	}
+	want := []configProblem{
+		{0, "LOCALE", `unknown locale "xx_YY"; use a name such as en_US.UTF-8`},
+		{1, "INSTALL_HOSTNAME", `"-bad" is not a valid host name (letters, digits and hyphens, at most 63 characters, no hyphen at either end)`},
+		{5, "GATEWAY", "10.0.0.1 is outside the network 192.168.1.0/24 of IP_ADDRESS"},
+		{6, "WEBHOOK_URL", `"ftp://example.com/hook" is not an http:// or https:// URL`},
+		{7, "INSTALL_USERNAME", `"root" is reserved for the system`},
+		{8, "TIMEZONE", `unknown time zone "Mars/Olympus"; use a name such as Europe/London`},
+	}
+	if !reflect.DeepEqual(configErr.Problems, want) {
+		t.Errorf("problems =\n%+v\nwant\n%+v", configErr.Problems, want)
+	}
+	if lines := strings.Split(err.Error(), "\n"); len(lines) != 7 || lines[0] != "6 problem(s) in "+path+":" || lines[2] != "  line 1: INSTALL_HOSTNAME: "+want[1].Message {
+		t.Errorf("error message:\n%s", err)
+	}
+
+	if newConfigError(path, nil) != nil {
+		t.Errorf("newConfigError without problems is not nil")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  int
+		err   string
+	}{
+		{"23", 23, ""},
+		{"/23", 23, ""},
+		{"255.255.254.0", 23, ""},
+		{"1", 1, ""},
+		{"32", 32, ""},
+		{"255.255.255.255", 32, ""},
+		{"128.0.0.0", 1, ""},
+		{"0", 0, "prefix length 0 is not between 1 and 32"},
+		{"33", 0, "prefix length 33 is not between 1 and 32"},
+		{"/33", 0, "prefix length /33 is not between 1 and 32"},
+		{"-1", 0, "prefix length -1 is not between 1 and 32"},
+		{"0.0.0.0", 0, "0.0.0.0 is not a valid netmask"},
+		{"255.255.0.255", 0, "255.255.0.255 is not a valid netmask"}, // not contiguous
+		{"255.0.255.0", 0, "255.0.255.0 is not a valid netmask"},
+		{"255.255.255", 0, `"255.255.255" is neither a prefix length such as 24 nor a netmask such as 255.255.255.0`},
+		{"ffff:ffff::", 0, `"ffff:ffff::" is neither a prefix length such as 24 nor a netmask such as 255.255.255.0`},
+	} {
+		got, err := parsePrefix(tc.value)
+		switch {
+		case tc.err == "" && (err != nil || got != tc.want):
+			t.Errorf("parsePrefix(%q) = %d, %v, want %d", tc.value, got, err, tc.want)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("parsePrefix(%q) = %d, %v, want error %q", tc.value, got, err, tc.err)
+		}
+	}
+}
+
+func TestPrefixLength(t *testing.T) {
+	for _, tc := range []struct {
+		cidrPrefix, netmask string
+		want                int
+		err                 string
+	}{
+		{"", "", 24, ""},
+		{"22", "", 22, ""},
+		{"", "255.255.252.0", 22, ""},
+		{"", "22", 22, ""},
+		{"/22", "255.255.252.0", 22, ""},
+		{"255.255.252.0", "22", 22, ""},
+		{"23", "255.255.255.0", 0, "CIDR_PREFIX 23 and NETMASK 255.255.255.0 disagree; set only one"},
+		{"0", "", 0, "prefix length 0 is not between 1 and 32"},
+		{"", "255.0.255.0", 0, "255.0.255.0 is not a valid netmask"},
+	} {
+		config := &Config{CIDRPrefix: tc.cidrPrefix, Netmask: tc.netmask}
+		got, err := config.prefixLength()
+		switch {
+		case tc.err == "" && (err != nil || got != tc.want):
+			t.Errorf("CIDR_PREFIX %q, NETMASK %q: got %d, %v, want %d", tc.cidrPrefix, tc.netmask, got, err, tc.want)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("CIDR_PREFIX %q, NETMASK %q: got %d, %v, want error %q", tc.cidrPrefix, tc.netmask, got, err, tc.err)
+		}
+	}
+}
+
+func TestValidatePrefixKey(t *testing.T) {
+	for _, tc := range []struct {
+		cidrPrefix, netmask string
+		want                configProblem
+	}{
+		{"33", "", configProblem{0, "CIDR_PREFIX", "prefix length 33 is not between 1 and 32"}},
+		{"", "255.0.255.0", configProblem{0, "NETMASK", "255.0.255.0 is not a valid netmask"}},
+		{"23", "255.255.255.0", configProblem{0, "NETMASK", "CIDR_PREFIX 23 and NETMASK 255.255.255.0 disagree; set only one"}},
+	} {
+		config := testConfig(t)
+		config.StaticIP, config.CIDRPrefix, config.Netmask = true, tc.cidrPrefix, tc.netmask
+		if got := config.validate(); !reflect.DeepEqual(got, []configProblem{tc.want}) {
+			t.Errorf("CIDR_PREFIX %q, NETMASK %q: problems %+v, want %+v", tc.cidrPrefix, tc.netmask, got, tc.want)
+		}
+	}
+}
+
+// A /22 lab network, given either way, reaches user-data as a prefix and
+// config.env as NETMASK=22, which the first-boot scripts read.
+func TestLoadConfigPrefix(t *testing.T) {
+	for _, setting := range []string{"NETMASK=255.255.252.0", "CIDR_PREFIX=/22", "CIDR_PREFIX=22\nNETMASK=255.255.252.0"} {
+		inTempDir(t)
+		env := strings.Join([]string{
+			"INSTALL_USERNAME=labadmin",
+			"INSTALL_PASSWORD_HASH=" + sha512Crypt([]byte("secret"), "saltsalt", sha512CryptDefaultRounds),
+			"STATIC_IP=true",
+			"IP_ADDRESS=10.20.5.50",
+			"GATEWAY=10.20.4.1",
+			setting,
+		}, "\n")
+		if err := os.WriteFile(".env", []byte(env), 0600); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig()
+		if err != nil {
+			t.Fatalf("%s: %v", setting, err)
+		}
+		if userData := generateUserData(config, config.PasswordHash); !strings.Contains(userData, "\n          - 10.20.5.50/22\n") {
+			t.Errorf("%s: user-data lacks the address 10.20.5.50/22:\n%s", setting, userData)
+		}
+		if configEnv := generateConfigEnv(config); !strings.Contains(configEnv, "\nNETMASK=22\n") {
+			t.Errorf("%s: config.env lacks NETMASK=22:\n%s", setting, configEnv)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// manifestName is the file in the root of each volume that lists the
+// SHA-256 of every other file on it. It uses the sha256sum format, so it can
+// also be checked with `sha256sum -c` from the mounted volume.
+const manifestName = "usb-creator.sha256"
+
+type manifestEntry struct {
+	Name string
+	Hash string
+}
+
+// manifest collects the hashes of the files written to one volume, keyed by
+// upper-case name since FAT is case-insensitive and a file may be replaced
+// after it was first copied.
+type manifest map[string]manifestEntry
+
+func (m manifest) add(name, hash string) {
+	m[strings.ToUpper(name)] = manifestEntry{Name: name, Hash: hash}
+}
+
+func (m manifest) entries() []manifestEntry {
+	entries := make([]manifestEntry, 0, len(m))
+	for _, e := range m {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+func (m manifest) bytes() []byte {
+	var b bytes.Buffer
+	for _, e := range m.entries() {
+		fmt.Fprintf(&b, "%s  %s\n", e.Hash, e.Name)
+	}
+	return b.Bytes()
+}
+
+// parseManifest reads a manifest written by manifest.bytes.
+func parseManifest(data []byte) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		hash, name, ok := strings.Cut(text, "  ")
+		if !ok || len(hash) != sha256.Size*2 || name == "" {
+			return nil, fmt.Errorf("%s line %d: invalid entry", manifestName, line)
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid hash", manifestName, line)
+		}
+		entries = append(entries, manifestEntry{Name: name, Hash: strings.ToLower(hash)})
+	}
+	return entries, scanner.Err()
+}
+
+// volumeReport is the outcome of verifying one volume. Err is set when the
+// volume or its manifest could not be read at all.
+type volumeReport struct {
+	Volume   string
+	Checked  int
+	Failures []string
+	Err      error
+}
+
+// verifyDisk reads both volumes of a stick or disk image back through the
+// raw device and checks every file against the volume's manifest.
+func verifyDisk(path string) ([]volumeReport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	parts, err := readGPT(f)
+	if err != nil {
+		return nil, err
+	}
+	var reports []volumeReport
+	for _, vol := range []Volume{VolumeESP, VolumeData} {
+		partType := gptTypeESP
+		if vol == VolumeData {
+			partType = gptTypeBasicData
+		}
+		var part *gptPartition
+		for i := range parts {
+			if parts[i].Type == partType {
+				part = &parts[i]
+				break
+			}
+		}
+		report := volumeReport{Volume: vol.String()}
+		if part == nil {
+			report.Err = fmt.Errorf("partition not found")
+			reports = append(reports, report)
+			continue
+		}
+
+		region := &regionDevice{
+			dev:    f,
+			offset: int64(part.FirstLBA * sectorSize),
+			size:   int64((part.LastLBA - part.FirstLBA + 1) * sectorSize),
+		}
+		fsys, err := openFAT32(region)
+		if err == nil {
+			report.verify(fsys.ReadFile, func(name string) (string, error) {
+				r, _, err := fsys.Open(name)
+				if err != nil {
+					return "", err
+				}
+				return sha256Sum(r)
+			})
+		} else {
+			report.Err = err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// verifyDir checks the files of a mounted volume, such as E:\ on Windows,
+// against its manifest.
+func verifyDir(dir string) volumeReport {
+	report := volumeReport{Volume: dir}
+	report.verify(func(name string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	}, func(name string) (string, error) {
+		return sha256Hash(filepath.Join(dir, filepath.FromSlash(name)))
+	})
+	return report
+}
+
+func (r *volumeReport) verify(readFile func(string) ([]byte, error), hash func(string) (string, error)) {
+	data, err := readFile(manifestName)
+	if err != nil {
+		r.Err = fmt.Errorf("no %s found; was this drive made by usb-creator? (%v)", manifestName, err)
+		return
+	}
+	entries, err := parseManifest(data)
+	if err != nil {
+		r.Err = err
+		return
+	}
+	for _, e := range entries {
+		r.Checked++
+		got, err := hash(e.Name)
+		switch {
+		case err != nil:
+			r.Failures = append(r.Failures, fmt.Sprintf("%s: %v", e.Name, err))
+		case got != e.Hash:
+			r.Failures = append(r.Failures, fmt.Sprintf("%s: SHA-256 mismatch", e.Name))
+		}
+	}
+}
+
+// printVerifyReport prints one line per volume and every failed file, and
+// reports whether everything passed.
+func printVerifyReport(reports []volumeReport, p progress) bool {
+	passed := true
+	for _, r := range reports {
+		switch {
+		case r.Err != nil:
+			p("❌ %s: %v", r.Volume, r.Err)
+			passed = false
+		case len(r.Failures) > 0:
+			p("❌ %s: %d of %d files failed verification", r.Volume, len(r.Failures), r.Checked)
+			for _, failure := range r.Failures {
+				p("   %s", failure)
+			}
+			passed = false
+		default:
+			p("✓ %s: %d files verified", r.Volume, r.Checked)
+		}
+	}
+	return passed
+}
+
+// runVerify implements `usb-creator verify [target]`, which checks a stick
+// made earlier. The target may be a drive or disk image, read directly, or
+// a mounted volume; without one the user picks a USB drive.
+func runVerify(args []string) int {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Println("Usage: usb-creator verify [drive, disk image or mounted volume]")
+	}
+	flags.Parse(args)
+	target := flags.Arg(0)
+
+	if target == "" {
+		if runtime.GOOS != "windows" && runtime.GOOS != "linux" {
+			fmt.Println("This tool supports Windows and Linux only. Pass a disk image or mounted volume to verify.")
+			return 1
+		}
+		if !isAdmin() {
+			fmt.Println("⚠️  Reading USB drives requires Administrator privileges.")
+			fmt.Println("   " + adminHint)
+			return 1
+		}
+		backend, err := newPlatformBackend(partitionSizes{})
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return 1
+		}
+		target = chooseUSBDrive(backend, "\nEnter drive number to verify: ").DeviceID
+	}
+
+	// "E:" names the current folder on E:, not its root
+	if filepath.VolumeName(target) == target {
+		target += string(filepath.Separator)
+	}
+
+	fmt.Printf("\n🔍 Verifying %s...\n", target)
+	var reports []volumeReport
+	var err error
+	if info, statErr := os.Stat(target); statErr == nil && info.IsDir() {
+		reports = []volumeReport{verifyDir(target)}
+	} else if reports, err = verifyDisk(target); err != nil {
+		fmt.Printf("\n❌ Error reading %s: %v\n", target, err)
+		return 1
+	}
+
+	if !printVerifyReport(reports, newProgress("")) {
+		fmt.Println("\n❌ Verification failed. Recreate the drive, or replace it if it fails again.")
+		return 1
+	}
+	fmt.Println("\n✅ All files verified successfully")
+	return 0
+}
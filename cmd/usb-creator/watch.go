@@ -0,0 +1,311 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often drives are listed where no hotplug events are available
+	watchPollInterval = 3 * time.Second
+
+	// Time for a new drive's partitions and properties to appear before it
+	// is listed
+	watchSettleDelay = 2 * time.Second
+)
+
+// runWatch implements `usb-creator watch`, a kiosk mode that creates a stick
+// on every removable drive plugged in while it runs, without prompts. Drives
+// connected before it started are never touched.
+func runWatch(args []string) int {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	isoPath := flags.String("iso", "", "Ubuntu ISO to write (default: newest LTS in downloads/)")
+	espSize := flags.String("esp-size", defaultESPSize, "Size of the EFI system partition")
+	dataSize := flags.String("data-size", "", "Size of the data partition (default: rest of the drive)")
+	maxDriveSize := flags.String("max-drive-size", defaultMaxDriveSize, "Ignore drives larger than this without --force")
+	force := flags.Bool("force", false, "Also write drives larger than --max-drive-size")
+	unmount := flags.Bool("unmount", false, "Also write drives with mounted filesystems, unmounting them first, as desktops mount sticks")
+	logPath := flags.String("log", "", "Append a line per finished stick to this file")
+	flags.Parse(args)
+
+	sizes, err := parsePartitionSizes(*espSize, *dataSize)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+	maxSize, err := parseSize(*maxDriveSize)
+	if err != nil {
+		fmt.Printf("Error: invalid --max-drive-size %q: %v\n", *maxDriveSize, err)
+		return 1
+	}
+	if runtime.GOOS != "windows" && runtime.GOOS != "linux" {
+		fmt.Println("This tool supports Windows and Linux only.")
+		return 1
+	}
+	if !isAdmin() {
+		fmt.Println("⚠️  This program requires Administrator privileges.")
+		fmt.Println("   " + adminHint)
+		return 1
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Printf("Error loading configuration: %v\n", err)
+		return 1
+	}
+	if *isoPath == "" {
+		catalog, err := loadCatalog("")
+		if err != nil {
+			fmt.Printf("Error loading release catalog: %v\n", err)
+			return 1
+		}
+		if releases := catalog.find(defaultArch, defaultFlavor); len(releases) > 0 {
+			*isoPath = filepath.Join(DefaultDownloadDir, releases[0].FileName())
+		}
+	}
+	info, err := os.Stat(*isoPath)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		fmt.Println("Pass the Ubuntu ISO to write with --iso")
+		return 1
+	}
+	if info.IsDir() {
+		fmt.Printf("❌ Refusing to use %s: extracted ISO contents cannot be checked against the signed Ubuntu checksums\n", *isoPath)
+		fmt.Println("Pass the Ubuntu ISO to write with --iso")
+		return 1
+	}
+	id, err := identifyISOFile(*isoPath)
+	if err != nil {
+		fmt.Printf("❌ Refusing to use %s: %v\n", *isoPath, err)
+		return 1
+	}
+
+	// Every stick gets this ISO without anyone looking, so it must match
+	// the signed Ubuntu checksum before the first one is written
+	isoName := id.FileName()
+	if hasValidStamp(*isoPath, isoName) {
+		fmt.Println("✓ ISO was verified against the signed Ubuntu checksum")
+	} else {
+		urls := isoSourceURLs(isoName)
+		if urls == nil {
+			fmt.Printf("❌ Refusing to use %s: no signed checksums are published for %s\n", *isoPath, isoName)
+			return 1
+		}
+		fmt.Println("🔐 Verifying ISO checksum...")
+		if err := verifyISO(*isoPath, append(mirrorURLs(config.ISOMirrors, urls[0]), urls[1:]...)...); err != nil {
+			fmt.Printf("❌ Refusing to use %s: %v\n", *isoPath, err)
+			return 1
+		}
+		fmt.Println("✓ ISO matches the signed Ubuntu checksum")
+	}
+	fmt.Printf("💿 %s\n", id.Release)
+
+	var logFile *os.File
+	if *logPath != "" {
+		if logFile, err = os.OpenFile(*logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+			fmt.Printf("Error opening log: %v\n", err)
+			return 1
+		}
+		defer logFile.Close()
+	}
+
+	w := &driveWatcher{
+		isoPath: *isoPath,
+		sizes:   sizes,
+		config:  config,
+		guard:   &driveGuard{MaxSize: maxSize, Force: *force, Unmount: *unmount},
+		log:     logFile,
+		known:   make(map[string]DriveInfo),
+		refused: make(map[string]string),
+		busy:    make(map[string]bool),
+	}
+	w.write = w.create
+	printConfigSummary(config)
+	return w.run()
+}
+
+// driveWatcher tracks the connected drives and starts a creation run on
+// each new one.
+type driveWatcher struct {
+	isoPath string
+	sizes   partitionSizes
+	config  *Config
+	guard   *driveGuard
+	log     *os.File
+	write   func(drive DriveInfo) // create, run for each drive started
+
+	mu    sync.Mutex
+	known map[string]DriveInfo // by DeviceID
+	// refused holds why new drives failed the guard. They are not known
+	// yet, so every scan checks them again, e.g. once a desktop that
+	// mounted them is done or their size can be read.
+	refused map[string]string
+	busy    map[string]bool
+}
+
+func (w *driveWatcher) run() int {
+	drives, err := listUSBDrives()
+	if err != nil {
+		fmt.Printf("Error listing drives: %v\n", err)
+		return 1
+	}
+	for _, d := range drives {
+		w.known[d.DeviceID] = d
+	}
+	if len(drives) > 0 {
+		fmt.Printf("💾 Leaving the %d drive(s) already connected alone\n", len(drives))
+	}
+	fmt.Printf("👀 Watching for new USB drives to write %s to. Press Ctrl+C to stop.\n\n", w.isoPath)
+
+	events := driveEvents()
+	for {
+		// Nothing signals when a refused drive is unmounted, so it is
+		// polled for
+		var retry <-chan time.Time
+		if w.hasRefused() {
+			retry = time.After(watchPollInterval)
+		}
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return 0
+			}
+			time.Sleep(watchSettleDelay)
+			settleDrives()
+		case <-retry:
+		}
+		if err := w.scan(); err != nil {
+			w.report("⚠️  Error listing drives: %v", err)
+		}
+	}
+}
+
+func (w *driveWatcher) hasRefused() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.refused) > 0
+}
+
+// scan lists the drives, forgets removed ones and starts on new ones. A
+// drive counts as new when its device was free, or now has a different size
+// or serial number, which means the stick was swapped between two scans.
+func (w *driveWatcher) scan() error {
+	drives, err := listUSBDrives()
+	if err != nil {
+		return err
+	}
+	w.start(drives)
+	return nil
+}
+
+// start starts a creation run with write on each new drive of drives that
+// passes the guard.
+func (w *driveWatcher) start(drives []DriveInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	present := make(map[string]bool)
+	for _, d := range drives {
+		present[d.DeviceID] = true
+		old, ok := w.known[d.DeviceID]
+		swapped := ok && (old.Size != d.Size || old.Serial != "" && d.Serial != "" && old.Serial != d.Serial)
+		if ok && !swapped || w.busy[d.DeviceID] {
+			continue
+		}
+
+		if !d.IsRemovable {
+			w.known[d.DeviceID] = d
+			w.report("⏭️  %s: %s is not a removable drive; skipped", driveLabel(&d), d.Model)
+			continue
+		}
+		if err := w.guard.check(&d); err != nil {
+			// Reported once per reason, as the drive is checked again
+			if w.refused[d.DeviceID] != err.Error() {
+				w.refused[d.DeviceID] = err.Error()
+				w.report("⛔ %s: %v", driveLabel(&d), err)
+			}
+			continue
+		}
+		delete(w.refused, d.DeviceID)
+		w.known[d.DeviceID] = d
+		w.busy[d.DeviceID] = true
+		go w.write(d)
+	}
+	for id := range w.known {
+		if !present[id] {
+			delete(w.known, id)
+		}
+	}
+	for id := range w.refused {
+		if !present[id] {
+			delete(w.refused, id)
+		}
+	}
+}
+
+// create builds one stick and logs the outcome.
+func (w *driveWatcher) create(drive DriveInfo) {
+	defer func() {
+		w.mu.Lock()
+		delete(w.busy, drive.DeviceID)
+		w.mu.Unlock()
+
+		// A stick swapped in while this one was busy raised no event of
+		// its own since
+		if err := w.scan(); err != nil {
+			w.report("⚠️  Error listing drives: %v", err)
+		}
+	}()
+
+	label := driveLabel(&drive)
+	w.report("🔧 %s: writing %s %s (serial %s)", label, drive.Model, drive.SizeDisplay, drive.Serial)
+	start := time.Now()
+
+	backend, err := newPlatformBackend(w.sizes)
+	if err == nil {
+		fanout := newISOFanout(w.isoPath, 1)
+		go fanout.run()
+		err = createBootableUSB(backend, &drive, fanout.view(0), w.config, w.guard, newProgress("["+label+"] "))
+	}
+
+	elapsed := time.Since(start).Round(time.Second)
+	if err != nil {
+		w.report("❌ %s: %s %s (serial %s) failed after %s: %v", label, drive.Model, drive.SizeDisplay, drive.Serial, elapsed, err)
+		return
+	}
+	w.report("✅ %s: %s %s (serial %s) created and verified in %s; remove it and insert the next",
+		label, drive.Model, drive.SizeDisplay, drive.Serial, elapsed)
+}
+
+// report prints a timestamped line and appends it to the log file, if any.
+func (w *driveWatcher) report(format string, args ...any) {
+	line := time.Now().Format("2006-01-02 15:04:05") + " " + fmt.Sprintf(format, args...)
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	fmt.Println(line)
+	if w.log != nil {
+		fmt.Fprintln(w.log, line)
+	}
+}
+
+// driveLabel is the short device name, such as sdb or PhysicalDrive2.
+func driveLabel(drive *DriveInfo) string {
+	return drive.DeviceID[strings.LastIndexAny(drive.DeviceID, `/\`)+1:]
+}
+
+// pollDriveEvents signals every watchPollInterval, for platforms or systems
+// without hotplug notifications.
+func pollDriveEvents() <-chan struct{} {
+	events := make(chan struct{})
+	go func() {
+		for range time.Tick(watchPollInterval) {
+			events <- struct{}{}
+		}
+	}()
+	return events
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os/exec"
+	"syscall"
+)
+
+// driveEvents signals whenever the kernel reports a block device being
+// added, removed or changed, on the uevent netlink socket udev itself
+// listens on. Without netlink access it falls back to polling.
+func driveEvents() <-chan struct{} {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return pollDriveEvents()
+	}
+	// Group 1 carries the kernel's own events
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: 1}); err != nil {
+		syscall.Close(fd)
+		return pollDriveEvents()
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 64<<10)
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EINTR || err == syscall.ENOBUFS {
+				continue
+			}
+			if err != nil {
+				close(events)
+				return
+			}
+			if isBlockUevent(buf[:n]) {
+				select {
+				case events <- struct{}{}:
+				default: // a scan is already due
+				}
+			}
+		}
+	}()
+	return events
+}
+
+// isBlockUevent reports whether a uevent message, "action@devpath" followed
+// by NUL-separated KEY=value pairs, is about a block device.
+func isBlockUevent(msg []byte) bool {
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		if string(field) == "SUBSYSTEM=block" {
+			return true
+		}
+	}
+	return false
+}
+
+// settleDrives waits for udev to finish processing the events so far, so
+// new drives are listed with their model and serial number.
+func settleDrives() {
+	exec.Command("udevadm", "settle").Run()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+// driveEvents signals periodically; drive arrival is found by listing.
+func driveEvents() <-chan struct{} {
+	return pollDriveEvents()
+}
+
+func settleDrives() {}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDriveWatcherRetriesRefused(t *testing.T) {
+	started := make(chan DriveInfo, 4)
+	w := &driveWatcher{
+		guard:   &driveGuard{MaxSize: 256 << 30},
+		known:   make(map[string]DriveInfo),
+		refused: make(map[string]string),
+		busy:    make(map[string]bool),
+		write:   func(drive DriveInfo) { started <- drive },
+	}
+	stick := DriveInfo{DeviceID: "/dev/sdb", Size: 16 << 30, SizeDisplay: "16.00GB", Serial: "1234", IsRemovable: true}
+
+	// The desktop mounted the stick before the first scan
+	mounted := stick
+	mounted.Mounted = "/media/user/STICK"
+	w.start([]DriveInfo{mounted})
+	w.start([]DriveInfo{mounted})
+	if len(started) != 0 || len(w.refused) != 1 || len(w.known) != 0 {
+		t.Fatalf("a mounted stick was started, or not kept for another check: refused %v, known %v", w.refused, w.known)
+	}
+
+	// Once it is unmounted, the next scan writes it
+	w.start([]DriveInfo{stick})
+	select {
+	case d := <-started:
+		if d.DeviceID != stick.DeviceID {
+			t.Errorf("started %s, want %s", d.DeviceID, stick.DeviceID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the unmounted stick was not started")
+	}
+	if len(w.refused) != 0 || !w.busy[stick.DeviceID] {
+		t.Errorf("after the start: refused %v, busy %v", w.refused, w.busy)
+	}
+
+	// Removing a refused drive forgets it
+	w.start([]DriveInfo{{DeviceID: "/dev/sdc", Size: 512 << 30, IsRemovable: true}})
+	if _, ok := w.refused["/dev/sdc"]; !ok {
+		t.Fatalf("a drive above --max-drive-size was not refused")
+	}
+	w.start(nil)
+	if len(w.refused) != 0 {
+		t.Errorf("refused drives that were removed are kept: %v", w.refused)
+	}
+}
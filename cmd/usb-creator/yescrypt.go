@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// yescrypt, as libxcrypt implements it for $y$ hashes, limited to the
+// default flavor: read-write mode with the pwxform settings below, p = 1,
+// t = 0 and no ROM. See https://www.openwall.com/yescrypt/.
+
+const (
+	// Cost of the hashes created, that of libxcrypt and Ubuntu ("j9T")
+	yescryptDefaultNLog2 = 12
+	yescryptDefaultR     = 32
+
+	// Flavor of YESCRYPT_DEFAULTS, encoded as "j"
+	yescryptFlavor = 47
+
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	sWidth    = 8
+
+	sBytes = 3 * (1 << sWidth) * pwxSimple * 8
+	sMask  = ((1 << sWidth) - 1) * pwxSimple * 8
+)
+
+// yescryptCrypt returns the $y$ hash of password with the binary salt, for
+// N = 2^nLog2 and block size r.
+func yescryptCrypt(password, salt []byte, nLog2, r int) string {
+	var out strings.Builder
+	out.WriteString("$y$")
+	encodeYescryptUint(&out, yescryptFlavor, 0)
+	encodeYescryptUint(&out, uint32(nLog2), 1)
+	encodeYescryptUint(&out, uint32(r), 1)
+	out.WriteByte('$')
+	encodeYescryptBytes(&out, salt)
+	out.WriteByte('$')
+	encodeYescryptBytes(&out, yescryptKey(password, salt, 1<<nLog2, r))
+	return out.String()
+}
+
+// yescryptKey derives the 32-byte hash. Large settings first hash the
+// password with N/64, so that a quick rejection costs memory too.
+func yescryptKey(password, salt []byte, n, r int) []byte {
+	if n >= 0x100 && n*r >= 0x20000 {
+		password = yescryptBody(password, salt, n>>6, r, true)
+	}
+	return yescryptBody(password, salt, n, r, false)
+}
+
+func yescryptBody(password, salt []byte, n, r int, prehash bool) []byte {
+	label := "yescrypt"
+	if prehash {
+		label = "yescrypt-prehash"
+	}
+	passwd := hmacSHA256([]byte(label), password)
+	b := pbkdf2.Key(passwd, salt, 1, 128*r, sha256.New)
+	copy(passwd, b[:32])
+
+	yescryptSmix(b, r, n, passwd)
+
+	dk := pbkdf2.Key(passwd, b, 1, 32, sha256.New)
+	if prehash {
+		return dk
+	}
+	// The client and stored keys of SCRAM (RFC 5802)
+	storedKey := sha256.Sum256(hmacSHA256(dk, []byte("Client Key")))
+	return storedKey[:]
+}
+
+func hmacSHA256(key, message []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// yescryptSmix runs SMix on b in place: the S-boxes are filled from the
+// first block, passwd is mixed with the last 64 bytes, and then the
+// read-write SMix1 and SMix2 of yescrypt run over N blocks.
+func yescryptSmix(b []byte, r, n int, passwd []byte) {
+	s := 32 * r
+	nloop := ((n+2)/3 + 1) &^ 1
+
+	sbox := make([]uint32, sBytes/4)
+	x := loadYescryptBlocks(b[:128])
+	yescryptSmix1(x, 1, sBytes/128, sbox, nil)
+	storeYescryptBlocks(b[:128], x)
+	ctx := newPwxform(sbox)
+	copy(passwd, hmacSHA256(b[128*r-64:128*r], passwd))
+
+	x = loadYescryptBlocks(b)
+	v := make([]uint32, n*s)
+	yescryptSmix1(x, r, n, v, ctx)
+	yescryptSmix2(x, r, n, nloop, v, ctx)
+	storeYescryptBlocks(b, x)
+}
+
+// Blocks are kept in the shuffled word order of the reference code, which
+// pwxform works on: word i of every 64 bytes holds word i*5%16 of the data.
+
+func loadYescryptBlocks(b []byte) []uint32 {
+	x := make([]uint32, len(b)/4)
+	for k := 0; k < len(x); k += 16 {
+		for i := 0; i < 16; i++ {
+			x[k+i] = binary.LittleEndian.Uint32(b[(k+i*5%16)*4:])
+		}
+	}
+	return x
+}
+
+func storeYescryptBlocks(b []byte, x []uint32) {
+	for k := 0; k < len(x); k += 16 {
+		for i := 0; i < 16; i++ {
+			binary.LittleEndian.PutUint32(b[(k+i*5%16)*4:], x[k+i])
+		}
+	}
+}
+
+// yescryptSmix1 fills v with n blocks of x. With pwxform, each step also
+// mixes in an earlier block.
+func yescryptSmix1(x []uint32, r, n int, v []uint32, ctx *pwxform) {
+	s := 32 * r
+	for i := 0; i < n; i++ {
+		copy(v[i*s:], x)
+		if ctx != nil && i > 1 {
+			p := 1 << (bits.Len(uint(i)) - 1)
+			j := int(integerify(x, r)&uint64(p-1)) + i - p
+			xorWords(x, v[j*s:(j+1)*s])
+		}
+		yescryptBlockMix(x, r, ctx)
+	}
+}
+
+// yescryptSmix2 mixes x with nloop blocks of v chosen by x, writing each back.
+func yescryptSmix2(x []uint32, r, n, nloop int, v []uint32, ctx *pwxform) {
+	s := 32 * r
+	for i := 0; i < nloop; i++ {
+		j := int(integerify(x, r) & uint64(n-1))
+		xorWords(x, v[j*s:(j+1)*s])
+		copy(v[j*s:], x)
+		yescryptBlockMix(x, r, ctx)
+	}
+}
+
+// integerify returns the first 64 bits of the last 64 bytes of x.
+func integerify(x []uint32, r int) uint64 {
+	last := x[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+func xorWords(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+// yescryptBlockMix is the BlockMix of scrypt with Salsa20/8 without ctx, and
+// the pwxform BlockMix of yescrypt with it.
+func yescryptBlockMix(b []uint32, r int, ctx *pwxform) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+	if ctx == nil {
+		y := make([]uint32, len(b))
+		for i := 0; i < 2*r; i += 2 {
+			xorWords(x[:], b[i*16:(i+1)*16])
+			salsa20(&x, 8)
+			copy(y[i*8:], x[:])
+			xorWords(x[:], b[(i+1)*16:(i+2)*16])
+			salsa20(&x, 8)
+			copy(y[i*8+r*16:], x[:])
+		}
+		copy(b, y)
+		return
+	}
+
+	// pwxform blocks are 64 bytes, so there are 2r of them
+	for i := 0; i < 2*r; i++ {
+		xorWords(x[:], b[i*16:(i+1)*16])
+		ctx.transform(&x)
+		copy(b[i*16:], x[:])
+	}
+	salsa20(&x, 2)
+	copy(b[(2*r-1)*16:], x[:])
+}
+
+// salsa20 applies the Salsa20 core with the given rounds to a shuffled block.
+func salsa20(b *[16]uint32, rounds int) {
+	var x [16]uint32
+	for i := range b {
+		x[i*5%16] = b[i]
+	}
+	for i := 0; i < rounds; i += 2 {
+		x[4] ^= bits.RotateLeft32(x[0]+x[12], 7)
+		x[8] ^= bits.RotateLeft32(x[4]+x[0], 9)
+		x[12] ^= bits.RotateLeft32(x[8]+x[4], 13)
+		x[0] ^= bits.RotateLeft32(x[12]+x[8], 18)
+		x[9] ^= bits.RotateLeft32(x[5]+x[1], 7)
+		x[13] ^= bits.RotateLeft32(x[9]+x[5], 9)
+		x[1] ^= bits.RotateLeft32(x[13]+x[9], 13)
+		x[5] ^= bits.RotateLeft32(x[1]+x[13], 18)
+		x[14] ^= bits.RotateLeft32(x[10]+x[6], 7)
+		x[2] ^= bits.RotateLeft32(x[14]+x[10], 9)
+		x[6] ^= bits.RotateLeft32(x[2]+x[14], 13)
+		x[10] ^= bits.RotateLeft32(x[6]+x[2], 18)
+		x[3] ^= bits.RotateLeft32(x[15]+x[11], 7)
+		x[7] ^= bits.RotateLeft32(x[3]+x[15], 9)
+		x[11] ^= bits.RotateLeft32(x[7]+x[3], 13)
+		x[15] ^= bits.RotateLeft32(x[11]+x[7], 18)
+
+		x[1] ^= bits.RotateLeft32(x[0]+x[3], 7)
+		x[2] ^= bits.RotateLeft32(x[1]+x[0], 9)
+		x[3] ^= bits.RotateLeft32(x[2]+x[1], 13)
+		x[0] ^= bits.RotateLeft32(x[3]+x[2], 18)
+		x[6] ^= bits.RotateLeft32(x[5]+x[4], 7)
+		x[7] ^= bits.RotateLeft32(x[6]+x[5], 9)
+		x[4] ^= bits.RotateLeft32(x[7]+x[6], 13)
+		x[5] ^= bits.RotateLeft32(x[4]+x[7], 18)
+		x[11] ^= bits.RotateLeft32(x[10]+x[9], 7)
+		x[8] ^= bits.RotateLeft32(x[11]+x[10], 9)
+		x[9] ^= bits.RotateLeft32(x[8]+x[11], 13)
+		x[10] ^= bits.RotateLeft32(x[9]+x[8], 18)
+		x[12] ^= bits.RotateLeft32(x[15]+x[14], 7)
+		x[13] ^= bits.RotateLeft32(x[12]+x[15], 9)
+		x[14] ^= bits.RotateLeft32(x[13]+x[12], 13)
+		x[15] ^= bits.RotateLeft32(x[14]+x[13], 18)
+	}
+	for i := range b {
+		b[i] += x[i*5%16]
+	}
+}
+
+// pwxform holds the three S-boxes of yescrypt, of 64-bit words, and the
+// position the next write to s2 goes to.
+type pwxform struct {
+	s0, s1, s2 []uint64
+	w          int
+}
+
+func newPwxform(sbox []uint32) *pwxform {
+	words := make([]uint64, len(sbox)/2)
+	for i := range words {
+		words[i] = uint64(sbox[2*i+1])<<32 | uint64(sbox[2*i])
+	}
+	third := len(words) / 3
+	return &pwxform{s2: words[:third], s1: words[third : 2*third], s0: words[2*third:]}
+}
+
+// transform runs pwxform on a 64-byte block, seen as pwxGather lanes of
+// pwxSimple 64-bit words.
+func (ctx *pwxform) transform(b *[16]uint32) {
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			lane := j * pwxSimple * 2
+			p0 := int(b[lane]&sMask) / 8
+			p1 := int(b[lane+1]&sMask) / 8
+			for k := 0; k < pwxSimple; k++ {
+				w := lane + k*2
+				x := uint64(b[w+1])*uint64(b[w]) + ctx.s0[p0+k]
+				x ^= ctx.s1[p1+k]
+				b[w], b[w+1] = uint32(x), uint32(x>>32)
+				if i != 0 && i != pwxRounds-1 {
+					ctx.s2[ctx.w] = x
+					ctx.w++
+				}
+			}
+		}
+	}
+	ctx.s0, ctx.s1, ctx.s2 = ctx.s2, ctx.s0, ctx.s1
+	ctx.w &= (1<<sWidth)*pwxSimple - 1
+}
+
+// encodeYescryptUint writes a yescrypt parameter of at least min in its
+// variable-length encoding.
+func encodeYescryptUint(out *strings.Builder, value, min uint32) {
+	value -= min
+	start, end, chars, shift := uint32(0), uint32(47), 1, 0
+	for {
+		count := (end + 1 - start) << shift
+		if value < count {
+			break
+		}
+		start = end + 1
+		end = start + (62-end)/2
+		value -= count
+		chars++
+		shift += 6
+	}
+	out.WriteByte(cryptAlphabet[start+value>>shift])
+	for ; chars > 1; chars-- {
+		shift -= 6
+		out.WriteByte(cryptAlphabet[value>>shift&0x3f])
+	}
+}
+
+// encodeYescryptBytes writes data in the little-endian base 64 of yescrypt.
+func encodeYescryptBytes(out *strings.Builder, data []byte) {
+	for i := 0; i < len(data); {
+		var value uint32
+		n := 0
+		for ; n < 24 && i < len(data); n += 8 {
+			value |= uint32(data[i]) << n
+			i++
+		}
+		for ; n > 0; n -= 6 {
+			out.WriteByte(cryptAlphabet[value&0x3f])
+			value >>= 6
+		}
+	}
+}
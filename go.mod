@@ -2,4 +2,13 @@ module ubuntu-auto-installer
 
 go 1.21
 
-require golang.org/x/crypto v0.18.0
+require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	golang.org/x/crypto v0.18.0
+	golang.org/x/term v0.18.0
+)
+
+require (
+	github.com/cloudflare/circl v1.3.7 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+)
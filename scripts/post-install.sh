@@ -392,12 +392,13 @@ configure_ssh() {
         USER_HOME=$(getent passwd "$INSTALL_USERNAME" | cut -d: -f6)
         [ -z "$USER_HOME" ] && USER_HOME="/home/$INSTALL_USERNAME"
         mkdir -p "$USER_HOME/.ssh"
+        # One key per line; config.env stores line breaks as \n
         while IFS= read -r key_line; do
             [ -z "$key_line" ] && continue
             if ! grep -qF "$key_line" "$USER_HOME/.ssh/authorized_keys" 2>/dev/null; then
                 echo "$key_line" >> "$USER_HOME/.ssh/authorized_keys"
             fi
-        done <<< "$SSH_AUTHORIZED_KEYS"
+        done <<< "${SSH_AUTHORIZED_KEYS//\\n/$'\n'}"
         chmod 700 "$USER_HOME/.ssh"
         chmod 600 "$USER_HOME/.ssh/authorized_keys"
         chown -R "$INSTALL_USERNAME:$INSTALL_USERNAME" "$USER_HOME/.ssh"